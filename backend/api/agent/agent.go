@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/api"
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"github.com/MeteorsLiu/virtuallabs/backend/worker"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// AuthMiddleware 校验 Authorization: Bearer <令牌>，并将虚拟机及其所有者写入上下文
+func AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "缺少代理令牌"})
+			return
+		}
+
+		var vm models.VirtualMachine
+		if err := api.DB.Where("agent_token_hash = ?", worker.HashAgentToken(token)).First(&vm).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "无效的代理令牌"})
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "数据库查询失败"})
+			return
+		}
+
+		var svm models.StudentVirtualMachine
+		if err := api.DB.Where("vm_id = ?", vm.VMID).First(&svm).Error; err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "虚拟机未分配给学生"})
+			return
+		}
+
+		c.Set("agentVM", &vm)
+		c.Set("agentStudentID", svm.StudentID)
+		c.Next()
+	}
+}
+
+type StepStatus struct {
+	models.ExperimentStep
+	Completed   bool       `json:"completed"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+}
+
+// 获取虚拟机所属实验的步骤及当前学生的完成情况
+func GetStepsHandler(c *gin.Context) {
+	vm := c.MustGet("agentVM").(*models.VirtualMachine)
+
+	steps, err := StudentSteps(vm.ExperimentID, c.GetInt("agentStudentID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询实验步骤失败"})
+		return
+	}
+	c.JSON(http.StatusOK, steps)
+}
+
+// 上报步骤完成，重复上报保留首次完成的时间
+func CompleteStepHandler(c *gin.Context) {
+	vm := c.MustGet("agentVM").(*models.VirtualMachine)
+	studentID := c.GetInt("agentStudentID")
+
+	var req struct {
+		Detail string `json:"detail" binding:"max=500"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var step models.ExperimentStep
+	if err := api.DB.Where("experiment_id = ? AND step_key = ?", vm.ExperimentID, c.Param("stepKey")).First(&step).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "实验步骤不存在"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询失败"})
+		return
+	}
+
+	completion := models.StepCompletion{
+		StudentID:    studentID,
+		StepID:       step.StepID,
+		ExperimentID: vm.ExperimentID,
+		VMID:         vm.VMID,
+		Detail:       req.Detail,
+		CompletedAt:  time.Now(),
+	}
+	if err := api.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&completion).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "记录步骤完成失败"})
+		return
+	}
+
+	// 重复上报时返回首次完成的记录
+	if err := api.DB.Where("student_id = ? AND step_id = ?", studentID, step.StepID).First(&completion).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询失败"})
+		return
+	}
+	c.JSON(http.StatusOK, completion)
+}
+
+// StudentSteps 返回实验的全部步骤及学生的完成情况，按 SortOrder 排序
+func StudentSteps(experimentID, studentID int) ([]StepStatus, error) {
+	var steps []models.ExperimentStep
+	if err := api.DB.Where("experiment_id = ?", experimentID).
+		Order("sort_order, step_id").Find(&steps).Error; err != nil {
+		return nil, err
+	}
+	var completions []models.StepCompletion
+	if err := api.DB.Where("experiment_id = ? AND student_id = ?", experimentID, studentID).
+		Find(&completions).Error; err != nil {
+		return nil, err
+	}
+
+	done := make(map[int]time.Time, len(completions))
+	for _, sc := range completions {
+		done[sc.StepID] = sc.CompletedAt
+	}
+	out := make([]StepStatus, len(steps))
+	for i, s := range steps {
+		out[i].ExperimentStep = s
+		if t, ok := done[s.StepID]; ok {
+			out[i].Completed = true
+			out[i].CompletedAt = &t
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,14 @@
+package agent
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// Register 注册虚拟机内进度代理使用的接口，使用每台虚拟机独立的令牌认证
+func Register(router *gin.Engine) {
+	agentGroup := router.Group("/agent").Use(AuthMiddleware())
+	{
+		agentGroup.GET("/steps", GetStepsHandler)
+		agentGroup.POST("/steps/:stepKey/complete", CompleteStepHandler)
+	}
+}
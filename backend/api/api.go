@@ -1,13 +1,22 @@
 package api
 
 import (
+	"crypto/subtle"
 	"encoding/base64"
+	"fmt"
 	"net/http"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/MeteorsLiu/virtuallabs/backend/config"
 	. "github.com/MeteorsLiu/virtuallabs/backend/models"
+	"github.com/MeteorsLiu/virtuallabs/backend/queue"
+	"github.com/MeteorsLiu/virtuallabs/backend/worker"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
@@ -16,15 +25,37 @@ import (
 // DB 为全局数据库操作句柄
 var DB *gorm.DB
 
+// 上传文件的本地存储目录，对外以 /uploads 路径提供
+var UploadDir = "uploads"
+
+// 实验和镜像可选用的 PriorityClass
+var PriorityClasses []string
+
+// 虚拟机内进度代理访问后端的地址
+var AgentURL string
+
 // initDB 初始化数据库连接，并自动迁移所有模型
-func InitDB(secret, dsn string) {
+func InitDB(c config.Config) {
 	var err error
-	DB, err = gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	DB, err = gorm.Open(mysql.Open(c.DB.DSN), &gorm.Config{})
 	if err != nil {
 		panic("数据库连接失败：" + err.Error())
 	}
 	DB.Set("gorm:table_options", "ENGINE=InnoDB CHARSET=utf8mb4")
 
+	sqlDB, err := DB.DB()
+	if err != nil {
+		panic("数据库连接失败：" + err.Error())
+	}
+	sqlDB.SetMaxOpenConns(c.DB.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(c.DB.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(c.DB.ConnMaxLifetime)
+
+	// 唯一索引需在自动迁移前清理旧数据中的重复行，否则建索引失败
+	if err := dedupeStudentGrades(DB); err != nil {
+		panic("成绩数据去重失败：" + err.Error())
+	}
+
 	// 自动迁移所有模型
 	DB.AutoMigrate(
 		// 第一阶段：核心独立表
@@ -37,8 +68,13 @@ func InitDB(secret, dsn string) {
 
 		// 第三阶段：成绩和题目系统
 		&StudentGrade{},   // 依赖 CourseAssessment
+		&GradeOverride{},  // 依赖 StudentGrade
 		&Question{},       // 依赖 Course 和 CourseChapter
 		&QuestionOption{}, // 依赖 Question
+		&QuestionTag{},
+		&AssessmentPool{},
+		&CourseGradePolicy{},
+		&CourseGrade{},
 
 		// 第四阶段：其他关联表
 		&Class{},
@@ -46,15 +82,53 @@ func InitDB(secret, dsn string) {
 		&TeacherClass{},
 		&Enrollment{},
 		&TeacherCourse{},
+		&LabImage{},
 		&Experiment{},
 		&TeacherExperiment{},
+		&ExperimentFile{},
 		&VirtualMachine{},
 		&StudentVirtualMachine{},
+		&ExperimentStep{},
+		&StepCompletion{},
+		&OutboxMessage{},
+		&AssessmentAttempt{},
 		&StudentAnswer{},
 		&StudentAnswerOption{},
 	)
 
-	JwtSecret = []byte(secret)
+	JwtSecret = []byte(c.JWT.Secret)
+	JwtExpire = c.JWT.Expire
+	UploadDir = c.UploadDir
+	PriorityClasses = c.PriorityClasses
+	AgentURL = c.Agent.URL
+}
+
+// dedupeStudentGrades 在 student_grades 尚无 idx_student_assessment 唯一索引时删除重复成绩，
+// 同一学生同一评分项只保留最后更新的一条
+func dedupeStudentGrades(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasTable(&StudentGrade{}) || m.HasIndex(&StudentGrade{}, "idx_student_assessment") {
+		return nil
+	}
+	return db.Exec(`DELETE g FROM student_grades g
+		JOIN student_grades newer ON newer.student_id = g.student_id AND newer.assessment_id = g.assessment_id
+			AND (newer.updated_at > g.updated_at OR (newer.updated_at = g.updated_at AND newer.grade_id > g.grade_id))`).Error
+}
+
+// ValidateScheduling 校验调度约束，PriorityClass 只能从配置的列表中选择
+func ValidateScheduling(s *queue.Scheduling) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	if s != nil && s.PriorityClassName != "" && !slices.Contains(PriorityClasses, s.PriorityClassName) {
+		return fmt.Errorf("不允许使用的 priorityClassName: %s", s.PriorityClassName)
+	}
+	return nil
+}
+
+// UploadPath 将 /uploads 开头的访问地址转换为本地文件路径
+func UploadPath(url string) string {
+	return filepath.Join(UploadDir, filepath.FromSlash(strings.TrimPrefix(url, "/uploads/")))
 }
 
 // hashPassword 对密码进行 SHA256 哈希
@@ -94,11 +168,28 @@ func RoleMiddleware(allowedRoles ...string) gin.HandlerFunc {
 	}
 }
 
-func UseCORS() gin.HandlerFunc {
+// UseCORS 跨域中间件，origins 为空或包含 * 时允许所有来源
+func UseCORS(origins []string) gin.HandlerFunc {
+	allowAll := len(origins) == 0
+	allowed := make(map[string]bool, len(origins))
+	for _, o := range origins {
+		if o == "*" {
+			allowAll = true
+		}
+		allowed[o] = true
+	}
+
 	return func(ctx *gin.Context) {
-		ctx.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		ctx.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		ctx.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Accept, Origin, Cache-Control, X-Requested-With")
+		if allowAll {
+			ctx.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			ctx.Writer.Header().Add("Vary", "Origin")
+			if origin := ctx.GetHeader("Origin"); allowed[origin] {
+				ctx.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+				ctx.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		ctx.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, X-Request-ID, Authorization, Accept, Origin, Cache-Control, X-Requested-With")
 		ctx.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, PUT, DELETE, OPTIONS")
 		if ctx.Request.Method == "OPTIONS" {
 			ctx.AbortWithStatus(204)
@@ -107,3 +198,32 @@ func UseCORS() gin.HandlerFunc {
 		ctx.Next()
 	}
 }
+
+// TraceMiddleware 为每个请求分配链路 ID，优先沿用调用方传入的 X-Request-ID，
+// 随虚拟机指令写入消息信封，便于在工作节点日志中追踪
+func TraceMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if id == "" || len(id) > 64 {
+			id = uuid.NewString()
+		}
+		c.Set(queue.TraceIDKey, id)
+		c.Header("X-Request-ID", id)
+		c.Next()
+	}
+}
+
+// WorkerAuthMiddleware 校验工作节点回调携带的共享密钥，未配置密钥时放行
+func WorkerAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if worker.Secret == "" {
+			c.Next()
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader(worker.SecretHeader)), []byte(worker.Secret)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "无效的工作节点密钥"})
+			return
+		}
+		c.Next()
+	}
+}
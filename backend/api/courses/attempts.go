@@ -0,0 +1,482 @@
+package courses
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/api"
+	"github.com/MeteorsLiu/virtuallabs/backend/grading"
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+//
+// 作答接口：学生开始作答后在截止时间前保存答案，显式提交或到期自动提交后评分
+//
+
+// AnswerRequest 按题型填写对应字段：选择题和判断题填选项，填空题按空的顺序填答案
+type AnswerRequest struct {
+	QuestionID    int      `json:"questionId" binding:"required"`
+	OptionIDs     []int    `json:"optionIds"`
+	BlankAnswers  []string `json:"blankAnswers" binding:"max=10,dive,max=500"`
+	NumericAnswer *float64 `json:"numericAnswer"`
+	TextAnswer    string   `json:"textAnswer" binding:"max=10000"`
+}
+
+// AttemptDetail 作答详情，包含题目和本次作答已保存的答案
+type AttemptDetail struct {
+	models.AssessmentAttempt
+	RemainingSeconds *int                   `json:"remainingSeconds,omitempty"` // 作答中且限时时返回
+	Questions        []models.Question      `json:"questions"`
+	Answers          []models.StudentAnswer `json:"answers"`
+}
+
+// 开始作答（学生），已有进行中的作答时直接返回，作答次数用完或评分项截止后不能再开始
+func StartAttempt(c *gin.Context) {
+	studentID := c.GetInt("userID")
+	assessmentID, _ := strconv.Atoi(c.Param("assessmentId"))
+
+	var assessment models.CourseAssessment
+	if err := api.DB.First(&assessment, assessmentID).Error; err != nil {
+		handleAssessmentError(c, err)
+		return
+	}
+	if !isEnrolled(studentID, assessment.CourseID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无课程访问权限"})
+		return
+	}
+
+	var latest models.AssessmentAttempt
+	err := api.DB.Where("assessment_id = ? AND student_id = ?", assessmentID, studentID).
+		Order("attempt_no DESC").First(&latest).Error
+	switch {
+	case err == nil && latest.Status == grading.StatusInProgress:
+		if grading.Expired(&latest, time.Now()) {
+			if _, err := grading.Submit(api.DB, latest.AttemptID, true); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "提交作答失败"})
+				return
+			}
+			c.JSON(http.StatusConflict, gin.H{"error": "作答已超时并自动提交"})
+			return
+		}
+		respondAttempt(c, http.StatusOK, &latest)
+		return
+	case err == nil:
+		if assessment.MaxAttempts > 0 && latest.AttemptNo >= assessment.MaxAttempts {
+			c.JSON(http.StatusConflict, gin.H{"error": "作答次数已用完"})
+			return
+		}
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询作答失败"})
+		return
+	}
+	// 截止后答案可能已经公布
+	if grading.PastDue(&assessment, time.Now()) {
+		c.JSON(http.StatusConflict, gin.H{"error": "评分项已截止，不能开始作答"})
+		return
+	}
+
+	// 每次作答单独抽题并确定顺序
+	drawn, err := grading.DrawQuestions(api.DB, &assessment)
+	if err != nil {
+		if errors.Is(err, grading.ErrPoolTooSmall) {
+			c.JSON(http.StatusConflict, gin.H{"error": "题库题目不足，请联系教师"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "抽题失败"})
+		return
+	}
+
+	now := time.Now()
+	attempt := models.AssessmentAttempt{
+		AssessmentID:   assessmentID,
+		StudentID:      studentID,
+		AttemptNo:      latest.AttemptNo + 1,
+		Status:         grading.StatusInProgress,
+		StartedAt:      now,
+		DrawnQuestions: drawn,
+	}
+	if assessment.TimeLimitMinutes > 0 {
+		deadline := now.Add(time.Duration(assessment.TimeLimitMinutes) * time.Minute)
+		attempt.Deadline = &deadline
+	}
+	// 并发开始时唯一索引保证只创建一次作答
+	if err := api.DB.Create(&attempt).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "作答已开始，请刷新后重试"})
+		return
+	}
+
+	respondAttempt(c, http.StatusCreated, &attempt)
+}
+
+// 获取评分项的作答记录及各次作答的答案和得分，学生只能查看自己的作答，教师可按 studentId 筛选
+func GetAssessmentAttempts(c *gin.Context) {
+	userID := c.GetInt("userID")
+	userRole := c.GetString("userRole")
+	assessmentID, _ := strconv.Atoi(c.Param("assessmentId"))
+
+	var assessment models.CourseAssessment
+	if err := api.DB.First(&assessment, assessmentID).Error; err != nil {
+		handleAssessmentError(c, err)
+		return
+	}
+
+	query := api.DB.Where("assessment_id = ?", assessmentID)
+	switch userRole {
+	case "student":
+		query = query.Where("student_id = ?", userID)
+	case "teacher":
+		if !isCourseTeacher(userID, assessment.CourseID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "无课程操作权限"})
+			return
+		}
+		if studentID := c.Query("studentId"); studentID != "" {
+			query = query.Where("student_id = ?", studentID)
+		}
+	default:
+		c.JSON(http.StatusForbidden, gin.H{"error": "无权查看作答"})
+		return
+	}
+
+	var attempts []models.AssessmentAttempt
+	if err := query.Preload("Answers.Selections").Order("student_id, attempt_no").Find(&attempts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询作答失败"})
+		return
+	}
+	if userRole == "student" {
+		reveal, err := grading.CanReveal(api.DB, &assessment, userID, time.Now())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "查询作答失败"})
+			return
+		}
+		// 逐题公布时已保存的答案都已公布
+		if !reveal && !grading.RevealsPerQuestion(&assessment) {
+			for i := range attempts {
+				hideAnswerResults(attempts[i].Answers)
+			}
+		}
+	}
+	c.JSON(http.StatusOK, attempts)
+}
+
+// 获取作答详情
+func GetAttempt(c *gin.Context) {
+	attempt, ok := loadAttempt(c)
+	if !ok {
+		return
+	}
+	if attempt.Status == grading.StatusInProgress && grading.Expired(attempt, time.Now()) {
+		submitted, err := grading.Submit(api.DB, attempt.AttemptID, true)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "提交作答失败"})
+			return
+		}
+		attempt = submitted
+	}
+	respondAttempt(c, http.StatusOK, attempt)
+}
+
+// 保存作答中的一道题的答案，重复保存以最后一次为准（学生）
+func SaveAttemptAnswer(c *gin.Context) {
+	attempt, ok := loadAttempt(c)
+	if !ok {
+		return
+	}
+
+	var req AnswerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	saveAnswer(c, attempt, &req)
+}
+
+// 提交作答并评分（学生）
+func SubmitAttempt(c *gin.Context) {
+	attempt, ok := loadAttempt(c)
+	if !ok {
+		return
+	}
+	if attempt.Status != grading.StatusInProgress {
+		c.JSON(http.StatusConflict, gin.H{"error": "作答已提交"})
+		return
+	}
+
+	submitted, err := grading.Submit(api.DB, attempt.AttemptID, grading.Expired(attempt, time.Now()))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "提交作答失败"})
+		return
+	}
+	c.JSON(http.StatusOK, submitted)
+}
+
+// saveAnswer 在作答中保存答案，截止时间已过时自动提交并拒绝保存，attempt 需预加载 Assessment
+func saveAnswer(c *gin.Context, attempt *models.AssessmentAttempt, req *AnswerRequest) {
+	if attempt.Status != grading.StatusInProgress {
+		c.JSON(http.StatusConflict, gin.H{"error": "作答已提交，不能修改答案"})
+		return
+	}
+	if grading.Expired(attempt, time.Now()) {
+		if _, err := grading.Submit(api.DB, attempt.AttemptID, true); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "提交作答失败"})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "作答已超时并自动提交"})
+		return
+	}
+
+	inPaper, err := grading.InPaper(api.DB, attempt, req.QuestionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询题目失败"})
+		return
+	}
+	var question models.Question
+	if !inPaper || api.DB.Preload("Options").First(&question, req.QuestionID).Error != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效题目或评分项"})
+		return
+	}
+	if err := validateAnswer(&question, req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx := api.DB.Begin()
+	defer tx.Rollback()
+
+	// 作答行加锁，与提交互斥，避免提交评分后仍写入答案
+	var locked models.AssessmentAttempt
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&locked, attempt.AttemptID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存答案失败"})
+		return
+	}
+	if locked.Status != grading.StatusInProgress {
+		c.JSON(http.StatusConflict, gin.H{"error": "作答已提交，不能修改答案"})
+		return
+	}
+	perQuestion := grading.RevealsPerQuestion(&attempt.Assessment)
+
+	// 替换本题之前保存的答案
+	var previous []int
+	if err := tx.Model(&models.StudentAnswer{}).
+		Where("attempt_id = ? AND question_id = ?", attempt.AttemptID, req.QuestionID).
+		Pluck("answer_id", &previous).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存答案失败"})
+		return
+	}
+	if perQuestion && len(previous) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "该题答案已公布，不能修改"})
+		return
+	}
+	if len(previous) > 0 {
+		if err := tx.Where("answer_id IN ?", previous).Delete(&models.StudentAnswerOption{}).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "保存答案失败"})
+			return
+		}
+		if err := tx.Delete(&models.StudentAnswer{}, previous).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "保存答案失败"})
+			return
+		}
+	}
+
+	answer := models.StudentAnswer{
+		StudentID:  attempt.StudentID,
+		QuestionID: req.QuestionID,
+		AttemptID:  &attempt.AttemptID,
+		AnswerTime: time.Now(),
+	}
+	switch question.QuestionType {
+	case grading.TypeFillBlank:
+		answer.BlankAnswers = req.BlankAnswers
+	case grading.TypeNumeric:
+		answer.NumericAnswer = req.NumericAnswer
+	case grading.TypeShortAnswer:
+		answer.TextAnswer = req.TextAnswer
+	}
+	if err := tx.Create(&answer).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存答案失败"})
+		return
+	}
+	if !grading.UsesOptions(question.QuestionType) {
+		req.OptionIDs = nil
+	}
+	for _, optID := range req.OptionIDs {
+		sel := models.StudentAnswerOption{AnswerID: answer.AnswerID, OptionID: optID}
+		if err := tx.Create(&sel).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "保存选项失败"})
+			return
+		}
+		answer.Selections = append(answer.Selections, sel)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "提交事务失败"})
+		return
+	}
+	// 逐题公布时随答案返回本题的正确答案和解析
+	if perQuestion {
+		answer.Question = question
+	}
+	c.JSON(http.StatusOK, answer)
+}
+
+// validateAnswer 按题型校验答案内容
+func validateAnswer(question *models.Question, req *AnswerRequest) error {
+	switch question.QuestionType {
+	case grading.TypeSingle, grading.TypeMultiple, grading.TypeTrueFalse:
+		if question.QuestionType != grading.TypeMultiple && len(req.OptionIDs) > 1 {
+			return errors.New("该题只能选择一个选项")
+		}
+		valid := make(map[int]bool, len(question.Options))
+		for _, opt := range question.Options {
+			valid[opt.OptionID] = true
+		}
+		for _, id := range req.OptionIDs {
+			if !valid[id] {
+				return errors.New("无效的选项")
+			}
+		}
+	case grading.TypeFillBlank:
+		if len(req.BlankAnswers) != len(question.Blanks) {
+			return fmt.Errorf("需要填写 %d 个空", len(question.Blanks))
+		}
+	case grading.TypeNumeric:
+		if req.NumericAnswer == nil || math.IsNaN(*req.NumericAnswer) || math.IsInf(*req.NumericAnswer, 0) {
+			return errors.New("请填写有效数值")
+		}
+	}
+	return nil
+}
+
+// loadAttempt 加载路径中的作答，学生只能访问自己的作答，教师需负责所属课程
+func loadAttempt(c *gin.Context) (*models.AssessmentAttempt, bool) {
+	userID := c.GetInt("userID")
+	attemptID, _ := strconv.Atoi(c.Param("attemptId"))
+
+	var attempt models.AssessmentAttempt
+	if err := api.DB.Preload("Assessment").First(&attempt, attemptID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			handleNotFound(c, "作答")
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询作答失败"})
+		return nil, false
+	}
+
+	switch c.GetString("userRole") {
+	case "student":
+		if attempt.StudentID == userID {
+			return &attempt, true
+		}
+	case "teacher":
+		if isCourseTeacher(userID, attempt.Assessment.CourseID) {
+			return &attempt, true
+		}
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "无权访问该作答"})
+	return nil, false
+}
+
+// respondAttempt 返回作答详情，学生按评分项的公布方式决定是否可见正确答案和解析
+func respondAttempt(c *gin.Context, status int, attempt *models.AssessmentAttempt) {
+	detail := AttemptDetail{AssessmentAttempt: *attempt}
+
+	showAnswers := c.GetString("userRole") == "teacher"
+	var assessment models.CourseAssessment
+	if !showAnswers {
+		if err := api.DB.First(&assessment, attempt.AssessmentID).Error; err != nil {
+			handleAssessmentError(c, err)
+			return
+		}
+		reveal, err := grading.CanReveal(api.DB, &assessment, attempt.StudentID, time.Now())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "获取题目失败"})
+			return
+		}
+		showAnswers = reveal
+	}
+
+	questions, err := grading.PaperQuestions(api.DB, attempt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取题目失败"})
+		return
+	}
+	detail.Questions = questions
+	if err := api.DB.Preload("Selections").
+		Where("attempt_id = ?", attempt.AttemptID).
+		Find(&detail.Answers).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取答案失败"})
+		return
+	}
+	switch {
+	case showAnswers:
+	case grading.RevealsPerQuestion(&assessment):
+		hideUnansweredKeys(detail.Questions, detail.Answers)
+	default:
+		hideAnswerKey(detail.Questions)
+		hideAnswerResults(detail.Answers)
+	}
+
+	if attempt.Status == grading.StatusInProgress && attempt.Deadline != nil {
+		remaining := max(0, int(time.Until(*attempt.Deadline).Seconds()))
+		detail.RemainingSeconds = &remaining
+	}
+	c.JSON(status, detail)
+}
+
+// hideAnswerKey 清除正确答案标记、填空题可接受答案、数值题答案和解析
+func hideAnswerKey(questions []models.Question) {
+	for i := range questions {
+		q := &questions[i]
+		q.Explanation = ""
+		for j := range q.Options {
+			q.Options[j].IsCorrect = false
+		}
+		for j := range q.Blanks {
+			q.Blanks[j].Accepted = nil
+		}
+		q.NumericAnswer = nil
+		q.Tolerance = 0
+	}
+}
+
+// hideUnansweredKeys 逐题公布时只保留已保存答案的题目的正确答案和解析
+func hideUnansweredKeys(questions []models.Question, answers []models.StudentAnswer) {
+	answered := make(map[int]bool, len(answers))
+	for _, a := range answers {
+		answered[a.QuestionID] = true
+	}
+	for i := range questions {
+		if !answered[questions[i].QuestionID] {
+			hideAnswerKey(questions[i : i+1])
+		}
+	}
+}
+
+// hideAnswerResults 清除答案的判分结果
+func hideAnswerResults(answers []models.StudentAnswer) {
+	for i := range answers {
+		answers[i].IsCorrect = nil
+	}
+}
+
+func isEnrolled(studentID, courseID int) bool {
+	var count int64
+	api.DB.Model(&models.Enrollment{}).
+		Where("student_id = ? AND course_id = ?", studentID, courseID).
+		Count(&count)
+	return count > 0
+}
+
+func handleAssessmentError(c *gin.Context, err error) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		handleNotFound(c, "评分项")
+	} else {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询评分项失败"})
+	}
+}
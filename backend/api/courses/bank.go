@@ -0,0 +1,177 @@
+package courses
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/api"
+	"github.com/MeteorsLiu/virtuallabs/backend/grading"
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+//
+// 题库与抽题接口：评分项可从课程题库按标签抽题，并为每个学生打乱题目和选项顺序
+//
+
+type PoolRequest struct {
+	Tag   string `json:"tag" binding:"required,max=50"`
+	Count int    `json:"count" binding:"required,min=1,max=200"`
+}
+
+type DrawRulesRequest struct {
+	ShuffleQuestions bool          `json:"shuffleQuestions"`
+	ShuffleOptions   bool          `json:"shuffleOptions"`
+	Pools            []PoolRequest `json:"pools" binding:"max=20,dive"`
+}
+
+// PoolStatus 抽题规则及题库中可抽取的题目数
+type PoolStatus struct {
+	models.AssessmentPool
+	Available int64 `json:"available"`
+}
+
+type DrawRules struct {
+	ShuffleQuestions bool         `json:"shuffleQuestions"`
+	ShuffleOptions   bool         `json:"shuffleOptions"`
+	Pools            []PoolStatus `json:"pools"`
+}
+
+// 获取课程题库（教师），可按标签过滤
+func GetQuestionBank(c *gin.Context) {
+	teacherID := c.GetInt("userID")
+	courseID, _ := strconv.Atoi(c.Param("courseId"))
+	if !isCourseTeacher(teacherID, courseID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无课程操作权限"})
+		return
+	}
+
+	query := api.DB.Preload("Options").Preload("Tags").
+		Where("questions.course_id = ? AND questions.assessment_id = 0", courseID)
+	if tag := c.Query("tag"); tag != "" {
+		query = query.Joins("JOIN question_tags ON question_tags.question_id = questions.question_id").
+			Where("question_tags.tag = ?", tag)
+	}
+
+	var questions []models.Question
+	if err := query.Order("questions.question_id").Find(&questions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取题库失败"})
+		return
+	}
+	c.JSON(http.StatusOK, questions)
+}
+
+// 获取评分项的抽题规则（教师）
+func GetDrawRules(c *gin.Context) {
+	assessment, ok := loadTeacherAssessment(c)
+	if !ok {
+		return
+	}
+	respondDrawRules(c, assessment)
+}
+
+// 设置评分项的抽题规则和乱序设置（教师），题库题目不足时拒绝保存。已开始的作答不受影响
+func UpdateDrawRules(c *gin.Context) {
+	assessment, ok := loadTeacherAssessment(c)
+	if !ok {
+		return
+	}
+
+	var req DrawRulesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	seen := make(map[string]bool, len(req.Pools))
+	for _, p := range req.Pools {
+		if seen[p.Tag] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "抽题规则的标签重复: " + p.Tag})
+			return
+		}
+		seen[p.Tag] = true
+
+		available, err := grading.PoolSize(api.DB, assessment.CourseID, p.Tag)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "查询题库失败"})
+			return
+		}
+		if int64(p.Count) > available {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("标签 %s 的题库只有 %d 道题", p.Tag, available)})
+			return
+		}
+	}
+
+	assessment.ShuffleQuestions, assessment.ShuffleOptions = req.ShuffleQuestions, req.ShuffleOptions
+	if err := api.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(assessment).
+			Select("shuffle_questions", "shuffle_options").
+			Updates(assessment).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("assessment_id = ?", assessment.AssessmentID).Delete(&models.AssessmentPool{}).Error; err != nil {
+			return err
+		}
+		for _, p := range req.Pools {
+			pool := models.AssessmentPool{AssessmentID: assessment.AssessmentID, Tag: p.Tag, Count: p.Count}
+			if err := tx.Create(&pool).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存抽题规则失败"})
+		return
+	}
+	respondDrawRules(c, assessment)
+}
+
+func respondDrawRules(c *gin.Context, assessment *models.CourseAssessment) {
+	var pools []models.AssessmentPool
+	if err := api.DB.Where("assessment_id = ?", assessment.AssessmentID).Order("pool_id").Find(&pools).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询抽题规则失败"})
+		return
+	}
+
+	rules := DrawRules{
+		ShuffleQuestions: assessment.ShuffleQuestions,
+		ShuffleOptions:   assessment.ShuffleOptions,
+		Pools:            make([]PoolStatus, len(pools)),
+	}
+	for i, p := range pools {
+		available, err := grading.PoolSize(api.DB, assessment.CourseID, p.Tag)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "查询题库失败"})
+			return
+		}
+		rules.Pools[i] = PoolStatus{AssessmentPool: p, Available: available}
+	}
+	c.JSON(http.StatusOK, rules)
+}
+
+// loadTeacherAssessment 加载路径中的评分项，要求教师负责所属课程
+func loadTeacherAssessment(c *gin.Context) (*models.CourseAssessment, bool) {
+	assessmentID, _ := strconv.Atoi(c.Param("assessmentId"))
+
+	var assessment models.CourseAssessment
+	if err := api.DB.First(&assessment, assessmentID).Error; err != nil {
+		handleAssessmentError(c, err)
+		return nil, false
+	}
+	if !isCourseTeacher(c.GetInt("userID"), assessment.CourseID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无课程操作权限"})
+		return nil, false
+	}
+	return &assessment, true
+}
+
+// isRandomized 评分项是否按学生抽题或乱序，此时学生只能在开始作答后按自己的题目查看
+func isRandomized(assessment *models.CourseAssessment) bool {
+	if assessment.ShuffleQuestions || assessment.ShuffleOptions {
+		return true
+	}
+	var count int64
+	api.DB.Model(&models.AssessmentPool{}).Where("assessment_id = ?", assessment.AssessmentID).Count(&count)
+	return count > 0
+}
@@ -2,15 +2,16 @@ package courses
 
 import (
 	"errors"
+	"math"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/MeteorsLiu/virtuallabs/backend/api"
+	"github.com/MeteorsLiu/virtuallabs/backend/grading"
 	"github.com/MeteorsLiu/virtuallabs/backend/models"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
 )
 
 //
@@ -216,6 +217,11 @@ type AssessmentRequest struct {
 	MaxScore       float64 `json:"maxScore" binding:"required,min=0,max=1000"`
 	Weight         float64 `json:"weight" binding:"min=0,max=100"`
 	AssessmentDate string  `json:"assessmentDate" binding:"required"`
+
+	TimeLimitMinutes int    `json:"timeLimitMinutes" binding:"min=0,max=1440"`                                           // 作答时限，0 表示不限时
+	MaxAttempts      *int   `json:"maxAttempts" binding:"omitempty,min=0,max=100"`                                       // 为空时只能作答一次，0 表示不限
+	ScoringPolicy    string `json:"scoringPolicy" binding:"omitempty,oneof=highest latest average"`                      // 为空时取最高分
+	RevealPolicy     string `json:"revealPolicy" binding:"omitempty,oneof=immediately after_submission after_due never"` // 为空时提交后公布
 }
 
 // 创建评分项（教师权限）
@@ -234,6 +240,17 @@ func CreateAssessment(c *gin.Context) {
 		return
 	}
 
+	maxAttempts := 1
+	if req.MaxAttempts != nil {
+		maxAttempts = *req.MaxAttempts
+	}
+	if req.ScoringPolicy == "" {
+		req.ScoringPolicy = grading.PolicyHighest
+	}
+	if req.RevealPolicy == "" {
+		req.RevealPolicy = grading.RevealAfterSubmission
+	}
+
 	parsedTime, _ := api.ToTime(req.AssessmentDate)
 	assessment := models.CourseAssessment{
 		CourseID:       courseID,
@@ -242,9 +259,21 @@ func CreateAssessment(c *gin.Context) {
 		MaxScore:       req.MaxScore,
 		Weight:         req.Weight,
 		AssessmentDate: parsedTime,
+
+		TimeLimitMinutes: req.TimeLimitMinutes,
+		MaxAttempts:      maxAttempts,
+		ScoringPolicy:    req.ScoringPolicy,
+		RevealPolicy:     req.RevealPolicy,
 	}
 
-	if err := api.DB.Create(&assessment).Error; err != nil {
+	if err := api.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&assessment).Error; err != nil {
+			return err
+		}
+		// 日期已过的新评分项（例如补录的往期测验）会按缺考计入总评，
+		// 日期未到的评分项在截止后由 ensureFinalGrades 补算
+		return grading.RecomputeCourseGrades(tx, courseID)
+	}); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建评分项失败"})
 		return
 	}
@@ -252,153 +281,30 @@ func CreateAssessment(c *gin.Context) {
 	c.JSON(http.StatusCreated, assessment)
 }
 
-// 提交答案并返回用户回答+正确答案
+// 保存答案到当前进行中的作答（学生），需先开始作答
 func SubmitAnswer(c *gin.Context) {
 	studentID := c.GetInt("userID")
 	assessmentID, _ := strconv.Atoi(c.Param("assessmentId"))
 
-	var req struct {
-		QuestionID int   `json:"questionId" binding:"required"`
-		OptionIDs  []int `json:"optionIds" binding:"required"`
-	}
-
+	var req AnswerRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// 获取题目及正确答案
-	var question models.Question
-
-	if err := api.DB.Preload("Options").
-		Where("questions.question_id = ? AND questions.assessment_id = ?", req.QuestionID, assessmentID).
-		First(&question).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效题目或评分项"})
-		return
-	}
-
-	tx := api.DB.Begin()
-	defer tx.Rollback()
-
-	// 保存原始答题记录（保持原结构不变）
-	answer := models.StudentAnswer{
-		StudentID:  studentID,
-		QuestionID: req.QuestionID,
-	}
-	if err := tx.Create(&answer).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存答案失败"})
-		return
-	}
-
-	// 保存原始选项记录
-	for _, optID := range req.OptionIDs {
-		if err := tx.Create(&models.StudentAnswerOption{
-			AnswerID: answer.AnswerID,
-			OptionID: optID,
-		}).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "保存选项失败"})
+	var attempt models.AssessmentAttempt
+	if err := api.DB.Preload("Assessment").
+		Where("assessment_id = ? AND student_id = ? AND status = ?", assessmentID, studentID, grading.StatusInProgress).
+		First(&attempt).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusConflict, gin.H{"error": "请先开始作答"})
 			return
 		}
-	}
-
-	// 提交事务
-	if err := tx.Commit().Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "提交事务失败"})
-		return
-	}
-
-	// 异步计算保持不变
-	go calculateAndSaveGrade(studentID, assessmentID)
-
-	answer.Question = question
-
-	c.JSON(http.StatusCreated, answer)
-}
-
-// 计算并保存成绩
-func calculateAndSaveGrade(studentID, assessmentID int) {
-	var assessment models.CourseAssessment
-	if err := api.DB.First(&assessment, assessmentID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询作答失败"})
 		return
 	}
 
-	// 获取所有题目
-	var questions []models.Question
-	if err := api.DB.Where("assessment_id = ?", assessmentID).Find(&questions).Error; err != nil || len(questions) == 0 {
-		return
-	}
-
-	// 计算得分
-	correctCount := 0
-	for _, q := range questions {
-		var answer models.StudentAnswer
-		if err := api.DB.Preload("Selections").
-			Where("student_id = ? AND question_id = ?", studentID, q.QuestionID).
-			First(&answer).Error; err != nil {
-			continue
-		}
-
-		// 获取正确答案
-		var correctOptions []int
-		api.DB.Model(&models.QuestionOption{}).
-			Where("question_id = ? AND is_correct = true", q.QuestionID).
-			Pluck("option_id", &correctOptions)
-
-		// 获取学生选择
-		var selectedOptions []int
-		for _, sel := range answer.Selections {
-			selectedOptions = append(selectedOptions, sel.OptionID)
-		}
-
-		// 判断正确性
-		if isAnswerCorrect(q.QuestionType, selectedOptions, correctOptions) {
-			correctCount++
-		}
-	}
-
-	// 计算最终分数
-	score := (float64(correctCount) / float64(len(questions))) * assessment.MaxScore
-
-	// 更新或创建成绩记录
-	grade := models.StudentGrade{
-		StudentID:    studentID,
-		AssessmentID: assessmentID,
-		Score:        score,
-		GradedBy:     nil, // 标记为自动评分
-	}
-
-	api.DB.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "student_id"}, {Name: "assessment_id"}},
-		DoUpdates: clause.AssignmentColumns([]string{"score", "updated_at"}),
-	}).Create(&grade)
-}
-
-// 判断答案正确性
-func isAnswerCorrect(questionType string, selected, correct []int) bool {
-	selectedSet := make(map[int]bool)
-	for _, s := range selected {
-		selectedSet[s] = true
-	}
-
-	correctSet := make(map[int]bool)
-	for _, c := range correct {
-		correctSet[c] = true
-	}
-
-	if questionType == "single" {
-		return len(selected) == 1 && len(correct) == 1 && selected[0] == correct[0]
-	}
-
-	// 多选题必须完全匹配
-	if len(selectedSet) != len(correctSet) {
-		return false
-	}
-	for k := range correctSet {
-		if !selectedSet[k] {
-			return false
-		}
-	}
-	return true
+	saveAnswer(c, &attempt, &req)
 }
 
 // 获取课程章节列表
@@ -435,11 +341,20 @@ func GetChapters(c *gin.Context) {
 type CreateQuestionRequest struct {
 	CourseID     int                 `json:"courseId" binding:"required"`
 	ChapterID    *int                `json:"chapterId,omitempty"` // 可选章节
-	QuestionType string              `json:"questionType" binding:"required,oneof=single multiple"`
+	QuestionType string              `json:"questionType" binding:"required,oneof=single multiple true_false fill_blank numeric short_answer"`
 	Content      string              `json:"content" binding:"required,min=5,max=1000"`
 	Explanation  string              `json:"explanation,omitempty" binding:"max=2000"`
-	Options      []QuestionOptionReq `json:"options" binding:"required,min=2,max=6,dive"`
-	AssessmentID int                 `json:"assessmentId" binding:"required"` // 关联评分项
+	Options      []QuestionOptionReq `json:"options" binding:"omitempty,max=6,dive"`     // 单选、多选题选项
+	AssessmentID int                 `json:"assessmentId"`                               // 关联评分项，为 0 时加入课程题库
+	Tags         []string            `json:"tags" binding:"max=10,dive,required,max=50"` // 题库标签
+
+	IsTrue        *bool              `json:"isTrue,omitempty"`        // 判断题答案
+	Blanks        []models.BlankRule `json:"blanks,omitempty"`        // 填空题评分规则
+	NumericAnswer *float64           `json:"numericAnswer,omitempty"` // 数值题答案
+	Tolerance     float64            `json:"tolerance" binding:"min=0"`
+
+	Points        *float64 `json:"points,omitempty" binding:"omitempty,gt=0,max=999"`                                     // 题目分值，默认 1 分
+	PartialCredit string   `json:"partialCredit,omitempty" binding:"omitempty,oneof=all_or_nothing proportional penalty"` // 多选题部分得分规则
 }
 
 // 题目选项请求结构
@@ -466,14 +381,16 @@ func CreateQuestion(c *gin.Context) {
 	}
 
 	// 验证评分项属于课程
-	var assessment models.CourseAssessment
-	if err := api.DB.First(&assessment, req.AssessmentID).Error; err != nil || assessment.CourseID != req.CourseID {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的评分项"})
-		return
+	if req.AssessmentID != 0 {
+		var assessment models.CourseAssessment
+		if err := api.DB.First(&assessment, req.AssessmentID).Error; err != nil || assessment.CourseID != req.CourseID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的评分项"})
+			return
+		}
 	}
 
-	// 校验选项正确性
-	if err := validateQuestionOptions(req.QuestionType, req.Options); err != nil {
+	// 按题型校验答案设置
+	if err := validateQuestion(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
@@ -494,6 +411,19 @@ func CreateQuestion(c *gin.Context) {
 		Explanation:  req.Explanation,
 		AssessmentID: req.AssessmentID,
 	}
+	if req.Points != nil {
+		question.Points = *req.Points
+	}
+	if req.PartialCredit != "" {
+		question.PartialCredit = req.PartialCredit
+	}
+	switch req.QuestionType {
+	case grading.TypeFillBlank:
+		question.Blanks = req.Blanks
+	case grading.TypeNumeric:
+		question.NumericAnswer = req.NumericAnswer
+		question.Tolerance = req.Tolerance
+	}
 
 	if err := tx.Create(&question).Error; err != nil {
 		tx.Rollback()
@@ -516,10 +446,24 @@ func CreateQuestion(c *gin.Context) {
 		}
 	}
 
+	// 创建标签
+	seen := make(map[string]bool, len(req.Tags))
+	for _, tag := range req.Tags {
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		if err := tx.Create(&models.QuestionTag{QuestionID: question.QuestionID, Tag: tag}).Error; err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "创建标签失败"})
+			return
+		}
+	}
+
 	tx.Commit()
 
 	// 重新加载关联数据
-	api.DB.Preload("Options").First(&question, question.QuestionID)
+	api.DB.Preload("Options").Preload("Tags").First(&question, question.QuestionID)
 
 	c.JSON(http.StatusCreated, question)
 }
@@ -573,6 +517,17 @@ func GetAssessmentQuestions(c *gin.Context) {
 			c.JSON(http.StatusForbidden, gin.H{"error": "无课程访问权限"})
 			return
 		}
+		// 限时评分项的题目只能在开始作答后查看，避免提前看题
+		if assessment.TimeLimitMinutes > 0 {
+			var count int64
+			api.DB.Model(&models.AssessmentAttempt{}).
+				Where("assessment_id = ? AND student_id = ?", assessmentID, currentUserID).
+				Count(&count)
+			if count == 0 {
+				c.JSON(http.StatusForbidden, gin.H{"error": "请先开始作答"})
+				return
+			}
+		}
 	} else if userRole == "teacher" {
 		// 验证教师是否负责该课程
 		if !isCourseTeacher(currentUserID, assessment.CourseID) {
@@ -581,28 +536,93 @@ func GetAssessmentQuestions(c *gin.Context) {
 		}
 	}
 
-	// 获取题目列表
+	// 获取题目列表，学生开始作答后按最近一次作答抽到的题目和顺序查看
 	var questions []models.Question
-	if err := api.DB.Preload("Options").
-		Where("assessment_id = ?", assessmentID).
-		Order("question_id ASC"). // 按创建顺序排序
-		Find(&questions).Error; err != nil {
+	var latest models.AssessmentAttempt
+	err = gorm.ErrRecordNotFound
+	if userRole == "student" {
+		err = api.DB.Where("assessment_id = ? AND student_id = ?", assessmentID, currentUserID).
+			Order("attempt_no DESC").First(&latest).Error
+	}
+	switch {
+	case err == nil:
+		questions, err = grading.PaperQuestions(api.DB, &latest)
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+	case userRole == "student" && isRandomized(&assessment):
+		c.JSON(http.StatusForbidden, gin.H{"error": "请先开始作答"})
+		return
+	default:
+		err = api.DB.Preload("Options").
+			Where("assessment_id = ?", assessmentID).
+			Order("question_id ASC"). // 按创建顺序排序
+			Find(&questions).Error
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取题目失败"})
 		return
 	}
 
-	// 学生访问时隐藏正确答案
+	// 学生访问时按公布方式隐藏正确答案和解析
 	if userRole == "student" {
-		for i := range questions {
-			for j := range questions[i].Options {
-				questions[i].Options[j].IsCorrect = false // 清空正确答案标记
+		reveal, err := grading.CanReveal(api.DB, &assessment, currentUserID, time.Now())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "获取题目失败"})
+			return
+		}
+		switch {
+		case reveal:
+		case grading.RevealsPerQuestion(&assessment) && latest.AttemptID != 0:
+			var answers []models.StudentAnswer
+			if err := api.DB.Select("question_id").Where("attempt_id = ?", latest.AttemptID).Find(&answers).Error; err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "获取题目失败"})
+				return
 			}
+			hideUnansweredKeys(questions, answers)
+		default:
+			hideAnswerKey(questions)
 		}
 	}
 
 	c.JSON(http.StatusOK, questions)
 }
 
+// validateQuestion 按题型校验题目答案，判断题会生成“正确”“错误”两个选项
+func validateQuestion(req *CreateQuestionRequest) error {
+	if req.PartialCredit != "" && req.QuestionType != grading.TypeMultiple {
+		return errors.New("仅多选题支持部分得分规则")
+	}
+
+	switch req.QuestionType {
+	case grading.TypeSingle, grading.TypeMultiple:
+		if len(req.Options) < 2 {
+			return errors.New("选择题至少需要两个选项")
+		}
+		return validateQuestionOptions(req.QuestionType, req.Options)
+	}
+
+	if len(req.Options) > 0 {
+		return errors.New("该题型不支持选项")
+	}
+
+	switch req.QuestionType {
+	case grading.TypeTrueFalse:
+		if req.IsTrue == nil {
+			return errors.New("判断题需要设置答案")
+		}
+		req.Options = []QuestionOptionReq{
+			{Content: "正确", IsCorrect: *req.IsTrue, SortOrder: 0},
+			{Content: "错误", IsCorrect: !*req.IsTrue, SortOrder: 1},
+		}
+	case grading.TypeFillBlank:
+		return grading.ValidateBlanks(req.Blanks)
+	case grading.TypeNumeric:
+		if req.NumericAnswer == nil || math.IsNaN(*req.NumericAnswer) || math.IsInf(*req.NumericAnswer, 0) {
+			return errors.New("数值题需要设置有效答案")
+		}
+	}
+	return nil
+}
+
 // 校验题目选项逻辑
 func validateQuestionOptions(qType string, options []QuestionOptionReq) error {
 	// 检查至少有一个正确选项
@@ -681,7 +701,12 @@ func EnrollCourse(c *gin.Context) {
 		EnrollmentTime: time.Now(),
 	}
 
-	if err := api.DB.Create(&newEnrollment).Error; err != nil {
+	if err := api.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&newEnrollment).Error; err != nil {
+			return err
+		}
+		return grading.RecomputeCourseGrades(tx, courseID, studentID)
+	}); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enroll"})
 		return
 	}
@@ -698,6 +723,7 @@ func UnenrollCourse(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Enrollment not found"})
 		return
 	}
+	api.DB.Where("student_id = ? AND course_id = ?", studentID, courseID).Delete(&models.CourseGrade{})
 
 	c.JSON(http.StatusOK, gin.H{
 		"code":    http.StatusOK,
@@ -0,0 +1,152 @@
+package courses
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/api"
+	"github.com/MeteorsLiu/virtuallabs/backend/grading"
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+//
+// 课程总评接口：总评规则和按评分项权重计算的总评
+//
+
+type GradePolicyRequest struct {
+	MissingPolicy string                  `json:"missingPolicy" binding:"required,oneof=zero exclude"`
+	DropLowest    map[string]int          `json:"dropLowest"`
+	LetterGrades  []models.LetterBoundary `json:"letterGrades" binding:"required"`
+}
+
+// 获取课程总评规则，未设置时返回默认规则
+func GetGradePolicy(c *gin.Context) {
+	courseID, _ := strconv.Atoi(c.Param("courseId"))
+	if !canViewCourseGrades(c, courseID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无权查看该课程成绩"})
+		return
+	}
+
+	policy, err := grading.LoadPolicy(api.DB, courseID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询总评规则失败"})
+		return
+	}
+	c.JSON(http.StatusOK, policy)
+}
+
+// 设置课程总评规则（教师），保存后重新计算全部学生的总评
+func UpdateGradePolicy(c *gin.Context) {
+	teacherID := c.GetInt("userID")
+	courseID, _ := strconv.Atoi(c.Param("courseId"))
+	if !isCourseTeacher(teacherID, courseID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无课程操作权限"})
+		return
+	}
+
+	var req GradePolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	policy := models.CourseGradePolicy{
+		CourseID:      courseID,
+		MissingPolicy: req.MissingPolicy,
+		DropLowest:    req.DropLowest,
+		LetterGrades:  req.LetterGrades,
+	}
+	if policy.DropLowest == nil {
+		policy.DropLowest = map[string]int{}
+	}
+	if err := grading.ValidatePolicy(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := api.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&policy).Error; err != nil {
+			return err
+		}
+		return grading.RecomputeCourseGrades(tx, courseID)
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存总评规则失败"})
+		return
+	}
+	c.JSON(http.StatusOK, policy)
+}
+
+// 获取课程总评，教师获取全部选课学生（可按班级过滤），学生只能获取自己的总评
+func GetFinalGrades(c *gin.Context) {
+	userID := c.GetInt("userID")
+	courseID, _ := strconv.Atoi(c.Param("courseId"))
+	if !canViewCourseGrades(c, courseID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无权查看该课程成绩"})
+		return
+	}
+
+	if err := ensureFinalGrades(courseID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "计算总评失败"})
+		return
+	}
+
+	query := api.DB.Preload("Student.StudentInfo").
+		Joins("JOIN enrollments ON enrollments.course_id = course_grades.course_id AND enrollments.student_id = course_grades.student_id").
+		Where("course_grades.course_id = ?", courseID)
+	if c.GetString("userRole") == "student" {
+		query = query.Where("course_grades.student_id = ?", userID)
+	} else if classID := c.Query("classId"); classID != "" {
+		query = query.Joins("JOIN student_classes ON student_classes.student_id = course_grades.student_id").
+			Where("student_classes.class_id = ?", classID)
+	}
+
+	var grades []models.CourseGrade
+	if err := query.Order("course_grades.student_id").Find(&grades).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询总评失败"})
+		return
+	}
+	c.JSON(http.StatusOK, grades)
+}
+
+// ensureFinalGrades 补算尚未计算过总评的选课学生，以及在最近一个已截止评分项的日期之前计算、
+// 尚未把缺考计入的总评
+func ensureFinalGrades(courseID int) error {
+	var lastDue sql.NullTime
+	if err := api.DB.Model(&models.CourseAssessment{}).
+		Where("course_id = ? AND assessment_date <= ?", courseID, time.Now()).
+		Select("MAX(assessment_date)").Scan(&lastDue).Error; err != nil {
+		return err
+	}
+
+	query := api.DB.Model(&models.Enrollment{}).
+		Joins("LEFT JOIN course_grades ON course_grades.course_id = enrollments.course_id AND course_grades.student_id = enrollments.student_id").
+		Where("enrollments.course_id = ?", courseID)
+	if lastDue.Valid {
+		query = query.Where("course_grades.student_id IS NULL OR course_grades.updated_at < ?", lastDue.Time)
+	} else {
+		query = query.Where("course_grades.student_id IS NULL")
+	}
+	var missing []int
+	if err := query.Pluck("enrollments.student_id", &missing).Error; err != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return grading.RecomputeCourseGrades(api.DB, courseID, missing...)
+}
+
+// canViewCourseGrades 教师需负责该课程，学生需已选课
+func canViewCourseGrades(c *gin.Context, courseID int) bool {
+	userID := c.GetInt("userID")
+	switch c.GetString("userRole") {
+	case "teacher":
+		return isCourseTeacher(userID, courseID)
+	case "student":
+		return isEnrolled(userID, courseID)
+	}
+	return false
+}
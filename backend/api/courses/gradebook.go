@@ -0,0 +1,177 @@
+package courses
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/api"
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"github.com/MeteorsLiu/virtuallabs/backend/sheet"
+	"github.com/gin-gonic/gin"
+)
+
+//
+// 成绩册导出接口：学生为行、评分项为列，最后两列为总评和等级
+//
+
+type gradebookStudent struct {
+	StudentID     int
+	Username      string
+	StudentNumber string
+}
+
+// 导出课程成绩册（教师），format 为 csv（默认）或 xlsx，可按班级和评分项类型过滤
+func ExportGradebook(c *gin.Context) {
+	teacherID := c.GetInt("userID")
+	courseID, _ := strconv.Atoi(c.Param("courseId"))
+
+	var course models.Course
+	if err := api.DB.First(&course, courseID).Error; err != nil {
+		handleCourseError(c, err)
+		return
+	}
+	if !isCourseTeacher(teacherID, courseID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无课程操作权限"})
+		return
+	}
+
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "xlsx" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "导出格式只支持 csv 和 xlsx"})
+		return
+	}
+
+	rows, err := buildGradebook(courseID, c.Query("classId"), c.QueryArray("assessmentType"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成成绩册失败"})
+		return
+	}
+
+	var buf bytes.Buffer
+	contentType := "text/csv; charset=utf-8"
+	if format == "xlsx" {
+		contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+		err = sheet.WriteXLSX(&buf, course.CourseName, rows)
+	} else {
+		err = sheet.WriteCSV(&buf, rows)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成成绩册失败"})
+		return
+	}
+
+	filename := fmt.Sprintf("%s-成绩册-%s.%s", course.CourseName, time.Now().Format("20060102"), format)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="gradebook.%s"; filename*=UTF-8''%s`, format, url.PathEscape(filename)))
+	c.Data(http.StatusOK, contentType, buf.Bytes())
+}
+
+// buildGradebook 生成成绩册表格，第一行为表头，缺少成绩的单元格为空
+func buildGradebook(courseID int, classID string, assessmentTypes []string) ([][]sheet.Cell, error) {
+	if err := ensureFinalGrades(courseID); err != nil {
+		return nil, err
+	}
+
+	students := []gradebookStudent{}
+	query := api.DB.Table("enrollments").
+		Select("enrollments.student_id, users.username, student_informations.student_number").
+		Joins("JOIN users ON users.user_id = enrollments.student_id").
+		Joins("LEFT JOIN student_informations ON student_informations.user_id = enrollments.student_id").
+		Where("enrollments.course_id = ?", courseID)
+	if classID != "" {
+		query = query.Joins("JOIN student_classes ON student_classes.student_id = enrollments.student_id").
+			Where("student_classes.class_id = ?", classID)
+	}
+	if err := query.Order("student_informations.student_number, enrollments.student_id").Scan(&students).Error; err != nil {
+		return nil, err
+	}
+	studentIDs := make([]int, len(students))
+	for i, s := range students {
+		studentIDs[i] = s.StudentID
+	}
+
+	var assessments []models.CourseAssessment
+	assessmentQuery := api.DB.Where("course_id = ?", courseID)
+	if len(assessmentTypes) > 0 {
+		assessmentQuery = assessmentQuery.Where("assessment_type IN ?", assessmentTypes)
+	}
+	if err := assessmentQuery.Order("assessment_date, assessment_id").Find(&assessments).Error; err != nil {
+		return nil, err
+	}
+
+	// 学生所在班级，多个班级以“/”分隔
+	var memberships []struct {
+		StudentID int
+		ClassName string
+	}
+	classes := make(map[int][]string)
+	scores := make(map[[2]int]float64)
+	finals := make(map[int]models.CourseGrade)
+	if len(studentIDs) > 0 {
+		if err := api.DB.Table("student_classes").
+			Select("student_classes.student_id, classes.class_name").
+			Joins("JOIN classes ON classes.class_id = student_classes.class_id").
+			Where("student_classes.student_id IN ?", studentIDs).
+			Order("classes.class_name").
+			Scan(&memberships).Error; err != nil {
+			return nil, err
+		}
+		for _, m := range memberships {
+			classes[m.StudentID] = append(classes[m.StudentID], m.ClassName)
+		}
+
+		if len(assessments) > 0 {
+			assessmentIDs := make([]int, len(assessments))
+			for i, a := range assessments {
+				assessmentIDs[i] = a.AssessmentID
+			}
+			var grades []models.StudentGrade
+			if err := api.DB.Where("assessment_id IN ? AND student_id IN ?", assessmentIDs, studentIDs).
+				Find(&grades).Error; err != nil {
+				return nil, err
+			}
+			for _, g := range grades {
+				scores[[2]int{g.StudentID, g.AssessmentID}] = g.Score
+			}
+		}
+
+		var courseGrades []models.CourseGrade
+		if err := api.DB.Where("course_id = ? AND student_id IN ?", courseID, studentIDs).
+			Find(&courseGrades).Error; err != nil {
+			return nil, err
+		}
+		for _, g := range courseGrades {
+			finals[g.StudentID] = g
+		}
+	}
+
+	header := []sheet.Cell{"学号", "用户名", "班级"}
+	for _, a := range assessments {
+		header = append(header, fmt.Sprintf("%s（满分 %s）", a.AssessmentName, strconv.FormatFloat(a.MaxScore, 'f', -1, 64)))
+	}
+	header = append(header, "总评", "等级")
+
+	rows := [][]sheet.Cell{header}
+	for _, s := range students {
+		row := []sheet.Cell{s.StudentNumber, s.Username, strings.Join(classes[s.StudentID], "/")}
+		for _, a := range assessments {
+			if score, ok := scores[[2]int{s.StudentID, a.AssessmentID}]; ok {
+				row = append(row, score)
+			} else {
+				row = append(row, nil)
+			}
+		}
+		final := finals[s.StudentID]
+		if final.Percent != nil {
+			row = append(row, *final.Percent, final.Letter)
+		} else {
+			row = append(row, nil, nil)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
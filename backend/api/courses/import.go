@@ -0,0 +1,248 @@
+package courses
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/api"
+	"github.com/MeteorsLiu/virtuallabs/backend/grading"
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"github.com/MeteorsLiu/virtuallabs/backend/sheet"
+	"github.com/gin-gonic/gin"
+)
+
+//
+// 成绩导入接口：上传“学号,分数[,评语]”格式的 CSV，先预览校验结果，无错误时一次性写入
+//
+
+const (
+	maxImportSize = 1 << 20
+	maxImportRows = 5000
+)
+
+// ImportRow 导入文件中的一行及其校验结果
+type ImportRow struct {
+	Line          int      `json:"line"`
+	StudentNumber string   `json:"studentNumber"`
+	Score         *float64 `json:"score"`
+	Comment       string   `json:"comment,omitempty"`
+	StudentID     int      `json:"studentId,omitempty"`
+	PreviousScore *float64 `json:"previousScore,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+type ImportPreview struct {
+	Rows    []ImportRow `json:"rows"`
+	Valid   int         `json:"valid"`
+	Invalid int         `json:"invalid"`
+	Applied bool        `json:"applied"`
+}
+
+// 预览成绩导入（教师），只校验不写入
+func PreviewGradeImport(c *gin.Context) {
+	_, preview, ok := parseGradeImport(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, preview)
+}
+
+// 导入成绩（教师），存在任何错误行时不写入并返回校验结果
+func ImportGrades(c *gin.Context) {
+	teacherID := c.GetInt("userID")
+	assessment, preview, ok := parseGradeImport(c)
+	if !ok {
+		return
+	}
+	if preview.Invalid > 0 {
+		c.JSON(http.StatusUnprocessableEntity, preview)
+		return
+	}
+	if preview.Valid == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "导入文件中没有成绩"})
+		return
+	}
+
+	entries := make([]grading.GradeEntry, len(preview.Rows))
+	for i, row := range preview.Rows {
+		entries[i] = grading.GradeEntry{StudentID: row.StudentID, Score: *row.Score, Comment: row.Comment}
+	}
+	if err := grading.ImportGrades(api.DB, assessment, teacherID, entries, "成绩导入"); err != nil {
+		if errors.Is(err, grading.ErrDuplicateEntry) || errors.Is(err, grading.ErrInvalidScore) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "导入数据有误，请重新预览"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "导入成绩失败"})
+		return
+	}
+	preview.Applied = true
+	c.JSON(http.StatusOK, preview)
+}
+
+// parseGradeImport 读取上传的 CSV 并逐行校验：学号是否存在、学生是否选课、分数是否在满分范围内、学号是否重复
+func parseGradeImport(c *gin.Context) (*models.CourseAssessment, *ImportPreview, bool) {
+	teacherID := c.GetInt("userID")
+	assessmentID, _ := strconv.Atoi(c.Param("assessmentId"))
+
+	var assessment models.CourseAssessment
+	if err := api.DB.First(&assessment, assessmentID).Error; err != nil {
+		handleAssessmentError(c, err)
+		return nil, nil, false
+	}
+	if !isCourseTeacher(teacherID, assessment.CourseID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无课程操作权限"})
+		return nil, nil, false
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "文件上传失败"})
+		return nil, nil, false
+	}
+	if file.Size > maxImportSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "导入文件不能超过 1MB"})
+		return nil, nil, false
+	}
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "文件上传失败"})
+		return nil, nil, false
+	}
+	defer f.Close()
+	records, err := sheet.ReadCSV(f)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "CSV 格式错误: " + err.Error()})
+		return nil, nil, false
+	}
+
+	// 第一列列名为“学号”或 studentNumber 时视为表头，否则第一行与其他行一样校验
+	firstLine := 1
+	if len(records) > 0 && len(records[0]) > 0 && isImportHeader(records[0][0]) {
+		records = records[1:]
+		firstLine = 2
+	}
+	if len(records) > maxImportRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("一次最多导入 %d 行", maxImportRows)})
+		return nil, nil, false
+	}
+
+	preview, err := validateGradeImport(&assessment, records, firstLine)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "校验导入数据失败"})
+		return nil, nil, false
+	}
+	return &assessment, preview, true
+}
+
+func isImportHeader(cell string) bool {
+	cell = strings.TrimSpace(cell)
+	return cell == "学号" || strings.EqualFold(cell, "studentNumber")
+}
+
+// validateGradeImport 校验导入记录，firstLine 为第一条记录在文件中的行号
+func validateGradeImport(assessment *models.CourseAssessment, records [][]string, firstLine int) (*ImportPreview, error) {
+	rows := make([]ImportRow, 0, len(records))
+	var numbers []string
+	for i, record := range records {
+		row := ImportRow{Line: firstLine + i}
+		if len(record) > 0 {
+			row.StudentNumber = record[0]
+		}
+		if len(record) > 2 {
+			row.Comment = record[2]
+		}
+		switch {
+		case len(record) < 2 || row.StudentNumber == "":
+			row.Error = "需要学号和分数两列"
+		default:
+			score, err := strconv.ParseFloat(record[1], 64)
+			switch {
+			case err != nil || math.IsNaN(score) || math.IsInf(score, 0):
+				row.Error = "分数无效"
+			case score < 0 || score > assessment.MaxScore:
+				row.Score = &score
+				row.Error = fmt.Sprintf("分数需在 0 到 %s 之间", strconv.FormatFloat(assessment.MaxScore, 'f', -1, 64))
+			default:
+				row.Score = &score
+			}
+			numbers = append(numbers, row.StudentNumber)
+		}
+		if len(row.Comment) > 2000 && row.Error == "" {
+			row.Error = "评语过长"
+		}
+		rows = append(rows, row)
+	}
+
+	// 按学号查找学生、选课情况和已有成绩
+	students := make(map[string]int)
+	enrolled := make(map[int]bool)
+	previous := make(map[int]float64)
+	if len(numbers) > 0 {
+		var infos []models.StudentInformation
+		if err := api.DB.Where("student_number IN ?", numbers).Find(&infos).Error; err != nil {
+			return nil, err
+		}
+		ids := make([]int, 0, len(infos))
+		for _, info := range infos {
+			students[info.StudentNumber] = info.UserID
+			ids = append(ids, info.UserID)
+		}
+		if len(ids) > 0 {
+			var enrolledIDs []int
+			if err := api.DB.Model(&models.Enrollment{}).
+				Where("course_id = ? AND student_id IN ?", assessment.CourseID, ids).
+				Pluck("student_id", &enrolledIDs).Error; err != nil {
+				return nil, err
+			}
+			for _, id := range enrolledIDs {
+				enrolled[id] = true
+			}
+			var grades []models.StudentGrade
+			if err := api.DB.Where("assessment_id = ? AND student_id IN ?", assessment.AssessmentID, ids).
+				Find(&grades).Error; err != nil {
+				return nil, err
+			}
+			for _, g := range grades {
+				previous[g.StudentID] = g.Score
+			}
+		}
+	}
+
+	preview := &ImportPreview{Rows: rows}
+	seen := make(map[string]int)
+	for i := range rows {
+		row := &rows[i]
+		if row.StudentNumber != "" {
+			if id, ok := students[row.StudentNumber]; ok {
+				row.StudentID = id
+				if score, ok := previous[id]; ok {
+					row.PreviousScore = &score
+				}
+			}
+		}
+		if row.Error == "" {
+			switch {
+			case row.StudentID == 0:
+				row.Error = "学号不存在"
+			case !enrolled[row.StudentID]:
+				row.Error = "学生未选修该课程"
+			case seen[row.StudentNumber] > 0:
+				row.Error = fmt.Sprintf("与第 %d 行学号重复", seen[row.StudentNumber])
+			}
+		}
+		if _, ok := seen[row.StudentNumber]; !ok && row.StudentNumber != "" {
+			seen[row.StudentNumber] = row.Line
+		}
+
+		if row.Error == "" {
+			preview.Valid++
+		} else {
+			preview.Invalid++
+		}
+	}
+	return preview, nil
+}
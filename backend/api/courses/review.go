@@ -0,0 +1,219 @@
+package courses
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/api"
+	"github.com/MeteorsLiu/virtuallabs/backend/grading"
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+//
+// 人工评分接口：待评分队列、逐题评分和成绩修改
+//
+
+// GradingQueue 待人工评分的内容：已提交作答中未评分的题目，以及没有题目、需要教师直接给分的实验评分项
+type GradingQueue struct {
+	Answers  []models.StudentAnswer `json:"answers"`
+	Ungraded []UngradedSubmission   `json:"ungraded"`
+}
+
+type UngradedSubmission struct {
+	AssessmentID   int    `json:"assessmentId"`
+	AssessmentName string `json:"assessmentName"`
+	StudentID      int    `json:"studentId"`
+	Username       string `json:"username"`
+	StudentNumber  string `json:"studentNumber"`
+}
+
+type AnswerGradeRequest struct {
+	Score   *float64 `json:"score" binding:"required"`
+	Comment string   `json:"comment" binding:"max=2000"`
+}
+
+type GradeOverrideRequest struct {
+	Score   *float64 `json:"score" binding:"required"`
+	Reason  string   `json:"reason" binding:"required,max=500"`
+	Comment string   `json:"comment" binding:"max=2000"`
+}
+
+type ClearOverrideRequest struct {
+	Reason string `json:"reason" binding:"required,max=500"`
+}
+
+// 获取课程的待评分队列（教师），可按评分项过滤
+func GetGradingQueue(c *gin.Context) {
+	teacherID := c.GetInt("userID")
+	courseID, _ := strconv.Atoi(c.Param("courseId"))
+	if !isCourseTeacher(teacherID, courseID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无课程操作权限"})
+		return
+	}
+	assessmentID := c.Query("assessmentId")
+
+	queue := GradingQueue{Answers: []models.StudentAnswer{}, Ungraded: []UngradedSubmission{}}
+
+	answers := api.DB.Preload("Student.StudentInfo").Preload("Question").
+		Joins("JOIN assessment_attempts ON assessment_attempts.attempt_id = student_answers.attempt_id").
+		Joins("JOIN course_assessments ON course_assessments.assessment_id = assessment_attempts.assessment_id").
+		Where("course_assessments.course_id = ? AND assessment_attempts.status = ?", courseID, grading.StatusSubmitted).
+		Where("student_answers.is_correct IS NULL AND student_answers.graded_by IS NULL")
+	if assessmentID != "" {
+		answers = answers.Where("course_assessments.assessment_id = ?", assessmentID)
+	}
+	if err := answers.Order("assessment_attempts.submitted_at, student_answers.answer_id").Find(&queue.Answers).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询待评分答案失败"})
+		return
+	}
+
+	ungraded := api.DB.Table("course_assessments").
+		Select("course_assessments.assessment_id, course_assessments.assessment_name, enrollments.student_id, users.username, student_informations.student_number").
+		Joins("JOIN enrollments ON enrollments.course_id = course_assessments.course_id").
+		Joins("JOIN users ON users.user_id = enrollments.student_id").
+		Joins("LEFT JOIN student_informations ON student_informations.user_id = enrollments.student_id").
+		Joins("LEFT JOIN student_grades ON student_grades.assessment_id = course_assessments.assessment_id AND student_grades.student_id = enrollments.student_id").
+		Where("course_assessments.course_id = ? AND course_assessments.assessment_type = ?", courseID, "experiment").
+		Where("student_grades.grade_id IS NULL").
+		Where("NOT EXISTS (SELECT 1 FROM questions WHERE questions.assessment_id = course_assessments.assessment_id)")
+	if assessmentID != "" {
+		ungraded = ungraded.Where("course_assessments.assessment_id = ?", assessmentID)
+	}
+	if err := ungraded.Order("course_assessments.assessment_id, student_informations.student_number").Scan(&queue.Ungraded).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询待评分评分项失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, queue)
+}
+
+// 为已提交作答中的一道题评分（教师），分数不超过该题分值
+func GradeAnswer(c *gin.Context) {
+	teacherID := c.GetInt("userID")
+	answerID, _ := strconv.Atoi(c.Param("answerId"))
+
+	var req AnswerGradeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var answer models.StudentAnswer
+	if err := api.DB.Preload("Question").First(&answer, answerID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			handleNotFound(c, "答案")
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询答案失败"})
+		return
+	}
+	if !isCourseTeacher(teacherID, answer.Question.CourseID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无课程操作权限"})
+		return
+	}
+
+	graded, err := grading.GradeAnswer(api.DB, answerID, teacherID, *req.Score, req.Comment)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, graded)
+	case errors.Is(err, grading.ErrNotSubmitted):
+		c.JSON(http.StatusConflict, gin.H{"error": "作答尚未提交"})
+	case errors.Is(err, grading.ErrInvalidScore):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "分数超出该题分值范围"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "评分失败"})
+	}
+}
+
+// 修改学生在评分项上的成绩（教师），记录评分人、原因和修改前的分数
+func OverrideGrade(c *gin.Context) {
+	teacherID := c.GetInt("userID")
+
+	var req GradeOverrideRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	assessment, studentID, ok := loadGradeTarget(c, teacherID)
+	if !ok {
+		return
+	}
+
+	grade, err := grading.OverrideGrade(api.DB, assessment, studentID, teacherID, *req.Score, req.Reason, req.Comment)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, grade)
+	case errors.Is(err, grading.ErrInvalidScore):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "分数超出评分项满分范围"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "修改成绩失败"})
+	}
+}
+
+// 撤销成绩修改（教师），成绩恢复为按作答自动计算
+func ClearGradeOverride(c *gin.Context) {
+	teacherID := c.GetInt("userID")
+
+	var req ClearOverrideRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	assessment, studentID, ok := loadGradeTarget(c, teacherID)
+	if !ok {
+		return
+	}
+
+	if err := grading.ClearOverride(api.DB, assessment, studentID, teacherID, req.Reason); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "成绩未被修改"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "撤销修改失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "已恢复自动计算的成绩"})
+}
+
+// 获取学生在评分项上的成绩修改记录（教师）
+func GetGradeOverrides(c *gin.Context) {
+	teacherID := c.GetInt("userID")
+	assessment, studentID, ok := loadGradeTarget(c, teacherID)
+	if !ok {
+		return
+	}
+
+	var overrides []models.GradeOverride
+	if err := api.DB.Preload("Grader").
+		Where("assessment_id = ? AND student_id = ?", assessment.AssessmentID, studentID).
+		Order("created_at DESC, override_id DESC").
+		Find(&overrides).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询修改记录失败"})
+		return
+	}
+	c.JSON(http.StatusOK, overrides)
+}
+
+// loadGradeTarget 加载路径中的评分项和学生，要求教师负责该课程且学生已选课
+func loadGradeTarget(c *gin.Context, teacherID int) (*models.CourseAssessment, int, bool) {
+	assessmentID, _ := strconv.Atoi(c.Param("assessmentId"))
+	studentID, _ := strconv.Atoi(c.Param("studentId"))
+
+	var assessment models.CourseAssessment
+	if err := api.DB.First(&assessment, assessmentID).Error; err != nil {
+		handleAssessmentError(c, err)
+		return nil, 0, false
+	}
+	if !isCourseTeacher(teacherID, assessment.CourseID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无课程操作权限"})
+		return nil, 0, false
+	}
+	if !isEnrolled(studentID, assessment.CourseID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "学生未选修该课程"})
+		return nil, 0, false
+	}
+	return &assessment, studentID, true
+}
@@ -21,6 +21,10 @@ func Register(router *gin.Engine) {
 		course.GET("/:courseId/chapters", GetChapters)
 
 		course.GET("/:courseId/grades", GetCourseGrades)
+		course.GET("/:courseId/final-grades", GetFinalGrades)
+		course.GET("/:courseId/gradebook/export", api.RoleMiddleware("teacher"), ExportGradebook)
+		course.GET("/:courseId/grading-policy", GetGradePolicy)
+		course.PUT("/:courseId/grading-policy", api.RoleMiddleware("teacher"), UpdateGradePolicy)
 
 		// 评分项路由
 		course.POST("/:courseId/assessments", api.RoleMiddleware("teacher"), CreateAssessment)
@@ -29,8 +33,29 @@ func Register(router *gin.Engine) {
 
 		course.POST("/assessments/:assessmentId/submit", api.RoleMiddleware("student"), SubmitAnswer)
 
+		// 作答路由
+		course.POST("/assessments/:assessmentId/attempts", api.RoleMiddleware("student"), StartAttempt)
+		course.GET("/assessments/:assessmentId/attempts", GetAssessmentAttempts)
+		course.GET("/attempts/:attemptId", GetAttempt)
+		course.PUT("/attempts/:attemptId/answers", api.RoleMiddleware("student"), SaveAttemptAnswer)
+		course.POST("/attempts/:attemptId/submit", api.RoleMiddleware("student"), SubmitAttempt)
+
+		// 人工评分路由
+		course.GET("/:courseId/grading-queue", api.RoleMiddleware("teacher"), GetGradingQueue)
+		course.PUT("/answers/:answerId/grade", api.RoleMiddleware("teacher"), GradeAnswer)
+		course.PUT("/assessments/:assessmentId/grades/:studentId", api.RoleMiddleware("teacher"), OverrideGrade)
+		course.DELETE("/assessments/:assessmentId/grades/:studentId/override", api.RoleMiddleware("teacher"), ClearGradeOverride)
+		course.GET("/assessments/:assessmentId/grades/:studentId/overrides", api.RoleMiddleware("teacher"), GetGradeOverrides)
+		course.POST("/assessments/:assessmentId/grades/import/preview", api.RoleMiddleware("teacher"), PreviewGradeImport)
+		course.POST("/assessments/:assessmentId/grades/import", api.RoleMiddleware("teacher"), ImportGrades)
+
 		course.POST("/assessments/question/", api.RoleMiddleware("teacher"), CreateQuestion)
 
+		// 题库与抽题路由
+		course.GET("/:courseId/question-bank", api.RoleMiddleware("teacher"), GetQuestionBank)
+		course.GET("/assessments/:assessmentId/draw-rules", api.RoleMiddleware("teacher"), GetDrawRules)
+		course.PUT("/assessments/:assessmentId/draw-rules", api.RoleMiddleware("teacher"), UpdateDrawRules)
+
 		course.GET("/assessments/:assessmentId/questions", GetAssessmentQuestions)
 
 		course.POST("/:courseId/enroll", api.RoleMiddleware("student"), EnrollCourse)
@@ -9,12 +9,14 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/MeteorsLiu/virtuallabs/backend/api"
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
 
 type UploadMetadata struct {
-	UploadType string `json:"uploadType" binding:"required,oneof=courseCover chapterVideo"`
+	UploadType string `json:"uploadType" binding:"required,oneof=courseCover chapterVideo experimentFile"`
 	TargetID   int    `json:"targetId" binding:"required"`
 }
 
@@ -35,6 +37,19 @@ func UploadFile(c *gin.Context) {
 		return
 	}
 
+	// 实验附件仅限实验所属课程的教师上传
+	if metadata.UploadType == "experimentFile" {
+		var experiment models.Experiment
+		if err := api.DB.First(&experiment, metadata.TargetID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "实验不存在"})
+			return
+		}
+		if c.GetString("userRole") != "teacher" || !isCourseTeacher(c.GetInt("userID"), experiment.CourseID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "无操作权限"})
+			return
+		}
+	}
+
 	// 创建存储目录
 	savePath := getSavePath(metadata)
 	if err := os.MkdirAll(savePath, 0755); err != nil {
@@ -64,5 +79,5 @@ func UploadFile(c *gin.Context) {
 
 // 获取存储路径
 func getSavePath(meta UploadMetadata) string {
-	return filepath.Join("uploads", meta.UploadType, strconv.Itoa(meta.TargetID))
+	return filepath.Join(api.UploadDir, meta.UploadType, strconv.Itoa(meta.TargetID))
 }
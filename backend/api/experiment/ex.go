@@ -8,6 +8,8 @@ import (
 
 	"github.com/MeteorsLiu/virtuallabs/backend/api"
 	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"github.com/MeteorsLiu/virtuallabs/backend/outbox"
+	"github.com/MeteorsLiu/virtuallabs/backend/queue"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
@@ -16,6 +18,12 @@ import (
 // 实验接口
 //
 
+// 与模型默认值一致的虚拟机租期（分钟）
+const (
+	defaultLeaseMinutes    = 240
+	defaultMaxLeaseMinutes = 480
+)
+
 // CreateExperiment 创建实验（仅限教师）
 func CreateExperiment(c *gin.Context) {
 	// 获取用户身份
@@ -33,6 +41,16 @@ func CreateExperiment(c *gin.Context) {
 		ExperimentName string `json:"experimentName" binding:"required,min=2,max=100"`
 		CourseID       int    `json:"courseId" binding:"required"`
 		Description    string `json:"description" binding:"max=500"`
+		InitScript     string `json:"initScript" binding:"max=16384"`
+		// 虚拟机租期设置，为空时使用默认值（4 小时，最长 8 小时，到期停止）
+		LeaseMinutes    int    `json:"leaseMinutes" binding:"omitempty,min=1,max=10080"`
+		MaxLeaseMinutes int    `json:"maxLeaseMinutes" binding:"omitempty,min=1,max=10080"`
+		ExpireAction    string `json:"expireAction" binding:"omitempty,oneof=stop delete"`
+		WarmPoolSize    int    `json:"warmPoolSize" binding:"omitempty,min=0,max=50"`
+		ImageID         int    `json:"imageId" binding:"omitempty,min=1"` // 镜像目录中的镜像，为空时使用默认镜像
+
+		Scheduling *queue.Scheduling `json:"scheduling"`
+		Egress     *queue.Egress     `json:"egress"` // 为空时不限制出站
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -40,6 +58,32 @@ func CreateExperiment(c *gin.Context) {
 		return
 	}
 
+	if input.LeaseMinutes == 0 {
+		input.LeaseMinutes = defaultLeaseMinutes
+	}
+	if input.MaxLeaseMinutes == 0 {
+		input.MaxLeaseMinutes = max(defaultMaxLeaseMinutes, input.LeaseMinutes)
+	}
+	if input.ExpireAction == "" {
+		input.ExpireAction = "stop"
+	}
+	if input.MaxLeaseMinutes < input.LeaseMinutes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "最长租期不能小于租期"})
+		return
+	}
+	if input.ImageID != 0 && !imageUsable(input.ImageID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "镜像不存在或已停用"})
+		return
+	}
+	if err := api.ValidateScheduling(input.Scheduling); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := input.Egress.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// 验证课程有效性
 	var course models.Course
 	if err := api.DB.First(&course, input.CourseID).Error; err != nil {
@@ -58,7 +102,22 @@ func CreateExperiment(c *gin.Context) {
 		ExperimentName: input.ExperimentName,
 		CourseID:       input.CourseID,
 		Description:    input.Description,
+		InitScript:     input.InitScript,
 		CreatedAt:      time.Now(),
+
+		LeaseMinutes:    input.LeaseMinutes,
+		MaxLeaseMinutes: input.MaxLeaseMinutes,
+		ExpireAction:    input.ExpireAction,
+		WarmPoolSize:    input.WarmPoolSize,
+	}
+	if input.ImageID != 0 {
+		experiment.ImageID = &input.ImageID
+	}
+	if !input.Scheduling.IsZero() {
+		experiment.Scheduling = input.Scheduling
+	}
+	if input.Egress.Restricted() {
+		experiment.Egress = input.Egress
 	}
 
 	tx := api.DB.Begin()
@@ -123,7 +182,7 @@ func GetExperiment(c *gin.Context) {
 	userRole := c.GetString("userRole")
 
 	var experiment models.Experiment
-	if err := api.DB.Preload("Course").First(&experiment, id).Error; err != nil {
+	if err := api.DB.Preload("Course").Preload("Files").Preload("Image").First(&experiment, id).Error; err != nil {
 		handleExperimentError(c, err)
 		return
 	}
@@ -158,8 +217,18 @@ func UpdateExperiment(c *gin.Context) {
 
 	// 绑定更新数据
 	var input struct {
-		ExperimentName string `json:"experimentName" binding:"omitempty,min=2,max=100"`
-		Description    string `json:"description" binding:"omitempty,max=500"`
+		ExperimentName string  `json:"experimentName" binding:"omitempty,min=2,max=100"`
+		Description    string  `json:"description" binding:"omitempty,max=500"`
+		InitScript     *string `json:"initScript" binding:"omitempty,max=16384"` // 传空字符串可清除脚本
+		// 修改租期只影响之后创建或续期的虚拟机
+		LeaseMinutes    int    `json:"leaseMinutes" binding:"omitempty,min=1,max=10080"`
+		MaxLeaseMinutes int    `json:"maxLeaseMinutes" binding:"omitempty,min=1,max=10080"`
+		ExpireAction    string `json:"expireAction" binding:"omitempty,oneof=stop delete"`
+		WarmPoolSize    *int   `json:"warmPoolSize" binding:"omitempty,min=0,max=50"` // 传 0 关闭预热
+		ImageID         *int   `json:"imageId" binding:"omitempty,min=0"`             // 传 0 恢复默认镜像
+
+		Scheduling *queue.Scheduling `json:"scheduling"` // 传 {} 清除调度约束
+		Egress     *queue.Egress     `json:"egress"`     // 修改只影响之后创建的虚拟机，传 {"mode":"open"} 取消限制
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -175,11 +244,83 @@ func UpdateExperiment(c *gin.Context) {
 	if input.Description != "" {
 		updates["description"] = input.Description
 	}
+	if input.InitScript != nil {
+		if provisionSize(experiment.ExperimentID, *input.InitScript) > queue.MaxProvisionSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "实验附件与初始化脚本总大小超出限制"})
+			return
+		}
+		updates["init_script"] = *input.InitScript
+	}
 
-	if err := api.DB.Model(&experiment).Updates(updates).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新失败"})
+	leaseMinutes, maxLeaseMinutes := experiment.LeaseMinutes, experiment.MaxLeaseMinutes
+	if input.LeaseMinutes != 0 {
+		leaseMinutes = input.LeaseMinutes
+		updates["lease_minutes"] = leaseMinutes
+	}
+	if input.MaxLeaseMinutes != 0 {
+		maxLeaseMinutes = input.MaxLeaseMinutes
+		updates["max_lease_minutes"] = maxLeaseMinutes
+	}
+	if maxLeaseMinutes < leaseMinutes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "最长租期不能小于租期"})
 		return
 	}
+	if input.ExpireAction != "" {
+		updates["expire_action"] = input.ExpireAction
+	}
+	if input.WarmPoolSize != nil {
+		updates["warm_pool_size"] = *input.WarmPoolSize
+	}
+	if input.Scheduling != nil {
+		if err := api.ValidateScheduling(input.Scheduling); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := input.Egress.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.ImageID != nil {
+		if *input.ImageID == 0 {
+			updates["image_id"] = nil
+		} else if imageUsable(*input.ImageID) {
+			updates["image_id"] = *input.ImageID
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "镜像不存在或已停用"})
+			return
+		}
+	}
+
+	if len(updates) > 0 {
+		if err := api.DB.Model(&experiment).Updates(updates).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "更新失败"})
+			return
+		}
+	}
+
+	// 调度约束和出站策略需经过字段的 JSON 序列化器，单独按结构体更新
+	var serialized []string
+	if input.Scheduling != nil {
+		experiment.Scheduling = nil
+		if !input.Scheduling.IsZero() {
+			experiment.Scheduling = input.Scheduling
+		}
+		serialized = append(serialized, "scheduling")
+	}
+	if input.Egress != nil {
+		experiment.Egress = nil
+		if input.Egress.Restricted() {
+			experiment.Egress = input.Egress
+		}
+		serialized = append(serialized, "egress")
+	}
+	if len(serialized) > 0 {
+		if err := api.DB.Model(&experiment).Select(serialized).Updates(&experiment).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "更新失败"})
+			return
+		}
+	}
 
 	c.JSON(http.StatusOK, experiment)
 }
@@ -204,13 +345,45 @@ func DeleteExperiment(c *gin.Context) {
 
 	tx := api.DB.Begin()
 
-	// 删除关联的虚拟机
+	// 删除关联的虚拟机，并通知工作节点回收对应的 Deployment
+	var vms []models.VirtualMachine
+	if err := tx.Where("experiment_id = ?", id).Find(&vms).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除关联资源失败"})
+		return
+	}
+	for _, vm := range vms {
+		if err := outbox.Enqueue(tx, queue.DeleteVMMessage(c, vm.VMID, vm.VMName)); err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "删除关联资源失败"})
+			return
+		}
+	}
 	if err := tx.Where("experiment_id = ?", id).Delete(&models.VirtualMachine{}).Error; err != nil {
 		tx.Rollback()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除关联资源失败"})
 		return
 	}
 
+	// 删除实验附件记录
+	if err := tx.Where("experiment_id = ?", id).Delete(&models.ExperimentFile{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除实验附件失败"})
+		return
+	}
+
+	// 删除实验步骤及完成记录
+	if err := tx.Where("experiment_id = ?", id).Delete(&models.StepCompletion{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除实验步骤失败"})
+		return
+	}
+	if err := tx.Where("experiment_id = ?", id).Delete(&models.ExperimentStep{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除实验步骤失败"})
+		return
+	}
+
 	// 删除教师关联
 	if err := tx.Where("experiment_id = ?", id).Delete(&models.TeacherExperiment{}).Error; err != nil {
 		tx.Rollback()
@@ -225,7 +398,12 @@ func DeleteExperiment(c *gin.Context) {
 		return
 	}
 
-	tx.Commit()
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除实验失败"})
+		return
+	}
+	outbox.Notify()
+
 	c.JSON(http.StatusOK, gin.H{"message": "实验删除成功"})
 }
 
@@ -238,6 +416,15 @@ func isCourseTeacher(teacherID, courseID int) bool {
 	return count > 0
 }
 
+// imageUsable 判断镜像目录中的镜像是否存在且已启用
+func imageUsable(imageID int) bool {
+	var count int64
+	api.DB.Model(&models.LabImage{}).
+		Where("image_id = ? AND enabled = ?", imageID, true).
+		Count(&count)
+	return count > 0
+}
+
 func hasExperimentAccess(userID int, userRole string, courseID int) bool {
 	switch userRole {
 	case "admin":
@@ -0,0 +1,161 @@
+package experiment
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/api"
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"github.com/MeteorsLiu/virtuallabs/backend/queue"
+	"github.com/gin-gonic/gin"
+)
+
+//
+// 实验附件接口
+//
+
+// AddExperimentFile 将通过 /upload 上传的文件挂到实验上（仅限负责教师）
+func AddExperimentFile(c *gin.Context) {
+	userID := c.GetInt("userID")
+	userRole := c.GetString("userRole")
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var experiment models.Experiment
+	if err := api.DB.First(&experiment, id).Error; err != nil {
+		handleExperimentError(c, err)
+		return
+	}
+
+	if userRole != "teacher" || !isCourseTeacher(userID, experiment.CourseID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "未授权修改该实验"})
+		return
+	}
+
+	var input struct {
+		FileName string `json:"fileName" binding:"required,max=255"`
+		FileURL  string `json:"fileUrl" binding:"required,max=255"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 文件名直接作为虚拟机内的路径，只允许单级文件名
+	if !queue.ValidFileName(input.FileName) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的文件名"})
+		return
+	}
+	// 同名附件在虚拟机内会相互覆盖
+	var sameName int64
+	if err := api.DB.Model(&models.ExperimentFile{}).
+		Where("experiment_id = ? AND file_name = ?", experiment.ExperimentID, input.FileName).
+		Count(&sameName).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "添加附件失败"})
+		return
+	}
+	if sameName > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "实验中已有同名附件"})
+		return
+	}
+
+	// 只接受上传到本实验目录下的文件
+	prefix := fmt.Sprintf("/uploads/experimentFile/%d/", experiment.ExperimentID)
+	if !strings.HasPrefix(input.FileURL, prefix) || path.Clean(input.FileURL) != input.FileURL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的文件地址"})
+		return
+	}
+	info, err := os.Stat(api.UploadPath(input.FileURL))
+	if err != nil || !info.Mode().IsRegular() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "文件不存在"})
+		return
+	}
+
+	if provisionSize(experiment.ExperimentID, experiment.InitScript)+info.Size() > queue.MaxProvisionSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "实验附件与初始化脚本总大小超出限制"})
+		return
+	}
+
+	file := models.ExperimentFile{
+		ExperimentID: experiment.ExperimentID,
+		FileName:     input.FileName,
+		FileURL:      input.FileURL,
+		FileSize:     info.Size(),
+	}
+	if err := api.DB.Create(&file).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "添加附件失败"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, file)
+}
+
+// GetExperimentFiles 获取实验附件列表
+func GetExperimentFiles(c *gin.Context) {
+	userID := c.GetInt("userID")
+	userRole := c.GetString("userRole")
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var experiment models.Experiment
+	if err := api.DB.First(&experiment, id).Error; err != nil {
+		handleExperimentError(c, err)
+		return
+	}
+
+	if !hasExperimentAccess(userID, userRole, experiment.CourseID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "未授权访问该实验"})
+		return
+	}
+
+	var files []models.ExperimentFile
+	if err := api.DB.Where("experiment_id = ?", id).Order("file_id ASC").Find(&files).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, files)
+}
+
+// DeleteExperimentFile 移除实验附件（仅限负责教师）
+func DeleteExperimentFile(c *gin.Context) {
+	userID := c.GetInt("userID")
+	userRole := c.GetString("userRole")
+	id, _ := strconv.Atoi(c.Param("id"))
+	fileID, _ := strconv.Atoi(c.Param("fileId"))
+
+	var experiment models.Experiment
+	if err := api.DB.First(&experiment, id).Error; err != nil {
+		handleExperimentError(c, err)
+		return
+	}
+
+	if userRole != "teacher" || !isCourseTeacher(userID, experiment.CourseID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "未授权修改该实验"})
+		return
+	}
+
+	result := api.DB.Where("file_id = ? AND experiment_id = ?", fileID, id).Delete(&models.ExperimentFile{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除失败"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "附件不存在"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "附件已移除"})
+}
+
+// provisionSize 计算实验附件与给定初始化脚本的总大小
+func provisionSize(experimentID int, initScript string) int64 {
+	var total int64
+	api.DB.Model(&models.ExperimentFile{}).
+		Where("experiment_id = ?", experimentID).
+		Select("COALESCE(SUM(file_size), 0)").
+		Scan(&total)
+	return total + int64(len(initScript))
+}
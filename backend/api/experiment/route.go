@@ -16,5 +16,16 @@ func Register(router *gin.Engine) {
 		experimentGroup.GET("/:id", GetExperiment)
 		experimentGroup.PUT("/:id", UpdateExperiment)
 		experimentGroup.DELETE("/:id", DeleteExperiment)
+
+		// 实验附件
+		experimentGroup.POST("/:id/files", AddExperimentFile)
+		experimentGroup.GET("/:id/files", GetExperimentFiles)
+		experimentGroup.DELETE("/:id/files/:fileId", DeleteExperimentFile)
+
+		// 实验步骤与进度
+		experimentGroup.GET("/:id/steps", GetExperimentSteps)
+		experimentGroup.PUT("/:id/steps", UpdateExperimentSteps)
+		experimentGroup.GET("/:id/progress", GetExperimentProgress)
+		experimentGroup.GET("/:id/progress/students/:studentId", GetStudentProgress)
 	}
 }
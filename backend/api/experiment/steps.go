@@ -0,0 +1,254 @@
+package experiment
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/api"
+	"github.com/MeteorsLiu/virtuallabs/backend/api/agent"
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"github.com/gin-gonic/gin"
+)
+
+//
+// 实验步骤与进度接口
+//
+
+var stepKeyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+type stepInput struct {
+	StepKey     string `json:"stepKey" binding:"required"`
+	Title       string `json:"title" binding:"required,max=200"`
+	Description string `json:"description"`
+}
+
+// GetExperimentSteps 获取实验步骤
+func GetExperimentSteps(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var experiment models.Experiment
+	if err := api.DB.First(&experiment, id).Error; err != nil {
+		handleExperimentError(c, err)
+		return
+	}
+	if !hasExperimentAccess(c.GetInt("userID"), c.GetString("userRole"), experiment.CourseID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "未授权访问该实验"})
+		return
+	}
+
+	var steps []models.ExperimentStep
+	if err := api.DB.Where("experiment_id = ?", id).Order("sort_order, step_id").Find(&steps).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询失败"})
+		return
+	}
+	c.JSON(http.StatusOK, steps)
+}
+
+// UpdateExperimentSteps 按提交顺序整体替换实验步骤（仅限负责教师）
+//
+// 标识不变的步骤保留原有的完成记录，被移除步骤的完成记录一并删除
+func UpdateExperimentSteps(c *gin.Context) {
+	userID := c.GetInt("userID")
+	userRole := c.GetString("userRole")
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var experiment models.Experiment
+	if err := api.DB.First(&experiment, id).Error; err != nil {
+		handleExperimentError(c, err)
+		return
+	}
+	if userRole != "teacher" || !isCourseTeacher(userID, experiment.CourseID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "未授权修改该实验"})
+		return
+	}
+
+	var input []stepInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	seen := make(map[string]bool, len(input))
+	for _, s := range input {
+		if !stepKeyPattern.MatchString(s.StepKey) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的步骤标识: " + s.StepKey})
+			return
+		}
+		if seen[s.StepKey] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "步骤标识重复: " + s.StepKey})
+			return
+		}
+		seen[s.StepKey] = true
+	}
+
+	tx := api.DB.Begin()
+
+	var existing []models.ExperimentStep
+	if err := tx.Where("experiment_id = ?", id).Find(&existing).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询失败"})
+		return
+	}
+	byKey := make(map[string]models.ExperimentStep, len(existing))
+	for _, s := range existing {
+		byKey[s.StepKey] = s
+	}
+
+	var removed []int
+	for _, s := range existing {
+		if !seen[s.StepKey] {
+			removed = append(removed, s.StepID)
+		}
+	}
+	if len(removed) > 0 {
+		if err := tx.Where("step_id IN ?", removed).Delete(&models.StepCompletion{}).Error; err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "更新实验步骤失败"})
+			return
+		}
+		if err := tx.Where("step_id IN ?", removed).Delete(&models.ExperimentStep{}).Error; err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "更新实验步骤失败"})
+			return
+		}
+	}
+
+	steps := make([]models.ExperimentStep, len(input))
+	for i, s := range input {
+		step := byKey[s.StepKey]
+		step.ExperimentID = id
+		step.StepKey = s.StepKey
+		step.Title = s.Title
+		step.Description = s.Description
+		step.SortOrder = i
+		if err := tx.Save(&step).Error; err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "更新实验步骤失败"})
+			return
+		}
+		steps[i] = step
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新实验步骤失败"})
+		return
+	}
+	c.JSON(http.StatusOK, steps)
+}
+
+type stepSummary struct {
+	StepID         int    `json:"stepId"`
+	StepKey        string `json:"stepKey"`
+	Title          string `json:"title"`
+	CompletedCount int    `json:"completedCount"`
+}
+
+type studentProgress struct {
+	StudentID      int                  `json:"studentId"`
+	Username       string               `json:"username"`
+	StudentNumber  string               `json:"studentNumber"`
+	CompletedCount int                  `gorm:"-" json:"completedCount"`
+	Completions    map[string]time.Time `gorm:"-" json:"completions"` // 步骤标识 -> 完成时间
+}
+
+// GetExperimentProgress 获取选课学生的步骤完成情况，可按 classId 筛选班级（仅限教师和管理员）
+func GetExperimentProgress(c *gin.Context) {
+	userID := c.GetInt("userID")
+	userRole := c.GetString("userRole")
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var experiment models.Experiment
+	if err := api.DB.First(&experiment, id).Error; err != nil {
+		handleExperimentError(c, err)
+		return
+	}
+	if userRole == "student" || !hasExperimentAccess(userID, userRole, experiment.CourseID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "未授权查看该实验进度"})
+		return
+	}
+
+	var steps []models.ExperimentStep
+	if err := api.DB.Where("experiment_id = ?", id).Order("sort_order, step_id").Find(&steps).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询失败"})
+		return
+	}
+
+	query := api.DB.Table("enrollments").
+		Select("enrollments.student_id, users.username, student_informations.student_number").
+		Joins("JOIN users ON users.user_id = enrollments.student_id").
+		Joins("LEFT JOIN student_informations ON student_informations.user_id = enrollments.student_id").
+		Where("enrollments.course_id = ?", experiment.CourseID)
+	if classID := c.Query("classId"); classID != "" {
+		query = query.Joins("JOIN student_classes ON student_classes.student_id = enrollments.student_id").
+			Where("student_classes.class_id = ?", classID)
+	}
+	var students []studentProgress
+	if err := query.Order("student_informations.student_number").Scan(&students).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询失败"})
+		return
+	}
+
+	var completions []models.StepCompletion
+	if err := api.DB.Where("experiment_id = ?", id).Find(&completions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询失败"})
+		return
+	}
+
+	keys := make(map[int]string, len(steps))
+	for _, s := range steps {
+		keys[s.StepID] = s.StepKey
+	}
+	index := make(map[int]int, len(students))
+	for i := range students {
+		students[i].Completions = map[string]time.Time{}
+		index[students[i].StudentID] = i
+	}
+	counts := make(map[int]int, len(steps))
+	for _, sc := range completions {
+		i, ok := index[sc.StudentID]
+		key, known := keys[sc.StepID]
+		if !ok || !known {
+			continue
+		}
+		students[i].Completions[key] = sc.CompletedAt
+		students[i].CompletedCount++
+		counts[sc.StepID]++
+	}
+
+	summaries := make([]stepSummary, len(steps))
+	for i, s := range steps {
+		summaries[i] = stepSummary{StepID: s.StepID, StepKey: s.StepKey, Title: s.Title, CompletedCount: counts[s.StepID]}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"steps":         summaries,
+		"students":      students,
+		"totalStudents": len(students),
+	})
+}
+
+// GetStudentProgress 获取单个学生的步骤完成情况，学生只能查看自己的进度
+func GetStudentProgress(c *gin.Context) {
+	userID := c.GetInt("userID")
+	userRole := c.GetString("userRole")
+	id, _ := strconv.Atoi(c.Param("id"))
+	studentID, _ := strconv.Atoi(c.Param("studentId"))
+
+	var experiment models.Experiment
+	if err := api.DB.First(&experiment, id).Error; err != nil {
+		handleExperimentError(c, err)
+		return
+	}
+	if (userRole == "student" && studentID != userID) || !hasExperimentAccess(userID, userRole, experiment.CourseID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "未授权查看该学生进度"})
+		return
+	}
+
+	steps, err := agent.StudentSteps(id, studentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询失败"})
+		return
+	}
+	c.JSON(http.StatusOK, steps)
+}
@@ -0,0 +1,225 @@
+package images
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/api"
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"github.com/MeteorsLiu/virtuallabs/backend/queue"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+//
+// 镜像目录接口
+//
+
+var (
+	// 镜像地址：[仓库[:端口]/]路径[:标签][@sha256:摘要]
+	imageRefPattern = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*(:[0-9]+)?(/[a-z0-9]+([._-][a-z0-9]+)*)*(:[A-Za-z0-9_][A-Za-z0-9_.-]{0,127})?(@sha256:[a-f0-9]{64})?$`)
+	// Kubernetes 资源数量，如 500m、1.5、2Gi
+	quantityPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?(m|k|M|G|T|Ki|Mi|Gi|Ti)?$`)
+)
+
+// 镜像的创建和更新参数，更新时整体替换
+type imageInput struct {
+	Name           string `json:"name" binding:"required,min=2,max=100"`
+	Image          string `json:"image" binding:"required,max=255"`
+	Description    string `json:"description" binding:"max=500"`
+	CPURequest     string `json:"cpuRequest" binding:"max=20"`
+	CPULimit       string `json:"cpuLimit" binding:"max=20"`
+	MemoryRequest  string `json:"memoryRequest" binding:"max=20"`
+	MemoryLimit    string `json:"memoryLimit" binding:"max=20"`
+	Ports          []int  `json:"ports" binding:"max=10,dive,min=1,max=65535"`
+	AccessProtocol string `json:"accessProtocol" binding:"required,oneof=vnc terminal http"`
+	Enabled        *bool  `json:"enabled"` // 为空时启用
+
+	Scheduling *queue.Scheduling `json:"scheduling"`
+}
+
+func (in *imageInput) validate() error {
+	if !imageRefPattern.MatchString(in.Image) {
+		return errors.New("无效的镜像地址")
+	}
+	for name, q := range map[string]string{
+		"cpuRequest":    in.CPURequest,
+		"cpuLimit":      in.CPULimit,
+		"memoryRequest": in.MemoryRequest,
+		"memoryLimit":   in.MemoryLimit,
+	} {
+		if q != "" && !quantityPattern.MatchString(q) {
+			return fmt.Errorf("无效的资源数量 %s: %s", name, q)
+		}
+	}
+	if err := api.ValidateScheduling(in.Scheduling); err != nil {
+		return err
+	}
+	seen := make(map[int]bool, len(in.Ports))
+	for _, p := range in.Ports {
+		if seen[p] {
+			return fmt.Errorf("端口重复: %d", p)
+		}
+		seen[p] = true
+	}
+	return nil
+}
+
+func (in *imageInput) apply(img *models.LabImage) {
+	img.Name = in.Name
+	img.Image = in.Image
+	img.Description = in.Description
+	img.CPURequest = in.CPURequest
+	img.CPULimit = in.CPULimit
+	img.MemoryRequest = in.MemoryRequest
+	img.MemoryLimit = in.MemoryLimit
+	img.Ports = in.Ports
+	img.AccessProtocol = in.AccessProtocol
+	img.Enabled = in.Enabled == nil || *in.Enabled
+	img.Scheduling = nil
+	if !in.Scheduling.IsZero() {
+		img.Scheduling = in.Scheduling
+	}
+}
+
+// CreateImage 新增镜像（仅限管理员）
+func CreateImage(c *gin.Context) {
+	var input imageInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := input.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if nameTaken(input.Name, 0) {
+		c.JSON(http.StatusConflict, gin.H{"error": "镜像名称已存在"})
+		return
+	}
+
+	var image models.LabImage
+	input.apply(&image)
+	image.CreatedAt = time.Now()
+	image.UpdatedAt = image.CreatedAt
+	if err := api.DB.Create(&image).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "镜像创建失败"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, image)
+}
+
+// GetImages 获取镜像列表，教师只能看到已启用的镜像
+func GetImages(c *gin.Context) {
+	query := api.DB.Order("name ASC")
+	if c.GetString("userRole") != "admin" {
+		query = query.Where("enabled = ?", true)
+	}
+
+	var images []models.LabImage
+	if err := query.Find(&images).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, images)
+}
+
+// GetImage 获取镜像详情
+func GetImage(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var image models.LabImage
+	if err := api.DB.First(&image, id).Error; err != nil {
+		handleImageError(c, err)
+		return
+	}
+	if !image.Enabled && c.GetString("userRole") != "admin" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "镜像不存在"})
+		return
+	}
+
+	c.JSON(http.StatusOK, image)
+}
+
+// UpdateImage 更新镜像（仅限管理员），只影响之后创建的虚拟机
+func UpdateImage(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var image models.LabImage
+	if err := api.DB.First(&image, id).Error; err != nil {
+		handleImageError(c, err)
+		return
+	}
+
+	var input imageInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := input.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if nameTaken(input.Name, image.ImageID) {
+		c.JSON(http.StatusConflict, gin.H{"error": "镜像名称已存在"})
+		return
+	}
+
+	input.apply(&image)
+	image.UpdatedAt = time.Now()
+	if err := api.DB.Save(&image).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, image)
+}
+
+// DeleteImage 删除镜像（仅限管理员），仍被实验引用时只能停用
+func DeleteImage(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	var image models.LabImage
+	if err := api.DB.First(&image, id).Error; err != nil {
+		handleImageError(c, err)
+		return
+	}
+
+	var count int64
+	if err := api.DB.Model(&models.Experiment{}).Where("image_id = ?", id).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库错误"})
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("镜像仍被 %d 个实验使用，请先停用", count)})
+		return
+	}
+
+	if err := api.DB.Delete(&image).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "镜像删除成功"})
+}
+
+func nameTaken(name string, exceptID int) bool {
+	var count int64
+	api.DB.Model(&models.LabImage{}).Where("name = ? AND image_id <> ?", name, exceptID).Count(&count)
+	return count > 0
+}
+
+func handleImageError(c *gin.Context, err error) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "镜像不存在"})
+	} else {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库错误"})
+	}
+}
@@ -0,0 +1,19 @@
+package images
+
+import (
+	"github.com/MeteorsLiu/virtuallabs/backend/api"
+	"github.com/gin-gonic/gin"
+)
+
+func Register(router *gin.Engine) {
+	// 镜像目录路由组，教师可查看，管理员维护
+	imageGroup := router.Group("/images")
+	imageGroup.Use(api.JWTAuthMiddleware())
+	{
+		imageGroup.GET("/", api.RoleMiddleware("teacher", "admin"), GetImages)
+		imageGroup.GET("/:id", api.RoleMiddleware("teacher", "admin"), GetImage)
+		imageGroup.POST("/", api.RoleMiddleware("admin"), CreateImage)
+		imageGroup.PUT("/:id", api.RoleMiddleware("admin"), UpdateImage)
+		imageGroup.DELETE("/:id", api.RoleMiddleware("admin"), DeleteImage)
+	}
+}
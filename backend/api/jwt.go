@@ -3,6 +3,7 @@ package api
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	jwt "github.com/golang-jwt/jwt/v5"
@@ -11,6 +12,7 @@ import (
 // 配置参数
 var (
 	JwtSecret []byte
+	JwtExpire = 24 * time.Hour
 )
 
 // JWT 声明结构
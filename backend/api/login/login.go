@@ -160,7 +160,7 @@ func LoginHandler(c *gin.Context) {
 	}
 
 	// 生成JWT
-	expirationTime := time.Now().Add(24 * time.Hour)
+	expirationTime := time.Now().Add(api.JwtExpire)
 	claims := &api.Claims{
 		UserID: user.UserID,
 		Role:   user.Role.Role,
@@ -0,0 +1,78 @@
+package vm
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/api"
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"github.com/MeteorsLiu/virtuallabs/backend/worker"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 获取虚拟机访问凭据，仅虚拟机所有者可查看
+func GetVMCredentialsHandler(c *gin.Context) {
+	if c.GetString("userRole") != "student" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "仅虚拟机所有者可查看访问凭据"})
+		return
+	}
+	vm, ok := loadAccessibleVM(c)
+	if !ok {
+		return
+	}
+	if vm.Credentials == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "访问凭据尚未生成"})
+		return
+	}
+
+	creds, err := worker.OpenCredentials(worker.Secret, vm.VMName, vm.Credentials)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "访问凭据解密失败"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, creds)
+}
+
+// 工作节点上报虚拟机访问凭据和进度代理令牌的哈希，只保存密文和哈希
+func VMCredentialsCallbackHandler(c *gin.Context) {
+	// 未配置共享密钥时任何人都能调用该接口，且凭据无法安全加密
+	if worker.Secret == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "未配置工作节点密钥，拒绝接收凭据"})
+		return
+	}
+
+	var req worker.CredentialsCallback
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 确认密文可以解开，避免保存无法使用的凭据
+	if _, err := worker.OpenCredentials(worker.Secret, req.VMName, req.Sealed); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "凭据无效"})
+		return
+	}
+
+	var vm models.VirtualMachine
+	if err := api.DB.Where("vm_name = ?", req.VMName).First(&vm).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "虚拟机不存在"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询失败"})
+		return
+	}
+
+	updates := map[string]interface{}{"credentials": req.Sealed}
+	if req.AgentTokenHash != "" {
+		updates["agent_token_hash"] = req.AgentTokenHash
+	}
+	if err := api.DB.Model(&vm).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "凭据保存失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "凭据保存成功"})
+}
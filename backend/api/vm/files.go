@@ -0,0 +1,89 @@
+package vm
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/worker"
+	"github.com/gin-gonic/gin"
+)
+
+// 从虚拟机工作目录下载文件（所属学生或课程教师）
+func DownloadVMFileHandler(c *gin.Context) {
+	var opts worker.FileOptions
+	if err := c.ShouldBindQuery(&opts); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	vm, ok := loadAccessibleVM(c)
+	if !ok {
+		return
+	}
+	if vm.Status != "running" {
+		c.JSON(http.StatusConflict, gin.H{"error": "虚拟机未运行"})
+		return
+	}
+
+	resp, err := worker.DownloadFile(c.Request.Context(), vm.VMName, opts)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "文件服务不可用"})
+		return
+	}
+	defer resp.Body.Close()
+
+	relayWorkerResponse(c, resp)
+}
+
+// 向虚拟机工作目录上传文件（所属学生或课程教师），archive=true 时按 tar 归档解包
+func UploadVMFileHandler(c *gin.Context) {
+	var opts worker.FileOptions
+	if err := c.ShouldBindQuery(&opts); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	vm, ok := loadAccessibleVM(c)
+	if !ok {
+		return
+	}
+	if vm.Status != "running" {
+		c.JSON(http.StatusConflict, gin.H{"error": "虚拟机未运行"})
+		return
+	}
+
+	// 预留 1MB 给 multipart 表单头
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, worker.MaxUploadSize+1<<20)
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "文件上传失败"})
+		return
+	}
+	if file.Size > worker.MaxUploadSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "文件过大"})
+		return
+	}
+
+	opts.Name = path.Base(strings.ReplaceAll(file.Filename, "\\", "/"))
+	if opts.Name == "." || opts.Name == "/" || opts.Name == ".." {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的文件名"})
+		return
+	}
+
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取文件失败"})
+		return
+	}
+	defer f.Close()
+
+	resp, err := worker.UploadFile(c.Request.Context(), vm.VMName, opts, f, file.Size)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "文件服务不可用"})
+		return
+	}
+	defer resp.Body.Close()
+
+	relayWorkerResponse(c, resp)
+}
@@ -0,0 +1,120 @@
+package vm
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/api"
+	"github.com/MeteorsLiu/virtuallabs/backend/lease"
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"github.com/MeteorsLiu/virtuallabs/backend/outbox"
+	"github.com/MeteorsLiu/virtuallabs/backend/queue"
+	"github.com/gin-gonic/gin"
+)
+
+type ExtendLeaseRequest struct {
+	// 续期分钟数，为空时使用实验的租期
+	Minutes int `json:"minutes" binding:"omitempty,min=1,max=1440"`
+}
+
+// 续期虚拟机（所属学生或课程教师），已停止的虚拟机续期后重新启动
+func ExtendVMLeaseHandler(c *gin.Context) {
+	var req ExtendLeaseRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	vm, ok := loadAccessibleVM(c)
+	if !ok {
+		return
+	}
+
+	var experiment models.Experiment
+	if err := api.DB.First(&experiment, vm.ExperimentID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询失败"})
+		return
+	}
+
+	extend := time.Duration(experiment.LeaseMinutes) * time.Minute
+	if req.Minutes > 0 {
+		extend = time.Duration(req.Minutes) * time.Minute
+	}
+	maxLease := time.Duration(experiment.MaxLeaseMinutes) * time.Minute
+	now := time.Now()
+
+	updates := map[string]interface{}{
+		"lease_warned_at": nil,
+	}
+	if vm.LeaseWarnedAt != nil && vm.StatusMsg == lease.WarningMsg {
+		updates["status_msg"] = ""
+	}
+
+	var startMsg *queue.Message
+	if vm.Status == "stopped" {
+		// 重新启动，租期重新开始计算
+		expiresAt := now.Add(min(extend, maxLease))
+		updates["status"] = "pending"
+		updates["status_msg"] = ""
+		updates["last_updated"] = now
+		updates["lease_started_at"] = now
+		updates["lease_expires_at"] = expiresAt
+		msg := queue.StartVMMessage(c, vm.VMID, vm.VMName)
+		startMsg = &msg
+	} else {
+		startedAt := now
+		if vm.LeaseStartedAt != nil {
+			startedAt = *vm.LeaseStartedAt
+		}
+		base := now
+		if vm.LeaseExpiresAt != nil && vm.LeaseExpiresAt.After(now) {
+			base = *vm.LeaseExpiresAt
+		}
+		limit := startedAt.Add(maxLease)
+		if !base.Before(limit) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "已达到实验允许的最长租期"})
+			return
+		}
+		expiresAt := base.Add(extend)
+		if expiresAt.After(limit) {
+			expiresAt = limit
+		}
+		updates["lease_started_at"] = startedAt
+		updates["lease_expires_at"] = expiresAt
+	}
+
+	tx := api.DB.Begin()
+	// 以读取时的状态为条件更新，避免与租期回收并发时续期已被停止或删除的虚拟机
+	result := tx.Model(&models.VirtualMachine{}).
+		Where("vm_id = ? AND status = ?", vm.VMID, vm.Status).
+		Updates(updates)
+	if result.Error != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "续期失败"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "虚拟机状态已变化，请刷新后重试"})
+		return
+	}
+	if startMsg != nil {
+		if err := outbox.Enqueue(tx, *startMsg); err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "续期失败"})
+			return
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "续期失败"})
+		return
+	}
+	if startMsg != nil {
+		outbox.Notify()
+	}
+
+	api.DB.First(vm, vm.VMID)
+	c.JSON(http.StatusOK, newVMDetailResponse(vm, &experiment))
+}
@@ -0,0 +1,32 @@
+package vm
+
+import (
+	"net/http"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/worker"
+	"github.com/gin-gonic/gin"
+)
+
+// 获取虚拟机容器日志（所属学生或课程教师）
+func GetVMLogsHandler(c *gin.Context) {
+	var opts worker.LogOptions
+	if err := c.ShouldBindQuery(&opts); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	vm, ok := loadAccessibleVM(c)
+	if !ok {
+		return
+	}
+
+	// 客户端断开时随请求上下文一起关闭上游日志流
+	resp, err := worker.PodLogs(c.Request.Context(), vm.VMName, opts)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "日志服务不可用"})
+		return
+	}
+	defer resp.Body.Close()
+
+	relayWorkerResponse(c, resp)
+}
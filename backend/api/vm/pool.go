@@ -0,0 +1,183 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/api"
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"github.com/MeteorsLiu/virtuallabs/backend/outbox"
+	"github.com/MeteorsLiu/virtuallabs/backend/queue"
+	"github.com/MeteorsLiu/virtuallabs/backend/worker"
+	"github.com/gin-gonic/gin"
+)
+
+// 领取预热虚拟机的超时时间，超时后按常规流程创建
+const claimTimeout = 5 * time.Second
+
+// experimentProvision 返回实验级别的初始化数据，学生相关字段由调用方补充
+func experimentProvision(experiment *models.Experiment) *queue.Provision {
+	provision := &queue.Provision{
+		ExperimentID: experiment.ExperimentID,
+		InitScript:   experiment.InitScript,
+	}
+	for _, f := range experiment.Files {
+		provision.Files = append(provision.Files, queue.ProvisionFile{Name: f.FileName, URL: f.FileURL})
+	}
+	if img := experiment.Image; img != nil {
+		provision.Image = &queue.ImageSpec{
+			Image:          img.Image,
+			CPURequest:     img.CPURequest,
+			CPULimit:       img.CPULimit,
+			MemoryRequest:  img.MemoryRequest,
+			MemoryLimit:    img.MemoryLimit,
+			Ports:          img.Ports,
+			AccessProtocol: img.AccessProtocol,
+		}
+	}
+
+	var base *queue.Scheduling
+	if experiment.Image != nil {
+		base = experiment.Image.Scheduling
+	}
+	provision.Scheduling = queue.MergeScheduling(base, experiment.Scheduling)
+	provision.Egress = experiment.Egress
+	// 进度代理令牌由工作节点在创建或领取虚拟机时生成，指令中只有地址
+	provision.Agent = &queue.AgentSpec{URL: api.AgentURL}
+	return provision
+}
+
+// WarmPoolsHandler 返回所有启用预热的实验配置，由工作节点定期拉取并补齐预热池
+func WarmPoolsHandler(c *gin.Context) {
+	var experiments []models.Experiment
+	if err := api.DB.Preload("Files").Preload("Image").Where("warm_pool_size > 0").Find(&experiments).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询失败"})
+		return
+	}
+
+	pools := make([]worker.WarmPool, 0, len(experiments))
+	for i := range experiments {
+		// 镜像停用或不适合预热时不再预热，已有的预热虚拟机会被工作节点回收
+		if !warmPoolEligible(&experiments[i]) {
+			continue
+		}
+		pools = append(pools, worker.WarmPool{
+			ExperimentID: experiments[i].ExperimentID,
+			Size:         experiments[i].WarmPoolSize,
+			Provision:    experimentProvision(&experiments[i]),
+		})
+	}
+	c.JSON(http.StatusOK, pools)
+}
+
+// ClaimedVMsHandler 返回没有对应虚拟机记录的已领取预热虚拟机，由工作节点删除。
+// 领取成功但后端已超时放弃或未能保存记录时，虚拟机记录会按常规流程另行创建
+func ClaimedVMsHandler(c *gin.Context) {
+	var claimed []worker.ClaimedVM
+	if err := c.ShouldBindJSON(&claimed); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(claimed) > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "一次最多核对 1000 台虚拟机"})
+		return
+	}
+
+	names := make([]string, len(claimed))
+	for i, vm := range claimed {
+		names[i] = vm.VMName
+	}
+	var records []models.VirtualMachine
+	if len(names) > 0 {
+		if err := api.DB.Select("vm_id", "vm_name").Where("vm_name IN ?", names).Find(&records).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "查询失败"})
+			return
+		}
+	}
+	recorded := make(map[worker.ClaimedVM]bool, len(records))
+	for _, r := range records {
+		recorded[worker.ClaimedVM{VMID: r.VMID, VMName: r.VMName}] = true
+	}
+
+	orphans := make([]worker.ClaimedVM, 0)
+	for _, vm := range claimed {
+		if !recorded[vm] {
+			orphans = append(orphans, vm)
+		}
+	}
+	c.JSON(http.StatusOK, orphans)
+}
+
+// warmPoolEligible 判断实验能否使用预热池。预热虚拟机创建时还不知道学生，
+// 初始化脚本运行时没有 LAB_STUDENT_* 变量，这些变量在领取后才写入 $LAB_WORKSPACE/.lab/env，
+// 因此初始化脚本引用学生变量的实验不预热，始终按常规流程创建
+func warmPoolEligible(experiment *models.Experiment) bool {
+	if experiment.WarmPoolSize <= 0 {
+		return false
+	}
+	if img := experiment.Image; img != nil && !img.Enabled {
+		return false
+	}
+	return !strings.Contains(experiment.InitScript, "LAB_STUDENT_")
+}
+
+// useWarmVM 为已保存的虚拟机记录领取预热虚拟机并更新记录，返回是否领取成功。
+// 状态取工作节点领取时观察到的 Pod 状态，尚未就绪时由工作节点随后回调
+func useWarmVM(c *gin.Context, vm *models.VirtualMachine, studentNumber string, agent *queue.AgentSpec) bool {
+	claim, ok := claimWarmVM(c, vm, studentNumber, agent)
+	if !ok {
+		return false
+	}
+
+	status := "pending"
+	if claim.Status == "running" {
+		status = "running"
+	}
+	if err := api.DB.Model(vm).Updates(map[string]interface{}{
+		"vm_name":          claim.VMName,
+		"status":           status,
+		"credentials":      claim.Credentials,
+		"agent_token_hash": claim.AgentTokenHash,
+		"last_updated":     time.Now(),
+	}).Error; err != nil {
+		log.Printf("record warm vm %s: %v", claim.VMName, err)
+		releaseWarmVM(c, vm.VMID, claim.VMName)
+		return false
+	}
+	vm.VMName, vm.Status = claim.VMName, status
+	return true
+}
+
+// claimWarmVM 尝试为新建的虚拟机记录领取预热虚拟机，返回领取到的 Deployment 名及其加密凭据
+func claimWarmVM(c *gin.Context, vm *models.VirtualMachine, studentNumber string, agent *queue.AgentSpec) (*worker.ClaimResponse, bool) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), claimTimeout)
+	defer cancel()
+
+	claim, err := worker.ClaimWarmVM(ctx, worker.ClaimRequest{
+		ExperimentID:  vm.ExperimentID,
+		VMID:          vm.VMID,
+		StudentID:     vm.CreatorID,
+		StudentNumber: studentNumber,
+		Agent:         agent,
+	})
+	if err != nil {
+		if !errors.Is(err, worker.ErrNoWarmVM) {
+			log.Println("claim warm vm:", err)
+		}
+		return nil, false
+	}
+	return claim, true
+}
+
+// releaseWarmVM 在领取成功但记录未能保存时回收该虚拟机，避免遗留无主的 Deployment
+func releaseWarmVM(c *gin.Context, vmid int, name string) {
+	if err := outbox.Enqueue(api.DB, queue.DeleteVMMessage(c, vmid, name)); err != nil {
+		log.Printf("release warm vm %s: %v", name, err)
+		return
+	}
+	outbox.Notify()
+}
@@ -2,6 +2,7 @@ package vm
 
 import (
 	"github.com/MeteorsLiu/virtuallabs/backend/api"
+	"github.com/MeteorsLiu/virtuallabs/backend/worker"
 	"github.com/gin-gonic/gin"
 )
 
@@ -12,9 +13,17 @@ func Register(router *gin.Engine) {
 		vmGroup.POST("/create-vm", CreateVMHandler)
 		vmGroup.GET("/get-experiment-vms/:experimentId", GetExperimentVMsHandler)
 		vmGroup.POST("/delete-vm", DeleteVMHandler)
+		vmGroup.GET("/:vmName/logs", GetVMLogsHandler)
+		vmGroup.GET("/:vmName/files", DownloadVMFileHandler)
+		vmGroup.POST("/:vmName/files", UploadVMFileHandler)
+		vmGroup.POST("/:vmName/extend", ExtendVMLeaseHandler)
+		vmGroup.GET("/:vmName/credentials", GetVMCredentialsHandler)
 
 	}
 
 	// 新增虚拟机状态回调接口
-	router.POST("/vm-status-callback", VMStatusCallbackHandler)
+	router.POST("/vm-status-callback", api.WorkerAuthMiddleware(), VMStatusCallbackHandler)
+	router.GET(worker.WarmPoolsPath, api.WorkerAuthMiddleware(), WarmPoolsHandler)
+	router.POST(worker.ClaimedVMsPath, api.WorkerAuthMiddleware(), ClaimedVMsHandler)
+	router.POST(worker.CredentialsCallbackPath, api.WorkerAuthMiddleware(), VMCredentialsCallbackHandler)
 }
@@ -2,12 +2,14 @@ package vm
 
 import (
 	"errors"
+	"io"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/MeteorsLiu/virtuallabs/backend/api"
 	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"github.com/MeteorsLiu/virtuallabs/backend/outbox"
 	"github.com/MeteorsLiu/virtuallabs/backend/queue"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -35,7 +37,32 @@ type VMDetailResponse struct {
 	ExperimentID int       `json:"experimentId"`
 	VMDetails    string    `json:"vmDetails"`
 	Status       string    `json:"status"`
+	StatusMsg    string    `json:"statusMsg"`
 	CreatedAt    time.Time `json:"createdAt"`
+
+	// 租期到期时间及可续期的最晚时间，已停止的虚拟机为空
+	LeaseExpiresAt *time.Time `json:"leaseExpiresAt"`
+	LeaseMaxAt     *time.Time `json:"leaseMaxAt"`
+	LeaseWarned    bool       `json:"leaseWarned"`
+}
+
+func newVMDetailResponse(vm *models.VirtualMachine, experiment *models.Experiment) VMDetailResponse {
+	resp := VMDetailResponse{
+		VMID:           vm.VMID,
+		VMName:         vm.VMName,
+		ExperimentID:   vm.ExperimentID,
+		VMDetails:      vm.VMDetails,
+		Status:         vm.Status,
+		StatusMsg:      vm.StatusMsg,
+		CreatedAt:      vm.CreatedAt,
+		LeaseExpiresAt: vm.LeaseExpiresAt,
+		LeaseWarned:    vm.LeaseWarnedAt != nil,
+	}
+	if vm.LeaseStartedAt != nil && vm.LeaseExpiresAt != nil {
+		maxAt := vm.LeaseStartedAt.Add(time.Duration(experiment.MaxLeaseMinutes) * time.Minute)
+		resp.LeaseMaxAt = &maxAt
+	}
+	return resp
 }
 
 // 创建虚拟机（学生）
@@ -71,6 +98,30 @@ func CreateVMHandler(c *gin.Context) {
 		return
 	}
 
+	// 加载实验附件与学生信息，用于初始化虚拟机环境
+	var experiment models.Experiment
+	if err := api.DB.Preload("Files").Preload("Image").First(&experiment, req.ExperimentID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "实验不存在"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询失败"})
+		return
+	}
+
+	// 只允许运行镜像目录中已启用的镜像
+	if experiment.Image != nil && !experiment.Image.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "实验使用的镜像已停用，请联系教师"})
+		return
+	}
+
+	var studentInfo models.StudentInformation
+	api.DB.Where("user_id = ?", userID).First(&studentInfo)
+
+	provision := experimentProvision(&experiment)
+	provision.StudentID = userID
+	provision.StudentNumber = studentInfo.StudentNumber
+
 	tx := api.DB.Begin()
 	defer func() {
 		if r := recover(); r != nil {
@@ -78,12 +129,20 @@ func CreateVMHandler(c *gin.Context) {
 		}
 	}()
 
-	// 生成UUID作为业务ID
+	// 生成UUID作为业务ID，租期从创建时开始计算
 	vmUUID := uuid.New().String()
+	now := time.Now()
+	expiresAt := now.Add(time.Duration(experiment.LeaseMinutes) * time.Minute)
 	newVM := models.VirtualMachine{
-		VMName:       vmUUID,
-		ExperimentID: req.ExperimentID,
-		VMDetails:    req.VMDetails,
+		VMName:         vmUUID,
+		ExperimentID:   req.ExperimentID,
+		VMDetails:      req.VMDetails,
+		CreatorID:      userID,
+		Status:         "pending",
+		CreatedAt:      now,
+		LastUpdated:    now,
+		LeaseStartedAt: &now,
+		LeaseExpiresAt: &expiresAt,
 	}
 
 	if err := tx.Create(&newVM).Error; err != nil {
@@ -105,22 +164,33 @@ func CreateVMHandler(c *gin.Context) {
 		return
 	}
 
-	// 发送创建请求
-	if err := queue.CreateVM(newVM.VMID, newVM.VMName); err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "请求处理失败"})
+	// 不使用预热池时创建指令写入发件箱，与虚拟机记录同时提交
+	warm := warmPoolEligible(&experiment)
+	if !warm {
+		if err := outbox.Enqueue(tx, queue.CreateVMMessage(c, newVM.VMID, newVM.VMName, provision)); err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "请求处理失败"})
+			return
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建虚拟机失败"})
 		return
 	}
 
-	tx.Commit()
-	c.JSON(http.StatusCreated, VMDetailResponse{
-		VMID:         newVM.VMID,
-		VMName:       newVM.VMName,
-		ExperimentID: newVM.ExperimentID,
-		VMDetails:    newVM.VMDetails,
-		Status:       "pending",
-		CreatedAt:    time.Now(),
-	})
+	// 领取预热虚拟机需要调用工作节点，在事务提交后进行，避免请求期间持有行锁；
+	// 池为空或领取失败时按常规流程创建
+	if warm && !useWarmVM(c, &newVM, studentInfo.StudentNumber, provision.Agent) {
+		if err := outbox.Enqueue(api.DB, queue.CreateVMMessage(c, newVM.VMID, newVM.VMName, provision)); err != nil {
+			api.DB.Model(&newVM).Updates(map[string]interface{}{"status": "error", "status_msg": "创建指令提交失败，请删除后重新创建"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "请求处理失败"})
+			return
+		}
+	}
+	outbox.Notify()
+
+	c.JSON(http.StatusCreated, newVMDetailResponse(&newVM, &experiment))
 }
 
 // 获取实验虚拟机列表
@@ -140,20 +210,14 @@ func GetExperimentVMsHandler(c *gin.Context) {
 	}
 
 	var vms []models.VirtualMachine
-	if err := query.Find(&vms).Error; err != nil {
+	if err := query.Preload("Experiment").Find(&vms).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询失败"})
 		return
 	}
 
 	response := make([]VMDetailResponse, 0, len(vms))
 	for _, vm := range vms {
-		response = append(response, VMDetailResponse{
-			VMID:         vm.VMID,
-			VMName:       vm.VMName,
-			ExperimentID: vm.ExperimentID,
-			VMDetails:    vm.VMDetails,
-			Status:       vm.Status, // 实际应从业务系统获取
-		})
+		response = append(response, newVMDetailResponse(&vm, &vm.Experiment))
 	}
 
 	c.JSON(http.StatusOK, response)
@@ -163,9 +227,17 @@ func GetExperimentVMsHandler(c *gin.Context) {
 func DeleteVMHandler(c *gin.Context) {
 	userID := c.GetInt("userID")
 
-	var thisVm models.StudentVirtualMachine
+	var req DeleteVMRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 只能删除自己的虚拟机
+	var thisVm models.VirtualMachine
 	err := api.DB.
-		Where("student_id = ?", userID).
+		Joins("JOIN student_virtual_machines ON virtual_machines.vm_id = student_virtual_machines.vm_id").
+		Where("student_virtual_machines.student_id = ? AND virtual_machines.vm_name = ?", userID, req.VMName).
 		First(&thisVm).Error
 
 	if err != nil {
@@ -180,24 +252,94 @@ func DeleteVMHandler(c *gin.Context) {
 		}
 	}()
 
-	// 删除虚拟机（级联删除关联关系）
-	if err := tx.Where("vm_name = ?", thisVm.VirtualMachine.VMName).Delete(&thisVm.VirtualMachine).Error; err != nil {
+	// 删除虚拟机及学生关联
+	if err := tx.Where("vm_id = ?", thisVm.VMID).Delete(&models.StudentVirtualMachine{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除失败"})
+		return
+	}
+	if err := tx.Delete(&thisVm).Error; err != nil {
 		tx.Rollback()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除失败"})
 		return
 	}
 
-	// 发送删除请求
-	if err := queue.DeleteVM(thisVm.VirtualMachine.VMID, thisVm.VirtualMachine.VMName); err != nil {
+	// 删除指令写入发件箱
+	if err := outbox.Enqueue(tx, queue.DeleteVMMessage(c, thisVm.VMID, thisVm.VMName)); err != nil {
 		tx.Rollback()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除请求发送失败"})
 		return
 	}
 
-	tx.Commit()
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除失败"})
+		return
+	}
+	outbox.Notify()
+
 	c.JSON(http.StatusOK, gin.H{"message": "删除操作已提交"})
 }
 
+// loadAccessibleVM 按路径参数加载虚拟机并校验访问权限，失败时已写入响应
+func loadAccessibleVM(c *gin.Context) (*models.VirtualMachine, bool) {
+	var vm models.VirtualMachine
+	if err := api.DB.Where("vm_name = ?", c.Param("vmName")).First(&vm).Error; err != nil {
+		handleVMError(c, err)
+		return nil, false
+	}
+
+	if !canAccessVM(c.GetInt("userID"), c.GetString("userRole"), &vm) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无权访问该虚拟机"})
+		return nil, false
+	}
+	return &vm, true
+}
+
+// 判断用户是否可访问虚拟机：学生需为创建者，教师需负责实验所属课程
+func canAccessVM(userID int, userRole string, vm *models.VirtualMachine) bool {
+	var count int64
+	switch userRole {
+	case "student":
+		api.DB.Model(&models.StudentVirtualMachine{}).
+			Where("student_id = ? AND vm_id = ?", userID, vm.VMID).
+			Count(&count)
+	case "teacher":
+		api.DB.Model(&models.TeacherCourse{}).
+			Joins("JOIN experiments ON experiments.course_id = teacher_courses.course_id").
+			Where("teacher_courses.teacher_id = ? AND experiments.experiment_id = ?", userID, vm.ExperimentID).
+			Count(&count)
+	}
+	return count > 0
+}
+
+// relayWorkerResponse 将工作节点的响应原样转发给客户端，边读边刷新以支持流式输出
+func relayWorkerResponse(c *gin.Context, resp *http.Response) {
+	for _, h := range []string{"Content-Type", "Content-Disposition"} {
+		if v := resp.Header.Get(h); v != "" {
+			c.Header(h, v)
+		}
+	}
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Status(resp.StatusCode)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := c.Writer.Write(buf[:n]); werr != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+		if err != nil {
+			if err != io.EOF {
+				c.Error(err)
+			}
+			return
+		}
+	}
+}
+
 func handleVMError(c *gin.Context, err error) {
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "虚拟机不存在"})
@@ -233,6 +375,12 @@ func VMStatusCallbackHandler(c *gin.Context) {
 		return
 	}
 
+	// 已停止的虚拟机重新启动前会先改为 pending，此时收到的回调来自停止前的 Pod
+	if vm.Status == "stopped" {
+		c.JSON(http.StatusOK, gin.H{"message": "虚拟机已停止，忽略状态回调"})
+		return
+	}
+
 	// 更新状态
 	updateData := map[string]interface{}{
 		"status":       req.Status,
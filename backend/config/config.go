@@ -0,0 +1,146 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/conf"
+)
+
+// 旧版本硬编码的 JWT 密钥，生产模式下禁止使用
+const DefaultJwtSecret = "123456"
+
+// 仓库中配置文件附带的工作节点开发密钥，便于本地直接启动，生产模式下禁止使用
+const DevWorkerSecret = "dev-worker-secret"
+
+// Config 后端配置，优先级：命令行参数 > 环境变量 > 配置文件 > 默认值
+type Config struct {
+	Mode       string `json:",default=dev,options=dev|prod,env=LAB_MODE"`
+	ListenAddr string `json:",default=:8888,env=LAB_LISTEN_ADDR"`
+	UploadDir  string `json:",default=uploads,env=LAB_UPLOAD_DIR"`
+
+	// 允许跨域的来源，为空或包含 * 时允许全部，环境变量 LAB_CORS_ORIGINS 以逗号分隔
+	CORSOrigins []string `json:",optional"`
+
+	JWT    JWTConf
+	DB     DBConf
+	Kafka  KafkaConf
+	Worker WorkerConf
+	Lease  LeaseConf
+	Agent  AgentConf
+
+	// 实验和镜像可选用的 PriorityClass，需预先在集群中创建（见 k8s/priorityclasses.yml）
+	PriorityClasses []string `json:",default=[lab-practice,lab-exam]"`
+}
+
+type JWTConf struct {
+	Secret string        `json:",optional,env=LAB_JWT_SECRET"`
+	Expire time.Duration `json:",default=24h,env=LAB_JWT_EXPIRE"`
+}
+
+type DBConf struct {
+	DSN             string        `json:",optional,env=LAB_DB_DSN"`
+	MaxOpenConns    int           `json:",default=50,env=LAB_DB_MAX_OPEN_CONNS"`
+	MaxIdleConns    int           `json:",default=10,env=LAB_DB_MAX_IDLE_CONNS"`
+	ConnMaxLifetime time.Duration `json:",default=1h,env=LAB_DB_CONN_MAX_LIFETIME"`
+}
+
+// KafkaConf 环境变量 LAB_KAFKA_BROKERS 以逗号分隔
+type KafkaConf struct {
+	Brokers []string `json:",default=[localhost:9092]"`
+	VMTopic string   `json:",default=k8s,env=LAB_KAFKA_VM_TOPIC"`
+}
+
+// WorkerConf k8s 工作节点的地址及双方互相调用时校验的共享密钥
+type WorkerConf struct {
+	URL    string `json:",default=http://127.0.0.1:8889,env=LAB_WORKER_URL"`
+	Secret string `json:",optional,env=LAB_WORKER_SECRET"`
+}
+
+// LeaseConf 虚拟机租期检查周期，以及到期前多久发送提醒
+type LeaseConf struct {
+	Interval   time.Duration `json:",default=1m,env=LAB_LEASE_INTERVAL"`
+	WarnBefore time.Duration `json:",default=15m,env=LAB_LEASE_WARN_BEFORE"`
+}
+
+// AgentConf 虚拟机内进度代理访问后端的地址，需从集群内可达
+type AgentConf struct {
+	URL string `json:",default=http://127.0.0.1:8888,env=LAB_AGENT_URL"`
+}
+
+// Load 读取配置文件，文件不存在且 required 为 false 时仅使用默认值和环境变量
+func Load(file string, required bool) (Config, error) {
+	var c Config
+	if _, err := os.Stat(file); err != nil && !required {
+		if err := conf.LoadFromYamlBytes([]byte("{}"), &c); err != nil {
+			return c, err
+		}
+	} else if err := conf.Load(file, &c); err != nil {
+		return c, fmt.Errorf("config file %s: %w", file, err)
+	}
+
+	if v := os.Getenv("LAB_KAFKA_BROKERS"); v != "" {
+		c.Kafka.Brokers = splitList(v)
+	}
+	if v := os.Getenv("LAB_CORS_ORIGINS"); v != "" {
+		c.CORSOrigins = splitList(v)
+	}
+	return c, nil
+}
+
+func (c *Config) IsProd() bool {
+	return c.Mode == "prod"
+}
+
+// Validate 校验配置，生产模式下拒绝缺失或默认的 JWT 密钥和开发用的 Worker.Secret，任何模式下都需要 Worker.Secret
+func (c *Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		return fmt.Errorf("ListenAddr: %w", err)
+	}
+	if c.DB.DSN == "" {
+		return errors.New("DB.DSN is required")
+	}
+	if c.JWT.Expire <= 0 {
+		return errors.New("JWT.Expire must be positive")
+	}
+	if len(c.Kafka.Brokers) == 0 || c.Kafka.VMTopic == "" {
+		return errors.New("Kafka.Brokers and Kafka.VMTopic are required")
+	}
+	if c.UploadDir == "" {
+		return errors.New("UploadDir is required")
+	}
+	if c.Lease.Interval <= 0 || c.Lease.WarnBefore <= 0 {
+		return errors.New("Lease.Interval and Lease.WarnBefore must be positive")
+	}
+	// 虚拟机访问凭据用该密钥加密，开发模式下也不能为空
+	if c.Worker.Secret == "" {
+		return errors.New("Worker.Secret is required to seal VM access credentials")
+	}
+
+	if c.IsProd() {
+		if c.JWT.Secret == "" || c.JWT.Secret == DefaultJwtSecret {
+			return errors.New("JWT.Secret must be set to a non-default value in prod mode")
+		}
+		if len(c.JWT.Secret) < 32 {
+			return errors.New("JWT.Secret must be at least 32 characters in prod mode")
+		}
+		if c.Worker.Secret == DevWorkerSecret {
+			return errors.New("Worker.Secret must not use the development value in prod mode")
+		}
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateProdSecret(t *testing.T) {
+	c, err := Load("missing.yml", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.DB.DSN = "user:pass@tcp(127.0.0.1:3306)/labs"
+	c.Mode = "prod"
+	c.Worker.Secret = "worker-secret"
+
+	for _, secret := range []string{"", DefaultJwtSecret, "too-short"} {
+		c.JWT.Secret = secret
+		if err := c.Validate(); err == nil {
+			t.Errorf("secret %q: expected error in prod mode", secret)
+		}
+	}
+
+	c.JWT.Secret = strings.Repeat("x", 32)
+	if err := c.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	c.Worker.Secret = DevWorkerSecret
+	if err := c.Validate(); err == nil {
+		t.Error("expected error for development worker secret in prod mode")
+	}
+
+	c.Mode = "dev"
+	c.JWT.Secret = ""
+	if err := c.Validate(); err != nil {
+		t.Errorf("dev mode should allow an empty JWT secret: %v", err)
+	}
+
+	c.Worker.Secret = ""
+	if err := c.Validate(); err == nil {
+		t.Error("expected error for missing worker secret in dev mode")
+	}
+}
@@ -0,0 +1,199 @@
+package grading
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 缺考评分项的处理方式，评分项日期（截止日期）过后仍没有成绩才算缺考，之前不计入
+const (
+	MissingZero    = "zero"
+	MissingExclude = "exclude"
+)
+
+// DefaultLetterGrades 课程未设置分数线时使用的五级制
+var DefaultLetterGrades = []models.LetterBoundary{
+	{Letter: "A", MinPercent: 90},
+	{Letter: "B", MinPercent: 80},
+	{Letter: "C", MinPercent: 70},
+	{Letter: "D", MinPercent: 60},
+	{Letter: "F", MinPercent: 0},
+}
+
+// DefaultPolicy 返回课程未设置总评规则时的默认规则
+func DefaultPolicy(courseID int) models.CourseGradePolicy {
+	return models.CourseGradePolicy{
+		CourseID:      courseID,
+		MissingPolicy: MissingZero,
+		DropLowest:    map[string]int{},
+		LetterGrades:  DefaultLetterGrades,
+	}
+}
+
+// ValidatePolicy 校验总评规则并将分数线按从高到低排序
+func ValidatePolicy(p *models.CourseGradePolicy) error {
+	switch p.MissingPolicy {
+	case MissingZero, MissingExclude:
+	default:
+		return fmt.Errorf("无效的缺考处理方式: %s", p.MissingPolicy)
+	}
+	for t, n := range p.DropLowest {
+		switch t {
+		case "exam", "homework", "experiment", "quiz":
+		default:
+			return fmt.Errorf("无效的评分项类型: %s", t)
+		}
+		if n < 0 || n > 20 {
+			return fmt.Errorf("%s 去掉的最低项数需在 0 到 20 之间", t)
+		}
+	}
+
+	if len(p.LetterGrades) == 0 || len(p.LetterGrades) > 20 {
+		return errors.New("需要 1 到 20 条等级分数线")
+	}
+	seen := make(map[float64]bool, len(p.LetterGrades))
+	for _, b := range p.LetterGrades {
+		if b.Letter == "" || len(b.Letter) > 10 {
+			return errors.New("等级名称不能为空且不超过 10 个字符")
+		}
+		if b.MinPercent < 0 || b.MinPercent > 100 {
+			return fmt.Errorf("等级 %s 的分数线需在 0 到 100 之间", b.Letter)
+		}
+		if seen[b.MinPercent] {
+			return fmt.Errorf("分数线 %v 重复", b.MinPercent)
+		}
+		seen[b.MinPercent] = true
+	}
+	sort.Slice(p.LetterGrades, func(i, j int) bool {
+		return p.LetterGrades[i].MinPercent > p.LetterGrades[j].MinPercent
+	})
+	return nil
+}
+
+// ComputeCourseGrade 按总评规则计算课程总评。各评分项得分按满分折算为比例后按权重加权平均，
+// scores 以评分项 ID 为键，没有可计入的评分项时 percent 为空
+func ComputeCourseGrade(policy *models.CourseGradePolicy, assessments []models.CourseAssessment, scores map[int]float64, now time.Time) (percent *float64, letter string) {
+	type item struct {
+		ratio, weight float64
+	}
+	byType := make(map[string][]item)
+	for _, a := range assessments {
+		if a.MaxScore <= 0 || a.Weight <= 0 {
+			continue
+		}
+		score, ok := scores[a.AssessmentID]
+		if !ok {
+			// 未到截止日期的评分项还不算缺考
+			if policy.MissingPolicy == MissingExclude || !now.After(a.AssessmentDate) {
+				continue
+			}
+			score = 0
+		}
+		byType[a.AssessmentType] = append(byType[a.AssessmentType], item{ratio: score / a.MaxScore, weight: a.Weight})
+	}
+
+	var sum, weights float64
+	for t, items := range byType {
+		// 去掉最低的若干项，至少保留一项
+		if n := min(policy.DropLowest[t], len(items)-1); n > 0 {
+			slices.SortStableFunc(items, func(a, b item) int {
+				switch {
+				case a.ratio < b.ratio:
+					return -1
+				case a.ratio > b.ratio:
+					return 1
+				}
+				return 0
+			})
+			items = items[n:]
+		}
+		for _, it := range items {
+			sum += it.ratio * it.weight
+			weights += it.weight
+		}
+	}
+	if weights == 0 {
+		return nil, ""
+	}
+
+	p := math.Round(sum/weights*10000) / 100
+	return &p, LetterFor(policy.LetterGrades, p)
+}
+
+// LetterFor 按从高到低排列的分数线给出等级，低于所有分数线时返回空
+func LetterFor(boundaries []models.LetterBoundary, percent float64) string {
+	for _, b := range boundaries {
+		if percent >= b.MinPercent {
+			return b.Letter
+		}
+	}
+	return ""
+}
+
+// LoadPolicy 加载课程总评规则，未设置时返回默认规则
+func LoadPolicy(tx *gorm.DB, courseID int) (*models.CourseGradePolicy, error) {
+	var policy models.CourseGradePolicy
+	err := tx.First(&policy, courseID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		policy = DefaultPolicy(courseID)
+		return &policy, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// RecomputeCourseGrades 重新计算课程总评，未指定学生时计算全部选课学生
+func RecomputeCourseGrades(tx *gorm.DB, courseID int, studentIDs ...int) error {
+	policy, err := LoadPolicy(tx, courseID)
+	if err != nil {
+		return err
+	}
+	var assessments []models.CourseAssessment
+	if err := tx.Where("course_id = ?", courseID).Find(&assessments).Error; err != nil {
+		return err
+	}
+
+	if len(studentIDs) == 0 {
+		if err := tx.Model(&models.Enrollment{}).Where("course_id = ?", courseID).
+			Pluck("student_id", &studentIDs).Error; err != nil {
+			return err
+		}
+		if len(studentIDs) == 0 {
+			return nil
+		}
+	}
+
+	var grades []models.StudentGrade
+	if err := tx.Joins("JOIN course_assessments ON course_assessments.assessment_id = student_grades.assessment_id").
+		Where("course_assessments.course_id = ? AND student_grades.student_id IN ?", courseID, studentIDs).
+		Find(&grades).Error; err != nil {
+		return err
+	}
+	scores := make(map[int]map[int]float64, len(studentIDs))
+	for _, g := range grades {
+		if scores[g.StudentID] == nil {
+			scores[g.StudentID] = make(map[int]float64)
+		}
+		scores[g.StudentID][g.AssessmentID] = g.Score
+	}
+
+	now := time.Now()
+	rows := make([]models.CourseGrade, 0, len(studentIDs))
+	for _, id := range studentIDs {
+		percent, letter := ComputeCourseGrade(policy, assessments, scores[id], now)
+		rows = append(rows, models.CourseGrade{CourseID: courseID, StudentID: id, Percent: percent, Letter: letter, UpdatedAt: now})
+	}
+	return tx.Clauses(clause.OnConflict{
+		UpdateAll: true,
+	}).CreateInBatches(&rows, 200).Error
+}
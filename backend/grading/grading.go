@@ -0,0 +1,259 @@
+package grading
+
+import (
+	"context"
+	"log"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// 截止时间后仍接受保存答案的宽限，抵消网络延迟
+	DeadlineGrace = 5 * time.Second
+
+	autoSubmitInterval = 30 * time.Second
+	batchSize          = 100
+
+	StatusInProgress = "in_progress"
+	StatusSubmitted  = "submitted"
+
+	PolicyHighest = "highest"
+	PolicyLatest  = "latest"
+	PolicyAverage = "average"
+)
+
+// Expired 判断作答是否已超过截止时间（含宽限）
+func Expired(a *models.AssessmentAttempt, now time.Time) bool {
+	return a.Deadline != nil && now.After(a.Deadline.Add(DeadlineGrace))
+}
+
+// Run 周期性提交已超过截止时间的作答，学生访问作答时也会即时提交
+func Run(ctx context.Context, db *gorm.DB) {
+	ticker := time.NewTicker(autoSubmitInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			n, err := autoSubmit(db)
+			if err != nil {
+				log.Println("attempt auto submit:", err)
+				break
+			}
+			if n < batchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func autoSubmit(db *gorm.DB) (int, error) {
+	var ids []int
+	if err := db.Model(&models.AssessmentAttempt{}).
+		Where("status = ? AND deadline < ?", StatusInProgress, time.Now().Add(-DeadlineGrace)).
+		Limit(batchSize).Pluck("attempt_id", &ids).Error; err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		if _, err := Submit(db, id, true); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), nil
+}
+
+// Submit 提交作答并评分，已提交的作答原样返回。auto 表示由系统在截止时间后提交
+func Submit(db *gorm.DB, attemptID int, auto bool) (*models.AssessmentAttempt, error) {
+	var attempt models.AssessmentAttempt
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// 锁定作答，避免学生提交与自动提交同时评分
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&attempt, attemptID).Error; err != nil {
+			return err
+		}
+		if attempt.Status == StatusSubmitted {
+			return nil
+		}
+
+		var assessment models.CourseAssessment
+		if err := tx.First(&assessment, attempt.AssessmentID).Error; err != nil {
+			return err
+		}
+		score, err := scoreAttempt(tx, &assessment, &attempt)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if err := tx.Model(&attempt).Updates(map[string]interface{}{
+			"status":         StatusSubmitted,
+			"submitted_at":   now,
+			"auto_submitted": auto,
+			"score":          score,
+		}).Error; err != nil {
+			return err
+		}
+		attempt.Status, attempt.SubmittedAt, attempt.AutoSubmitted, attempt.Score = StatusSubmitted, &now, auto, &score
+
+		return RecomputeGrade(tx, &assessment, attempt.StudentID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &attempt, nil
+}
+
+// scoreAttempt 只按本次作答保存的答案计算得分并记录每道题的评分结果，得分为各题得分之和占总分值的比例，
+// 未作答的题目记为错误，简答题在教师评分前不计分
+func scoreAttempt(tx *gorm.DB, assessment *models.CourseAssessment, attempt *models.AssessmentAttempt) (float64, error) {
+	questions, err := PaperQuestions(tx, attempt)
+	if err != nil {
+		return 0, err
+	}
+	if len(questions) == 0 {
+		return 0, nil
+	}
+
+	var answers []models.StudentAnswer
+	if err := tx.Preload("Selections").Where("attempt_id = ?", attempt.AttemptID).Find(&answers).Error; err != nil {
+		return 0, err
+	}
+	byQuestion := make(map[int]*models.StudentAnswer, len(answers))
+	for i := range answers {
+		byQuestion[answers[i].QuestionID] = &answers[i]
+	}
+
+	var earned, total float64
+	for i := range questions {
+		points := QuestionPoints(&questions[i])
+		total += points
+
+		answer := byQuestion[questions[i].QuestionID]
+		if answer != nil && answer.GradedBy != nil && answer.Score != nil {
+			// 教师已评分的题目以教师给分为准
+			earned += min(*answer.Score, points)
+			continue
+		}
+		credit, correct, graded := answerCredit(&questions[i], answer)
+		earned += credit * points
+		if answer != nil && graded {
+			if err := tx.Model(answer).Update("is_correct", correct).Error; err != nil {
+				return 0, err
+			}
+		}
+	}
+	return earned / total * assessment.MaxScore, nil
+}
+
+// QuestionPoints 返回一道题的分值，未设置分值的题目按 1 分计
+func QuestionPoints(q *models.Question) float64 {
+	if q.Points <= 0 {
+		return 1
+	}
+	return q.Points
+}
+
+// rescoreAttempt 教师评分后重新计算已提交作答的得分和学生成绩
+func rescoreAttempt(tx *gorm.DB, attempt *models.AssessmentAttempt) error {
+	var assessment models.CourseAssessment
+	if err := tx.First(&assessment, attempt.AssessmentID).Error; err != nil {
+		return err
+	}
+	score, err := scoreAttempt(tx, &assessment, attempt)
+	if err != nil {
+		return err
+	}
+	if err := tx.Model(attempt).Update("score", score).Error; err != nil {
+		return err
+	}
+	attempt.Score = &score
+	return RecomputeGrade(tx, &assessment, attempt.StudentID)
+}
+
+// RecomputeGrade 按评分项的计分方式汇总学生已提交的作答，写入或更新成绩并重新计算课程总评，教师改分后的成绩保持不变
+func RecomputeGrade(tx *gorm.DB, assessment *models.CourseAssessment, studentID int) error {
+	var overridden int64
+	if err := tx.Model(&models.StudentGrade{}).
+		Where("assessment_id = ? AND student_id = ? AND overridden = ?", assessment.AssessmentID, studentID, true).
+		Count(&overridden).Error; err != nil {
+		return err
+	}
+	if overridden > 0 {
+		return nil
+	}
+
+	var scores []float64
+	if err := tx.Model(&models.AssessmentAttempt{}).
+		Where("assessment_id = ? AND student_id = ? AND status = ? AND score IS NOT NULL",
+			assessment.AssessmentID, studentID, StatusSubmitted).
+		Order("attempt_no").Pluck("score", &scores).Error; err != nil {
+		return err
+	}
+	if len(scores) == 0 {
+		return nil
+	}
+
+	var grade models.StudentGrade
+	if err := tx.Where(models.StudentGrade{StudentID: studentID, AssessmentID: assessment.AssessmentID}).
+		Assign(map[string]interface{}{
+			"score":      FinalScore(assessment.ScoringPolicy, scores),
+			"graded_by":  nil,
+			"updated_at": time.Now(),
+		}).
+		FirstOrCreate(&grade).Error; err != nil {
+		return err
+	}
+	return RecomputeCourseGrades(tx, assessment.CourseID, studentID)
+}
+
+// FinalScore 按计分方式汇总各次作答的得分，scores 按作答顺序排列且不能为空
+func FinalScore(policy string, scores []float64) float64 {
+	switch policy {
+	case PolicyLatest:
+		return scores[len(scores)-1]
+	case PolicyAverage:
+		var sum float64
+		for _, s := range scores {
+			sum += s
+		}
+		return math.Round(sum/float64(len(scores))*100) / 100
+	default:
+		return slices.Max(scores)
+	}
+}
+
+// 判断答案正确性
+func isAnswerCorrect(questionType string, selected, correct []int) bool {
+	selectedSet := make(map[int]bool)
+	for _, s := range selected {
+		selectedSet[s] = true
+	}
+
+	correctSet := make(map[int]bool)
+	for _, c := range correct {
+		correctSet[c] = true
+	}
+
+	if questionType == TypeSingle || questionType == TypeTrueFalse {
+		return len(selected) == 1 && len(correct) == 1 && selected[0] == correct[0]
+	}
+
+	// 多选题必须完全匹配
+	if len(selectedSet) != len(correctSet) {
+		return false
+	}
+	for k := range correctSet {
+		if !selectedSet[k] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,257 @@
+package grading
+
+import (
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+)
+
+func TestIsAnswerCorrect(t *testing.T) {
+	cases := []struct {
+		qType             string
+		selected, correct []int
+		want              bool
+	}{
+		{"single", []int{1}, []int{1}, true},
+		{"single", []int{2}, []int{1}, false},
+		{"single", []int{1, 2}, []int{1}, false},
+		{"single", nil, []int{1}, false},
+		{"multiple", []int{2, 1}, []int{1, 2}, true},
+		{"multiple", []int{1}, []int{1, 2}, false},
+		{"multiple", []int{1, 2, 3}, []int{1, 2}, false},
+	}
+	for _, c := range cases {
+		if got := isAnswerCorrect(c.qType, c.selected, c.correct); got != c.want {
+			t.Errorf("%s %v vs %v: got %v", c.qType, c.selected, c.correct, got)
+		}
+	}
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Now()
+	deadline := now.Add(-time.Second)
+	if Expired(&models.AssessmentAttempt{}, now) {
+		t.Error("attempt without deadline never expires")
+	}
+	if Expired(&models.AssessmentAttempt{Deadline: &deadline}, now) {
+		t.Error("attempt within grace should not expire")
+	}
+	if !Expired(&models.AssessmentAttempt{Deadline: &deadline}, now.Add(DeadlineGrace)) {
+		t.Error("attempt past grace should expire")
+	}
+}
+
+func TestFinalScore(t *testing.T) {
+	scores := []float64{60, 90, 70}
+	for policy, want := range map[string]float64{
+		PolicyHighest: 90,
+		PolicyLatest:  70,
+		PolicyAverage: 73.33,
+		"":            90,
+	} {
+		if got := FinalScore(policy, scores); got != want {
+			t.Errorf("%q: got %v, want %v", policy, got, want)
+		}
+	}
+}
+
+func TestRevealAssessment(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	once := &models.CourseAssessment{RevealPolicy: RevealAfterSubmission, MaxAttempts: 1}
+	retake := &models.CourseAssessment{RevealPolicy: RevealAfterSubmission, MaxAttempts: 3, AssessmentDate: now.Add(24 * time.Hour)}
+	unlimited := &models.CourseAssessment{RevealPolicy: RevealAfterSubmission, MaxAttempts: 0}
+	pastDue := &models.CourseAssessment{RevealPolicy: RevealAfterSubmission, MaxAttempts: 3, AssessmentDate: now.Add(-time.Hour)}
+	due := &models.CourseAssessment{RevealPolicy: RevealAfterDue, MaxAttempts: 3, AssessmentDate: now.Add(-time.Hour)}
+	notDue := &models.CourseAssessment{RevealPolicy: RevealAfterDue, MaxAttempts: 3, AssessmentDate: now.Add(time.Hour)}
+
+	attempt := func(no int, status string) models.AssessmentAttempt {
+		return models.AssessmentAttempt{AttemptNo: no, Status: status}
+	}
+	for name, c := range map[string]struct {
+		assessment *models.CourseAssessment
+		attempts   []models.AssessmentAttempt
+		want       bool
+	}{
+		"no attempts":        {once, nil, false},
+		"in progress":        {once, []models.AssessmentAttempt{attempt(1, StatusInProgress)}, false},
+		"single submitted":   {once, []models.AssessmentAttempt{attempt(1, StatusSubmitted)}, true},
+		"retake in progress": {retake, []models.AssessmentAttempt{attempt(1, StatusSubmitted), attempt(2, StatusInProgress)}, false},
+		"retakes remain":     {retake, []models.AssessmentAttempt{attempt(1, StatusSubmitted)}, false},
+		"attempts used up":   {retake, []models.AssessmentAttempt{attempt(1, StatusSubmitted), attempt(2, StatusSubmitted), attempt(3, StatusSubmitted)}, true},
+		"unlimited":          {unlimited, []models.AssessmentAttempt{attempt(5, StatusSubmitted)}, false},
+		"retakes past due":   {pastDue, []models.AssessmentAttempt{attempt(1, StatusSubmitted)}, true},
+		"due, no attempts":   {due, nil, true},
+		"due, in progress":   {due, []models.AssessmentAttempt{attempt(1, StatusInProgress)}, false},
+		"not yet due":        {notDue, []models.AssessmentAttempt{attempt(1, StatusSubmitted)}, false},
+	} {
+		if got := revealAssessment(c.assessment, c.attempts, now); got != c.want {
+			t.Errorf("%s: got %v", name, got)
+		}
+	}
+}
+
+// 截止日期公布答案时，学生必须已不能开始新的作答
+func TestRevealedByDateClosesAttempts(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	submitted := []models.AssessmentAttempt{{AttemptNo: 1, Status: StatusSubmitted}}
+	for _, policy := range []string{RevealAfterSubmission, RevealAfterDue} {
+		for _, date := range []time.Time{{}, now.Add(-time.Hour), now.Add(time.Hour)} {
+			a := &models.CourseAssessment{RevealPolicy: policy, MaxAttempts: 0, AssessmentDate: date}
+			if revealAssessment(a, submitted, now) && !PastDue(a, now) {
+				t.Errorf("%s due %v: answers revealed while new attempts are allowed", policy, date)
+			}
+		}
+	}
+	if PastDue(&models.CourseAssessment{}, now) {
+		t.Error("assessment without a date should never be past due")
+	}
+}
+
+func TestMatchBlank(t *testing.T) {
+	for _, c := range []struct {
+		rule   models.BlankRule
+		answer string
+		want   bool
+	}{
+		{models.BlankRule{Accepted: []string{"iptables"}}, "  IPTables ", true},
+		{models.BlankRule{Accepted: []string{"iptables"}, CaseSensitive: true}, "IPTables", false},
+		{models.BlankRule{Accepted: []string{"systemctl start nginx"}, Whitespace: WhitespaceCollapse}, "systemctl  start\tnginx", true},
+		{models.BlankRule{Accepted: []string{"systemctl start nginx"}}, "systemctl  start nginx", false},
+		{models.BlankRule{Accepted: []string{"a,b"}, Whitespace: WhitespaceIgnore}, "a, b", true},
+		{models.BlankRule{Accepted: []string{`re:port\s*(80|8080)`}}, "Port 8080", true},
+		{models.BlankRule{Accepted: []string{`re:80`}}, "8080", false},
+	} {
+		if got := MatchBlank(c.rule, c.answer); got != c.want {
+			t.Errorf("%+v %q: got %v", c.rule, c.answer, got)
+		}
+	}
+
+	if ValidateBlanks([]models.BlankRule{{Accepted: []string{"re:("}}}) == nil {
+		t.Error("invalid regexp should be rejected")
+	}
+}
+
+func TestGradeNumeric(t *testing.T) {
+	want, tolerance := 3.14, 0.01
+	q := &models.Question{QuestionType: TypeNumeric, NumericAnswer: &want, Tolerance: tolerance}
+	for v, ok := range map[float64]bool{3.14: true, 3.149: true, 3.2: false} {
+		if got, graded := gradeAnswer(q, &models.StudentAnswer{NumericAnswer: &v}); got != ok || !graded {
+			t.Errorf("%v: got %v graded %v", v, got, graded)
+		}
+	}
+	if _, graded := gradeAnswer(&models.Question{QuestionType: TypeShortAnswer}, &models.StudentAnswer{TextAnswer: "x"}); graded {
+		t.Error("short answer should wait for manual grading")
+	}
+}
+
+func TestMultipleCredit(t *testing.T) {
+	correct := []int{1, 2, 3, 4}
+	cases := []struct {
+		policy   string
+		selected []int
+		want     float64
+	}{
+		{CreditAllOrNothing, []int{1, 2, 3, 4}, 1},
+		{CreditAllOrNothing, []int{1, 2, 3}, 0},
+		{CreditProportional, []int{1, 2, 3}, 0.75},
+		{CreditProportional, []int{1, 2, 5}, 0},
+		{CreditPenalty, []int{1, 2, 3, 5}, 0.5},
+		{CreditPenalty, []int{1, 5, 6}, 0},
+		{CreditPenalty, []int{1, 1}, 0.25},
+	}
+	for _, c := range cases {
+		if got := MultipleCredit(c.policy, c.selected, correct); got != c.want {
+			t.Errorf("%s %v: got %v, want %v", c.policy, c.selected, got, c.want)
+		}
+	}
+}
+
+func TestComputeCourseGrade(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	past := now.Add(-24 * time.Hour)
+	assessments := []models.CourseAssessment{
+		{AssessmentID: 1, AssessmentType: "exam", MaxScore: 100, Weight: 60, AssessmentDate: past},
+		{AssessmentID: 2, AssessmentType: "quiz", MaxScore: 10, Weight: 20, AssessmentDate: past},
+		{AssessmentID: 3, AssessmentType: "quiz", MaxScore: 10, Weight: 20, AssessmentDate: past},
+	}
+	scores := map[int]float64{1: 80, 2: 5}
+
+	policy := DefaultPolicy(1)
+	if p, letter := ComputeCourseGrade(&policy, assessments, scores, now); p == nil || *p != 58 || letter != "F" {
+		t.Errorf("missing as zero: got %v %q", p, letter)
+	}
+
+	// 未到截止日期的评分项不按缺考计 0 分
+	assessments[2].AssessmentDate = now.Add(24 * time.Hour)
+	if p, letter := ComputeCourseGrade(&policy, assessments, scores, now); p == nil || *p != 72.5 || letter != "C" {
+		t.Errorf("not yet due: got %v %q", p, letter)
+	}
+	assessments[2].AssessmentDate = past
+
+	policy.MissingPolicy = MissingExclude
+	if p, letter := ComputeCourseGrade(&policy, assessments, scores, now); p == nil || *p != 72.5 || letter != "C" {
+		t.Errorf("missing excluded: got %v %q", p, letter)
+	}
+
+	policy.MissingPolicy = MissingZero
+	policy.DropLowest = map[string]int{"quiz": 5}
+	if p, letter := ComputeCourseGrade(&policy, assessments, scores, now); p == nil || *p != 72.5 || letter != "C" {
+		t.Errorf("drop lowest: got %v %q", p, letter)
+	}
+
+	if p, _ := ComputeCourseGrade(&policy, nil, scores, now); p != nil {
+		t.Errorf("no assessments: got %v", *p)
+	}
+}
+
+func TestBuildPaper(t *testing.T) {
+	questions := []models.Question{
+		{QuestionID: 1, QuestionType: TypeSingle, Options: []models.QuestionOption{{OptionID: 11, SortOrder: 1}, {OptionID: 10, SortOrder: 0}, {OptionID: 12, SortOrder: 2}}},
+		{QuestionID: 2, QuestionType: TypeTrueFalse, Options: []models.QuestionOption{{OptionID: 20, SortOrder: 0}, {OptionID: 21, SortOrder: 1}}},
+		{QuestionID: 3, QuestionType: TypeShortAnswer},
+	}
+
+	paper := buildPaper(questions, false, false, rand.New(rand.NewPCG(1, 2)))
+	if len(paper) != 3 || paper[0].QuestionID != 1 || !slices.Equal(paper[0].OptionIDs, []int{10, 11, 12}) || paper[2].OptionIDs != nil {
+		t.Fatalf("unshuffled paper: %+v", paper)
+	}
+
+	for seed := uint64(0); seed < 20; seed++ {
+		paper := buildPaper(questions, true, true, rand.New(rand.NewPCG(seed, seed)))
+		ids := make([]int, len(paper))
+		for i, d := range paper {
+			ids[i] = d.QuestionID
+			if d.QuestionID == 2 && !slices.Equal(d.OptionIDs, []int{20, 21}) {
+				t.Errorf("true/false options must keep their order: %v", d.OptionIDs)
+			}
+		}
+		slices.Sort(ids)
+		if !slices.Equal(ids, []int{1, 2, 3}) {
+			t.Errorf("shuffled paper lost questions: %v", ids)
+		}
+	}
+}
+
+func TestSample(t *testing.T) {
+	candidates := []models.Question{{QuestionID: 1}, {QuestionID: 2}, {QuestionID: 3}, {QuestionID: 4}}
+	picked, err := sample(candidates, 2, rand.New(rand.NewPCG(3, 4)))
+	if err != nil || len(picked) != 2 || picked[0].QuestionID >= picked[1].QuestionID {
+		t.Errorf("sample: %v %v", picked, err)
+	}
+	if _, err := sample(candidates, 5, rand.New(rand.NewPCG(3, 4))); !errors.Is(err, ErrPoolTooSmall) {
+		t.Errorf("expected ErrPoolTooSmall, got %v", err)
+	}
+}
+
+func TestImportGradesRejectsDuplicates(t *testing.T) {
+	assessment := &models.CourseAssessment{MaxScore: 100}
+	entries := []GradeEntry{{StudentID: 1, Score: 80}, {StudentID: 2, Score: 90}, {StudentID: 1, Score: 70}}
+	// 校验在开启事务前完成，不需要数据库
+	if err := ImportGrades(nil, assessment, 1, entries, ""); !errors.Is(err, ErrDuplicateEntry) {
+		t.Errorf("got %v, want ErrDuplicateEntry", err)
+	}
+}
@@ -0,0 +1,215 @@
+package grading
+
+import (
+	"errors"
+	"time"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrNotSubmitted   = errors.New("attempt not submitted")
+	ErrInvalidScore   = errors.New("invalid score")
+	ErrDuplicateEntry = errors.New("duplicate student in grade entries")
+)
+
+// GradeAnswer 教师为已提交作答中的一道题评分，给分覆盖自动评分结果，随后重新计算作答得分和成绩
+func GradeAnswer(db *gorm.DB, answerID, graderID int, score float64, comment string) (*models.StudentAnswer, error) {
+	var answer models.StudentAnswer
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Preload("Question").First(&answer, answerID).Error; err != nil {
+			return err
+		}
+		if answer.AttemptID == nil {
+			return ErrNotSubmitted
+		}
+
+		// 与提交使用同一把锁，避免评分与提交交错
+		var attempt models.AssessmentAttempt
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&attempt, *answer.AttemptID).Error; err != nil {
+			return err
+		}
+		if attempt.Status != StatusSubmitted {
+			return ErrNotSubmitted
+		}
+
+		points := QuestionPoints(&answer.Question)
+		if score < 0 || score > points {
+			return ErrInvalidScore
+		}
+
+		now := time.Now()
+		correct := score == points
+		answer.Score, answer.Comment, answer.GradedBy, answer.GradedAt, answer.IsCorrect = &score, comment, &graderID, &now, &correct
+		if err := tx.Model(&answer).
+			Select("score", "comment", "graded_by", "graded_at", "is_correct").
+			Updates(&answer).Error; err != nil {
+			return err
+		}
+		return rescoreAttempt(tx, &attempt)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &answer, nil
+}
+
+// OverrideGrade 教师直接设置学生在评分项上的成绩并记录修改前的分数，之后的作答不再改变该成绩
+func OverrideGrade(db *gorm.DB, assessment *models.CourseAssessment, studentID, graderID int, score float64, reason, comment string) (*models.StudentGrade, error) {
+	if score < 0 || score > assessment.MaxScore {
+		return nil, ErrInvalidScore
+	}
+
+	var grade models.StudentGrade
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var previous *float64
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("assessment_id = ? AND student_id = ?", assessment.AssessmentID, studentID).
+			First(&grade).Error
+		switch {
+		case err == nil:
+			prev := grade.Score
+			previous = &prev
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			grade = models.StudentGrade{StudentID: studentID, AssessmentID: assessment.AssessmentID}
+		default:
+			return err
+		}
+
+		grade.Score, grade.GradedBy, grade.GradeComment, grade.Overridden, grade.UpdatedAt = score, &graderID, comment, true, time.Now()
+		if grade.GradeID == 0 {
+			if err := tx.Create(&grade).Error; err != nil {
+				return err
+			}
+		} else if err := tx.Model(&grade).
+			Select("score", "graded_by", "grade_comment", "overridden", "updated_at").
+			Updates(&grade).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Create(&models.GradeOverride{
+			AssessmentID:  assessment.AssessmentID,
+			StudentID:     studentID,
+			PreviousScore: previous,
+			NewScore:      &score,
+			Reason:        reason,
+			GradedBy:      graderID,
+		}).Error; err != nil {
+			return err
+		}
+		return RecomputeCourseGrades(tx, assessment.CourseID, studentID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &grade, nil
+}
+
+// ClearOverride 撤销教师改分，成绩恢复为按作答自动计算，没有已提交作答时删除成绩
+func ClearOverride(db *gorm.DB, assessment *models.CourseAssessment, studentID, graderID int, reason string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var grade models.StudentGrade
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("assessment_id = ? AND student_id = ? AND overridden = ?", assessment.AssessmentID, studentID, true).
+			First(&grade).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&grade).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&models.GradeOverride{
+			AssessmentID:  assessment.AssessmentID,
+			StudentID:     studentID,
+			PreviousScore: &grade.Score,
+			Reason:        reason,
+			GradedBy:      graderID,
+		}).Error; err != nil {
+			return err
+		}
+		if err := RecomputeGrade(tx, assessment, studentID); err != nil {
+			return err
+		}
+		// 没有已提交作答时 RecomputeGrade 不会更新总评
+		return RecomputeCourseGrades(tx, assessment.CourseID, studentID)
+	})
+}
+
+// GradeEntry 一条导入的成绩
+type GradeEntry struct {
+	StudentID int
+	Score     float64
+	Comment   string
+}
+
+// ImportGrades 在一个事务中写入导入的成绩，成绩按教师改分处理并记录修改前的分数，最后重新计算课程总评。
+// 同一学生出现多次时返回 ErrDuplicateEntry，不写入任何成绩
+func ImportGrades(db *gorm.DB, assessment *models.CourseAssessment, graderID int, entries []GradeEntry, reason string) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	seen := make(map[int]bool, len(entries))
+	for _, e := range entries {
+		if e.Score < 0 || e.Score > assessment.MaxScore {
+			return ErrInvalidScore
+		}
+		if seen[e.StudentID] {
+			return ErrDuplicateEntry
+		}
+		seen[e.StudentID] = true
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		studentIDs := make([]int, len(entries))
+		for i, e := range entries {
+			studentIDs[i] = e.StudentID
+		}
+		var existing []models.StudentGrade
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("assessment_id = ? AND student_id IN ?", assessment.AssessmentID, studentIDs).
+			Find(&existing).Error; err != nil {
+			return err
+		}
+		byStudent := make(map[int]*models.StudentGrade, len(existing))
+		for i := range existing {
+			byStudent[existing[i].StudentID] = &existing[i]
+		}
+
+		now := time.Now()
+		overrides := make([]models.GradeOverride, 0, len(entries))
+		for _, e := range entries {
+			score := e.Score
+			override := models.GradeOverride{
+				AssessmentID: assessment.AssessmentID,
+				StudentID:    e.StudentID,
+				NewScore:     &score,
+				Reason:       reason,
+				GradedBy:     graderID,
+			}
+
+			grade, ok := byStudent[e.StudentID]
+			if !ok {
+				grade = &models.StudentGrade{StudentID: e.StudentID, AssessmentID: assessment.AssessmentID}
+			} else {
+				prev := grade.Score
+				override.PreviousScore = &prev
+			}
+			grade.Score, grade.GradedBy, grade.GradeComment, grade.Overridden, grade.UpdatedAt = e.Score, &graderID, e.Comment, true, now
+			if grade.GradeID == 0 {
+				if err := tx.Create(grade).Error; err != nil {
+					return err
+				}
+			} else if err := tx.Model(grade).
+				Select("score", "graded_by", "grade_comment", "overridden", "updated_at").
+				Updates(grade).Error; err != nil {
+				return err
+			}
+			overrides = append(overrides, override)
+		}
+		if err := tx.CreateInBatches(&overrides, 200).Error; err != nil {
+			return err
+		}
+		return RecomputeCourseGrades(tx, assessment.CourseID, studentIDs...)
+	})
+}
@@ -0,0 +1,168 @@
+package grading
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sort"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"gorm.io/gorm"
+)
+
+// ErrPoolTooSmall 题库中带有抽题规则标签的题目不足
+var ErrPoolTooSmall = errors.New("question pool too small")
+
+// DrawQuestions 为新作答确定题目：评分项的固定题目加上按抽题规则从题库抽取的题目，
+// 并按评分项设置打乱题目和选项顺序
+func DrawQuestions(tx *gorm.DB, assessment *models.CourseAssessment) ([]models.DrawnQuestion, error) {
+	r := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+
+	var questions []models.Question
+	if err := tx.Preload("Options").
+		Where("assessment_id = ?", assessment.AssessmentID).
+		Order("question_id").Find(&questions).Error; err != nil {
+		return nil, err
+	}
+	chosen := make(map[int]bool, len(questions))
+	for _, q := range questions {
+		chosen[q.QuestionID] = true
+	}
+
+	var pools []models.AssessmentPool
+	if err := tx.Where("assessment_id = ?", assessment.AssessmentID).Order("pool_id").Find(&pools).Error; err != nil {
+		return nil, err
+	}
+	for _, pool := range pools {
+		var candidates []models.Question
+		if err := bankQuestions(tx, assessment.CourseID, pool.Tag).Preload("Options").Find(&candidates).Error; err != nil {
+			return nil, err
+		}
+		// 多个规则的标签可能重叠，同一道题只抽一次
+		candidates = slices.DeleteFunc(candidates, func(q models.Question) bool { return chosen[q.QuestionID] })
+		picked, err := sample(candidates, pool.Count, r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", err, pool.Tag)
+		}
+		for _, q := range picked {
+			chosen[q.QuestionID] = true
+		}
+		questions = append(questions, picked...)
+	}
+
+	return buildPaper(questions, assessment.ShuffleQuestions, assessment.ShuffleOptions, r), nil
+}
+
+// PoolSize 返回课程题库中带有该标签的题目数
+func PoolSize(tx *gorm.DB, courseID int, tag string) (int64, error) {
+	var count int64
+	err := bankQuestions(tx, courseID, tag).Model(&models.Question{}).Count(&count).Error
+	return count, err
+}
+
+func bankQuestions(tx *gorm.DB, courseID int, tag string) *gorm.DB {
+	return tx.Joins("JOIN question_tags ON question_tags.question_id = questions.question_id").
+		Where("questions.course_id = ? AND questions.assessment_id = 0 AND question_tags.tag = ?", courseID, tag).
+		Order("questions.question_id")
+}
+
+// sample 从候选题目中随机抽取 n 道，保持候选中的相对顺序
+func sample(candidates []models.Question, n int, r *rand.Rand) ([]models.Question, error) {
+	if n > len(candidates) {
+		return nil, ErrPoolTooSmall
+	}
+	indexes := r.Perm(len(candidates))[:n]
+	sort.Ints(indexes)
+	picked := make([]models.Question, n)
+	for i, idx := range indexes {
+		picked[i] = candidates[idx]
+	}
+	return picked, nil
+}
+
+// buildPaper 生成作答的题目和选项顺序，选项默认按 SortOrder 排列，判断题不打乱选项
+func buildPaper(questions []models.Question, shuffleQuestions, shuffleOptions bool, r *rand.Rand) []models.DrawnQuestion {
+	paper := make([]models.DrawnQuestion, len(questions))
+	for i, q := range questions {
+		options := slices.Clone(q.Options)
+		sort.SliceStable(options, func(a, b int) bool {
+			if options[a].SortOrder != options[b].SortOrder {
+				return options[a].SortOrder < options[b].SortOrder
+			}
+			return options[a].OptionID < options[b].OptionID
+		})
+		if shuffleOptions && q.QuestionType != TypeTrueFalse {
+			r.Shuffle(len(options), func(a, b int) { options[a], options[b] = options[b], options[a] })
+		}
+
+		paper[i].QuestionID = q.QuestionID
+		for _, opt := range options {
+			paper[i].OptionIDs = append(paper[i].OptionIDs, opt.OptionID)
+		}
+	}
+	if shuffleQuestions {
+		r.Shuffle(len(paper), func(a, b int) { paper[a], paper[b] = paper[b], paper[a] })
+	}
+	return paper
+}
+
+// PaperQuestions 按作答确定的顺序加载题目和选项，引入抽题前的作答返回评分项的全部题目
+func PaperQuestions(tx *gorm.DB, attempt *models.AssessmentAttempt) ([]models.Question, error) {
+	var questions []models.Question
+	if len(attempt.DrawnQuestions) == 0 {
+		err := tx.Preload("Options").
+			Where("assessment_id = ?", attempt.AssessmentID).
+			Order("question_id ASC").
+			Find(&questions).Error
+		return questions, err
+	}
+
+	ids := make([]int, len(attempt.DrawnQuestions))
+	for i, d := range attempt.DrawnQuestions {
+		ids[i] = d.QuestionID
+	}
+	if err := tx.Preload("Options").Where("question_id IN ?", ids).Find(&questions).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[int]models.Question, len(questions))
+	for _, q := range questions {
+		byID[q.QuestionID] = q
+	}
+
+	ordered := make([]models.Question, 0, len(questions))
+	for _, d := range attempt.DrawnQuestions {
+		q, ok := byID[d.QuestionID]
+		if !ok {
+			continue
+		}
+		position := make(map[int]int, len(d.OptionIDs))
+		for i, id := range d.OptionIDs {
+			position[id] = i
+		}
+		sort.SliceStable(q.Options, func(a, b int) bool {
+			pa, oka := position[q.Options[a].OptionID]
+			pb, okb := position[q.Options[b].OptionID]
+			if oka != okb {
+				return oka
+			}
+			return pa < pb
+		})
+		ordered = append(ordered, q)
+	}
+	return ordered, nil
+}
+
+// InPaper 判断题目是否属于该作答
+func InPaper(tx *gorm.DB, attempt *models.AssessmentAttempt, questionID int) (bool, error) {
+	if len(attempt.DrawnQuestions) > 0 {
+		return slices.ContainsFunc(attempt.DrawnQuestions, func(d models.DrawnQuestion) bool {
+			return d.QuestionID == questionID
+		}), nil
+	}
+	var count int64
+	err := tx.Model(&models.Question{}).
+		Where("question_id = ? AND assessment_id = ?", questionID, attempt.AssessmentID).
+		Count(&count).Error
+	return count > 0, err
+}
@@ -0,0 +1,228 @@
+package grading
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+)
+
+// 题目类型
+const (
+	TypeSingle      = "single"
+	TypeMultiple    = "multiple"
+	TypeTrueFalse   = "true_false"
+	TypeFillBlank   = "fill_blank"
+	TypeNumeric     = "numeric"
+	TypeShortAnswer = "short_answer"
+)
+
+// 填空题空白处理方式
+const (
+	WhitespaceTrim     = "trim"
+	WhitespaceCollapse = "collapse"
+	WhitespaceIgnore   = "ignore"
+)
+
+// 多选题部分得分规则
+const (
+	CreditAllOrNothing = "all_or_nothing"
+	CreditProportional = "proportional"
+	CreditPenalty      = "penalty"
+)
+
+// 以此前缀开头的可接受答案按正则表达式匹配
+const regexPrefix = "re:"
+
+// UsesOptions 判断题目是否以选项作答
+func UsesOptions(questionType string) bool {
+	switch questionType {
+	case TypeSingle, TypeMultiple, TypeTrueFalse:
+		return true
+	}
+	return false
+}
+
+// ValidateBlanks 校验填空题的评分规则，正则表达式必须能够编译
+func ValidateBlanks(blanks []models.BlankRule) error {
+	if len(blanks) == 0 || len(blanks) > 10 {
+		return errors.New("填空题需要 1 到 10 个空")
+	}
+	for i, b := range blanks {
+		if len(b.Accepted) == 0 || len(b.Accepted) > 20 {
+			return fmt.Errorf("第 %d 个空需要 1 到 20 个可接受答案", i+1)
+		}
+		switch b.Whitespace {
+		case "", WhitespaceTrim, WhitespaceCollapse, WhitespaceIgnore:
+		default:
+			return fmt.Errorf("第 %d 个空的空白处理方式无效: %s", i+1, b.Whitespace)
+		}
+		for _, a := range b.Accepted {
+			if len(a) > 500 {
+				return fmt.Errorf("第 %d 个空的可接受答案过长", i+1)
+			}
+			if _, err := blankPattern(b, a); err != nil {
+				return fmt.Errorf("第 %d 个空的正则表达式无效: %s", i+1, a)
+			}
+		}
+	}
+	return nil
+}
+
+// gradeAnswer 自动评分一道题，简答题返回 graded 为 false 等待教师评分
+func gradeAnswer(q *models.Question, answer *models.StudentAnswer) (correct, graded bool) {
+	if q.QuestionType == TypeShortAnswer {
+		return false, false
+	}
+	if answer == nil {
+		return false, true
+	}
+
+	switch q.QuestionType {
+	case TypeFillBlank:
+		return blanksCorrect(q.Blanks, answer.BlankAnswers), true
+	case TypeNumeric:
+		return q.NumericAnswer != nil && answer.NumericAnswer != nil &&
+			math.Abs(*answer.NumericAnswer-*q.NumericAnswer) <= q.Tolerance, true
+	}
+
+	return isAnswerCorrect(q.QuestionType, selectedOptions(answer), correctOptions(q)), true
+}
+
+// answerCredit 返回一道题的得分比例，多选题未全对时按部分得分规则计算
+func answerCredit(q *models.Question, answer *models.StudentAnswer) (credit float64, correct, graded bool) {
+	correct, graded = gradeAnswer(q, answer)
+	switch {
+	case correct:
+		return 1, true, graded
+	case graded && answer != nil && q.QuestionType == TypeMultiple:
+		return MultipleCredit(q.PartialCredit, selectedOptions(answer), correctOptions(q)), false, true
+	}
+	return 0, false, graded
+}
+
+// MultipleCredit 按部分得分规则计算多选题的得分比例：
+// proportional 按选对的正确选项比例得分，选了错误选项不得分；
+// penalty 每个错误选项抵消一个正确选项，最低为 0
+func MultipleCredit(policy string, selected, correct []int) float64 {
+	if len(correct) == 0 {
+		return 0
+	}
+	correctSet := make(map[int]bool, len(correct))
+	for _, id := range correct {
+		correctSet[id] = true
+	}
+	seen := make(map[int]bool, len(selected))
+	hits, wrongs := 0, 0
+	for _, id := range selected {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if correctSet[id] {
+			hits++
+		} else {
+			wrongs++
+		}
+	}
+
+	switch policy {
+	case CreditProportional:
+		if wrongs > 0 {
+			return 0
+		}
+		return float64(hits) / float64(len(correct))
+	case CreditPenalty:
+		return max(0, float64(hits-wrongs)/float64(len(correct)))
+	default:
+		if wrongs == 0 && hits == len(correct) {
+			return 1
+		}
+		return 0
+	}
+}
+
+func correctOptions(q *models.Question) []int {
+	var ids []int
+	for _, opt := range q.Options {
+		if opt.IsCorrect {
+			ids = append(ids, opt.OptionID)
+		}
+	}
+	return ids
+}
+
+func selectedOptions(answer *models.StudentAnswer) []int {
+	var ids []int
+	for _, sel := range answer.Selections {
+		ids = append(ids, sel.OptionID)
+	}
+	return ids
+}
+
+func blanksCorrect(rules []models.BlankRule, answers []string) bool {
+	if len(rules) == 0 || len(answers) != len(rules) {
+		return false
+	}
+	for i, rule := range rules {
+		if !MatchBlank(rule, answers[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchBlank 按空的规则判断答案是否可接受
+func MatchBlank(rule models.BlankRule, answer string) bool {
+	answer = normalizeBlank(rule, answer)
+	for _, accepted := range rule.Accepted {
+		if strings.HasPrefix(accepted, regexPrefix) {
+			re, err := blankPattern(rule, accepted)
+			if err == nil && re.MatchString(answer) {
+				return true
+			}
+			continue
+		}
+		if normalizeBlank(rule, accepted) == answer {
+			return true
+		}
+	}
+	return false
+}
+
+// blankPattern 编译正则形式的可接受答案，匹配整个答案，不区分大小写时加 (?i)
+func blankPattern(rule models.BlankRule, accepted string) (*regexp.Regexp, error) {
+	expr, ok := strings.CutPrefix(accepted, regexPrefix)
+	if !ok {
+		return nil, nil
+	}
+	expr = "^(?:" + expr + ")$"
+	if !rule.CaseSensitive {
+		expr = "(?i)" + expr
+	}
+	return regexp.Compile(expr)
+}
+
+func normalizeBlank(rule models.BlankRule, s string) string {
+	switch rule.Whitespace {
+	case WhitespaceIgnore:
+		s = strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) {
+				return -1
+			}
+			return r
+		}, s)
+	case WhitespaceCollapse:
+		s = strings.Join(strings.Fields(s), " ")
+	default:
+		s = strings.TrimSpace(s)
+	}
+	if !rule.CaseSensitive {
+		s = strings.ToLower(s)
+	}
+	return s
+}
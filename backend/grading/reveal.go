@@ -0,0 +1,77 @@
+package grading
+
+import (
+	"time"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"gorm.io/gorm"
+)
+
+// 正确答案和解析的公布方式
+const (
+	RevealImmediately     = "immediately"      // 逐题公布，见 RevealsPerQuestion
+	RevealAfterSubmission = "after_submission" // 允许多次作答时在次数用完或截止日期后公布
+	RevealAfterDue        = "after_due"        // 评分项日期视为截止日期
+	RevealNever           = "never"
+)
+
+// RevealsPerQuestion 判断是否逐题公布：立即公布时学生保存某题答案后才能看到该题的正确答案和解析，
+// 此后不能再修改该题答案
+func RevealsPerQuestion(assessment *models.CourseAssessment) bool {
+	return assessment.RevealPolicy == RevealImmediately
+}
+
+// PastDue 判断评分项是否已过截止日期，此后不能再开始新的作答
+func PastDue(assessment *models.CourseAssessment, now time.Time) bool {
+	return !assessment.AssessmentDate.IsZero() && now.After(assessment.AssessmentDate)
+}
+
+// CanReveal 判断能否向学生展示评分项全部题目的正确答案和解析，教师不受限制。
+// 立即公布的评分项返回 false，由调用方按 RevealsPerQuestion 逐题处理
+func CanReveal(db *gorm.DB, assessment *models.CourseAssessment, studentID int, now time.Time) (bool, error) {
+	switch assessment.RevealPolicy {
+	case RevealAfterDue, RevealAfterSubmission:
+	default:
+		return false, nil
+	}
+
+	var attempts []models.AssessmentAttempt
+	if err := db.Select("attempt_no", "status").
+		Where("assessment_id = ? AND student_id = ?", assessment.AssessmentID, studentID).
+		Find(&attempts).Error; err != nil {
+		return false, err
+	}
+	return revealAssessment(assessment, attempts, now), nil
+}
+
+// revealAssessment 有进行中的作答时不公布，截止日期前开始的作答在截止后仍可继续
+func revealAssessment(assessment *models.CourseAssessment, attempts []models.AssessmentAttempt, now time.Time) bool {
+	for _, a := range attempts {
+		if a.Status == StatusInProgress {
+			return false
+		}
+	}
+	if assessment.RevealPolicy == RevealAfterDue {
+		return PastDue(assessment, now)
+	}
+	return revealAfterSubmission(assessment, attempts, now)
+}
+
+// revealAfterSubmission 学生提交过作答后，作答次数已用完或评分项已过截止日期才公布，
+// 截止后不能再开始作答，避免带着答案重新作答
+func revealAfterSubmission(assessment *models.CourseAssessment, attempts []models.AssessmentAttempt, now time.Time) bool {
+	submitted, latest := false, 0
+	for _, a := range attempts {
+		if a.Status == StatusSubmitted {
+			submitted = true
+		}
+		latest = max(latest, a.AttemptNo)
+	}
+	if !submitted {
+		return false
+	}
+	if assessment.MaxAttempts > 0 && latest >= assessment.MaxAttempts {
+		return true
+	}
+	return PastDue(assessment, now)
+}
@@ -0,0 +1,147 @@
+package lease
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/config"
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"github.com/MeteorsLiu/virtuallabs/backend/outbox"
+	"github.com/MeteorsLiu/virtuallabs/backend/queue"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	batchSize = 100
+	// 提醒发出后至少保留的时间，避免调度中断恢复后未提醒就直接回收
+	minNotice = 5 * time.Minute
+
+	WarningMsg = "虚拟机租期即将到期，请及时续期或保存数据"
+	StoppedMsg = "虚拟机租期已到期，已自动停止，续期后可重新启动"
+)
+
+// 占用集群资源、需要检查租期的状态
+var ActiveStatuses = []string{"pending", "creating", "running", "error"}
+
+// Run 周期性检查虚拟机租期：为旧虚拟机补齐租期、发送到期提醒、回收已到期的虚拟机
+func Run(ctx context.Context, db *gorm.DB, c config.LeaseConf) {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := backfill(db); err != nil {
+			log.Println("lease backfill:", err)
+		}
+		if err := warn(db, c.WarnBefore); err != nil {
+			log.Println("lease warn:", err)
+		}
+		for {
+			n, err := expire(ctx, db, min(minNotice, c.WarnBefore))
+			if err != nil {
+				log.Println("lease expire:", err)
+				break
+			}
+			if n < batchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// backfill 为启用租期前创建的虚拟机按实验配置设置租期
+func backfill(db *gorm.DB) error {
+	now := time.Now()
+	return db.Exec(`UPDATE virtual_machines
+		JOIN experiments ON experiments.experiment_id = virtual_machines.experiment_id
+		SET virtual_machines.lease_started_at = ?,
+			virtual_machines.lease_expires_at = DATE_ADD(?, INTERVAL experiments.lease_minutes MINUTE)
+		WHERE virtual_machines.lease_expires_at IS NULL AND virtual_machines.status IN ?`,
+		now, now, ActiveStatuses).Error
+}
+
+// warn 标记即将到期的虚拟机，提醒通过虚拟机列表的状态信息展示给学生
+func warn(db *gorm.DB, before time.Duration) error {
+	now := time.Now()
+	return db.Model(&models.VirtualMachine{}).
+		Where("lease_expires_at <= ? AND lease_warned_at IS NULL AND status IN ?", now.Add(before), ActiveStatuses).
+		Updates(map[string]interface{}{
+			"lease_warned_at": now,
+			"status_msg":      WarningMsg,
+		}).Error
+}
+
+// expire 按实验配置停止或删除已到期且已提醒的虚拟机，指令与状态变更在同一事务中写入发件箱
+func expire(ctx context.Context, db *gorm.DB, notice time.Duration) (int, error) {
+	var vms []models.VirtualMachine
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("lease_expires_at <= ? AND lease_warned_at <= ? AND status IN ?", now, now.Add(-notice), ActiveStatuses).
+			Order("lease_expires_at ASC").
+			Limit(batchSize).
+			Find(&vms).Error; err != nil {
+			return err
+		}
+		if len(vms) == 0 {
+			return nil
+		}
+
+		actions := make(map[int]string)
+		var experiments []models.Experiment
+		ids := make([]int, 0, len(vms))
+		for _, vm := range vms {
+			ids = append(ids, vm.ExperimentID)
+		}
+		if err := tx.Select("experiment_id", "expire_action").Where("experiment_id IN ?", ids).Find(&experiments).Error; err != nil {
+			return err
+		}
+		for _, e := range experiments {
+			actions[e.ExperimentID] = e.ExpireAction
+		}
+
+		for _, vm := range vms {
+			if actions[vm.ExperimentID] == "delete" {
+				if err := tx.Where("vm_id = ?", vm.VMID).Delete(&models.StudentVirtualMachine{}).Error; err != nil {
+					return err
+				}
+				if err := tx.Delete(&models.VirtualMachine{}, vm.VMID).Error; err != nil {
+					return err
+				}
+				if err := outbox.Enqueue(tx, queue.DeleteVMMessage(ctx, vm.VMID, vm.VMName)); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := tx.Model(&models.VirtualMachine{}).Where("vm_id = ?", vm.VMID).Updates(map[string]interface{}{
+				"status":           "stopped",
+				"status_msg":       StoppedMsg,
+				"last_updated":     now,
+				"lease_expires_at": nil,
+				"lease_warned_at":  nil,
+			}).Error; err != nil {
+				return err
+			}
+			if err := outbox.Enqueue(tx, queue.StopVMMessage(ctx, vm.VMID, vm.VMName)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(vms) > 0 {
+		log.Printf("lease: reclaimed %d expired vms", len(vms))
+		outbox.Notify()
+	}
+	return len(vms), nil
+}
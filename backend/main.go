@@ -1,40 +1,88 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"log"
 
 	"github.com/MeteorsLiu/virtuallabs/backend/api"
+	"github.com/MeteorsLiu/virtuallabs/backend/api/agent"
 	"github.com/MeteorsLiu/virtuallabs/backend/api/class"
 	"github.com/MeteorsLiu/virtuallabs/backend/api/courses"
 	"github.com/MeteorsLiu/virtuallabs/backend/api/experiment"
+	"github.com/MeteorsLiu/virtuallabs/backend/api/images"
 	"github.com/MeteorsLiu/virtuallabs/backend/api/login"
 	"github.com/MeteorsLiu/virtuallabs/backend/api/student"
 	"github.com/MeteorsLiu/virtuallabs/backend/api/teacher"
 	"github.com/MeteorsLiu/virtuallabs/backend/api/vm"
+	"github.com/MeteorsLiu/virtuallabs/backend/config"
+	"github.com/MeteorsLiu/virtuallabs/backend/grading"
+	"github.com/MeteorsLiu/virtuallabs/backend/lease"
+	"github.com/MeteorsLiu/virtuallabs/backend/outbox"
+	"github.com/MeteorsLiu/virtuallabs/backend/queue"
+	"github.com/MeteorsLiu/virtuallabs/backend/worker"
 	"github.com/gin-gonic/gin"
 )
 
 // 程序入口，设置 Gin 路由
 func main() {
-	var dsn string
-	flag.StringVar(&dsn, "dsn", "", "MySQL DSN")
+	var configFile, dsn string
+	flag.StringVar(&configFile, "f", "config.yml", "配置文件")
+	flag.StringVar(&dsn, "dsn", "", "MySQL DSN，覆盖配置文件")
 	flag.Parse()
 
-	api.InitDB("123456", dsn)
+	// 显式指定的配置文件必须存在
+	required := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "f" {
+			required = true
+		}
+	})
+
+	c, err := config.Load(configFile, required)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if dsn != "" {
+		c.DB.DSN = dsn
+	}
+	if err := c.Validate(); err != nil {
+		log.Fatalf("配置错误：%v", err)
+	}
+	if c.JWT.Secret == "" {
+		log.Println("警告：未配置 JWT.Secret，开发模式下使用默认密钥")
+		c.JWT.Secret = config.DefaultJwtSecret
+	}
+	if c.IsProd() {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
+	api.InitDB(c)
+	queue.Init(c.Kafka.Brokers, c.Kafka.VMTopic)
+	go outbox.Run(context.Background(), api.DB)
+	go lease.Run(context.Background(), api.DB, c.Lease)
+	go grading.Run(context.Background(), api.DB)
+	worker.Addr = c.Worker.URL
+	worker.Secret = c.Worker.Secret
+
 	router := gin.Default()
 
-	router.Static("/uploads", "./uploads")
+	router.Static("/uploads", c.UploadDir)
 
-	router.Use(api.UseCORS())
+	router.Use(api.UseCORS(c.CORSOrigins))
+	router.Use(api.TraceMiddleware())
 
 	login.Register(router)
 
 	vm.Register(router)
+	// 代理接口使用虚拟机令牌认证，须在注册全局 JWT 中间件的路由之前注册
+	agent.Register(router)
 	class.Register(router)
 	courses.Register(router)
 	student.Register(router)
 	teacher.Register(router)
 	experiment.Register(router)
+	images.Register(router)
 
-	router.Run(":8888")
+	router.Run(c.ListenAddr)
 }
@@ -3,6 +3,7 @@ package models
 import (
 	"time"
 
+	"github.com/MeteorsLiu/virtuallabs/backend/queue"
 	"gorm.io/gorm"
 )
 
@@ -95,24 +96,86 @@ type CourseAssessment struct {
 	AssessmentDate time.Time `json:"assessmentDate"`
 	CreatedAt      time.Time `gorm:"type:timestamp;default:CURRENT_TIMESTAMP;not null" json:"createdAt"`
 
+	TimeLimitMinutes int `gorm:"not null;default:0" json:"timeLimitMinutes"` // 作答时限，0 表示不限时
+	// 允许的作答次数，0 表示不限；多次作答时按计分方式取最高、最后一次或平均分
+	MaxAttempts   int    `gorm:"not null;default:1" json:"maxAttempts"`
+	ScoringPolicy string `gorm:"type:ENUM('highest', 'latest', 'average');default:'highest';not null" json:"scoringPolicy"`
+	// 向学生公布正确答案和解析的时机：立即、提交后、截止日期后或不公布
+	RevealPolicy string `gorm:"type:ENUM('immediately', 'after_submission', 'after_due', 'never');default:'after_submission';not null" json:"revealPolicy"`
+
+	// 每个学生开始作答时打乱题目顺序和选项顺序，并从题库按抽题规则抽题
+	ShuffleQuestions bool             `gorm:"not null" json:"shuffleQuestions"`
+	ShuffleOptions   bool             `gorm:"not null" json:"shuffleOptions"`
+	Pools            []AssessmentPool `gorm:"foreignKey:AssessmentID" json:"pools,omitempty"`
+
 	Course Course `gorm:"foreignKey:CourseID;references:CourseID;-:migration" json:"course"`
 }
 
+// 抽题规则：从课程题库中带有该标签的题目里随机抽取 Count 道
+type AssessmentPool struct {
+	PoolID       int    `gorm:"primaryKey;autoIncrement" json:"poolId"`
+	AssessmentID int    `gorm:"not null;index" json:"assessmentId"`
+	Tag          string `gorm:"not null;size:50" json:"tag"`
+	Count        int    `gorm:"not null" json:"count"`
+}
+
 type StudentGrade struct {
 	GradeID      int       `gorm:"primaryKey;autoIncrement" json:"gradeId"`
-	StudentID    int       `json:"studentId"`
-	AssessmentID int       `json:"assessmentId"`
+	StudentID    int       `gorm:"uniqueIndex:idx_student_assessment" json:"studentId"`
+	AssessmentID int       `gorm:"uniqueIndex:idx_student_assessment" json:"assessmentId"`
 	Score        float64   `gorm:"type:decimal(5,2);not null" json:"score"`
 	GradedBy     *int      `json:"gradedBy,omitempty"`
 	GradeComment string    `gorm:"type:TEXT" json:"gradeComment"`
 	CreatedAt    time.Time `gorm:"type:timestamp;default:CURRENT_TIMESTAMP;not null" json:"createdAt"`
 	UpdatedAt    time.Time `gorm:"type:timestamp;default:CURRENT_TIMESTAMP;not null" json:"updatedAt"`
 
+	Overridden bool `gorm:"not null;default:false" json:"overridden"` // 教师手动改分后不再随作答重新计算
+
 	Student    User             `gorm:"foreignKey:StudentID" json:"student"`
 	Assessment CourseAssessment `gorm:"foreignKey:AssessmentID;references:AssessmentID;-:migration"`
 	Grader     *User            `gorm:"foreignKey:GradedBy" json:"grader,omitempty"`
 }
 
+// 成绩修改记录，PreviousScore 为空表示修改前没有成绩
+type GradeOverride struct {
+	OverrideID    int       `gorm:"primaryKey;autoIncrement" json:"overrideId"`
+	AssessmentID  int       `gorm:"not null;index:idx_override_grade" json:"assessmentId"`
+	StudentID     int       `gorm:"not null;index:idx_override_grade" json:"studentId"`
+	PreviousScore *float64  `gorm:"type:decimal(5,2)" json:"previousScore"`
+	NewScore      *float64  `gorm:"type:decimal(5,2)" json:"newScore"` // 为空表示撤销改分、恢复自动计算
+	Reason        string    `gorm:"type:TEXT;not null" json:"reason"`
+	GradedBy      int       `gorm:"not null" json:"gradedBy"`
+	CreatedAt     time.Time `gorm:"type:timestamp;default:CURRENT_TIMESTAMP;not null" json:"createdAt"`
+
+	Grader User `gorm:"foreignKey:GradedBy;-:migration" json:"grader"`
+}
+
+// 课程总评规则：缺考的评分项计 0 分或不计入，按评分项类型去掉最低的若干项，按百分制分数线给出等级
+type CourseGradePolicy struct {
+	CourseID      int              `gorm:"primaryKey" json:"courseId"`
+	MissingPolicy string           `gorm:"type:ENUM('zero', 'exclude');default:'zero';not null" json:"missingPolicy"`
+	DropLowest    map[string]int   `gorm:"serializer:json;type:TEXT" json:"dropLowest"` // 评分项类型 -> 去掉的最低项数
+	LetterGrades  []LetterBoundary `gorm:"serializer:json;type:TEXT" json:"letterGrades"`
+	UpdatedAt     time.Time        `gorm:"type:timestamp;default:CURRENT_TIMESTAMP;not null" json:"updatedAt"`
+}
+
+// 等级分数线，百分制分数不低于 MinPercent 时取该等级
+type LetterBoundary struct {
+	Letter     string  `json:"letter"`
+	MinPercent float64 `json:"minPercent"`
+}
+
+// 学生的课程总评，任一评分项成绩变化时重新计算。没有可计入的评分项时 Percent 为空
+type CourseGrade struct {
+	CourseID  int       `gorm:"primaryKey" json:"courseId"`
+	StudentID int       `gorm:"primaryKey" json:"studentId"`
+	Percent   *float64  `gorm:"type:decimal(5,2)" json:"percent"`
+	Letter    string    `gorm:"size:10" json:"letter"`
+	UpdatedAt time.Time `gorm:"type:timestamp;default:CURRENT_TIMESTAMP;not null" json:"updatedAt"`
+
+	Student User `gorm:"foreignKey:StudentID;-:migration" json:"student"`
+}
+
 type TeacherCourse struct {
 	TeacherID int `gorm:"primaryKey" json:"teacherId"`
 	CourseID  int `gorm:"primaryKey" json:"courseId"`
@@ -135,9 +198,82 @@ type Experiment struct {
 	ExperimentName string    `gorm:"not null;size:100" json:"experimentName"`
 	CourseID       int       `gorm:"not null" json:"courseId"`
 	Description    string    `gorm:"type:TEXT" json:"description"`
+	InitScript     string    `gorm:"type:TEXT" json:"initScript"` // 虚拟机启动前执行的初始化脚本
 	CreatedAt      time.Time `gorm:"type:timestamp;default:CURRENT_TIMESTAMP;not null" json:"createdAt"`
 
-	Course Course `gorm:"foreignKey:CourseID;constraint:OnDelete:CASCADE;-:migration"`
+	// 虚拟机租期（分钟），续期后总时长不超过 MaxLeaseMinutes，到期按 ExpireAction 停止或删除
+	LeaseMinutes    int    `gorm:"not null;default:240" json:"leaseMinutes"`
+	MaxLeaseMinutes int    `gorm:"not null;default:480" json:"maxLeaseMinutes"`
+	ExpireAction    string `gorm:"type:ENUM('stop', 'delete');default:'stop';not null" json:"expireAction"`
+
+	WarmPoolSize int `gorm:"not null;default:0" json:"warmPoolSize"` // 预热池中保持的空闲虚拟机数，0 表示不预热；初始化脚本引用 LAB_STUDENT_* 变量时不预热
+
+	ImageID *int `gorm:"index" json:"imageId"` // 镜像目录中的镜像，为空时使用部署模板中的默认镜像
+	// 调度约束，与镜像的约束合并后生效，如考试实验使用专用节点和高优先级
+	Scheduling *queue.Scheduling `gorm:"serializer:json;type:TEXT" json:"scheduling"`
+	// 出站网络策略，考核实验可禁止或只允许访问指定地址
+	Egress *queue.Egress `gorm:"serializer:json;type:TEXT" json:"egress"`
+
+	Course Course           `gorm:"foreignKey:CourseID;constraint:OnDelete:CASCADE;-:migration"`
+	Files  []ExperimentFile `gorm:"foreignKey:ExperimentID" json:"files,omitempty"`
+	Steps  []ExperimentStep `gorm:"foreignKey:ExperimentID" json:"steps,omitempty"`
+	Image  *LabImage        `gorm:"foreignKey:ImageID;-:migration" json:"image,omitempty"`
+}
+
+// 实验镜像目录，只有目录中已启用的镜像可以在集群中运行，由管理员维护
+type LabImage struct {
+	ImageID        int       `gorm:"primaryKey;autoIncrement" json:"imageId"`
+	Name           string    `gorm:"unique;not null;size:100" json:"name"`
+	Image          string    `gorm:"not null;size:255" json:"image"` // 镜像仓库地址，如 registry.example.com/lab/ubuntu:22.04
+	Description    string    `gorm:"type:TEXT" json:"description"`
+	CPURequest     string    `gorm:"size:20" json:"cpuRequest"` // 默认资源，格式同 Kubernetes 资源数量，如 500m、2Gi
+	CPULimit       string    `gorm:"size:20" json:"cpuLimit"`
+	MemoryRequest  string    `gorm:"size:20" json:"memoryRequest"`
+	MemoryLimit    string    `gorm:"size:20" json:"memoryLimit"`
+	Ports          []int     `gorm:"serializer:json;type:TEXT" json:"ports"` // 暴露的容器端口，第一个为访问端口
+	AccessProtocol string    `gorm:"type:ENUM('vnc', 'terminal', 'http');default:'vnc';not null" json:"accessProtocol"`
+	Enabled        bool      `gorm:"not null" json:"enabled"` // 停用后不能再被实验选用或创建新虚拟机
+	CreatedAt      time.Time `gorm:"type:timestamp;default:CURRENT_TIMESTAMP;not null" json:"createdAt"`
+	UpdatedAt      time.Time `gorm:"type:timestamp;default:CURRENT_TIMESTAMP;not null" json:"updatedAt"`
+
+	// 默认调度约束，如大内存镜像只调度到大规格节点
+	Scheduling *queue.Scheduling `gorm:"serializer:json;type:TEXT" json:"scheduling"`
+}
+
+// 实验附件，创建虚拟机时拷贝到工作目录
+type ExperimentFile struct {
+	FileID       int       `gorm:"primaryKey;autoIncrement" json:"fileId"`
+	ExperimentID int       `gorm:"not null;index" json:"experimentId"`
+	FileName     string    `gorm:"not null;size:255" json:"fileName"` // 虚拟机内的文件名
+	FileURL      string    `gorm:"not null;size:255" json:"fileUrl"`
+	FileSize     int64     `gorm:"not null" json:"fileSize"`
+	CreatedAt    time.Time `gorm:"type:timestamp;default:CURRENT_TIMESTAMP;not null" json:"createdAt"`
+
+	Experiment Experiment `gorm:"foreignKey:ExperimentID;constraint:OnDelete:CASCADE;-:migration" json:"-"`
+}
+
+// 实验步骤，由虚拟机内的进度代理按 StepKey 上报完成
+type ExperimentStep struct {
+	StepID       int    `gorm:"primaryKey;autoIncrement" json:"stepId"`
+	ExperimentID int    `gorm:"not null;uniqueIndex:idx_experiment_step" json:"experimentId"`
+	StepKey      string `gorm:"not null;size:64;uniqueIndex:idx_experiment_step" json:"stepKey"` // 如 firewall-configured
+	Title        string `gorm:"not null;size:200" json:"title"`
+	Description  string `gorm:"type:TEXT" json:"description"`
+	SortOrder    int    `gorm:"default:0" json:"sortOrder"`
+
+	Experiment Experiment `gorm:"foreignKey:ExperimentID;constraint:OnDelete:CASCADE;-:migration" json:"-"`
+}
+
+// 学生完成实验步骤的记录，同一步骤只保留首次完成
+type StepCompletion struct {
+	StudentID    int       `gorm:"primaryKey" json:"studentId"`
+	StepID       int       `gorm:"primaryKey" json:"stepId"`
+	ExperimentID int       `gorm:"not null;index" json:"experimentId"`
+	VMID         int       `gorm:"not null" json:"vmId"`
+	Detail       string    `gorm:"size:500" json:"detail"` // 代理附带的说明，如检查输出
+	CompletedAt  time.Time `gorm:"type:timestamp;default:CURRENT_TIMESTAMP;not null" json:"completedAt"`
+
+	Step ExperimentStep `gorm:"foreignKey:StepID;constraint:OnDelete:CASCADE;-:migration" json:"-"`
 }
 
 type TeacherExperiment struct {
@@ -157,10 +293,34 @@ type VirtualMachine struct {
 	Status       string    `gorm:"type:ENUM('pending', 'creating', 'running', 'stopped', 'error');default:'pending'" json:"status"`
 	StatusMsg    string    `gorm:"size:255" json:"statusMsg"`
 	LastUpdated  time.Time `gorm:"type:timestamp;default:CURRENT_TIMESTAMP;not null" json:"lastUpdated"`
+	CreatedAt    time.Time `gorm:"type:timestamp;default:CURRENT_TIMESTAMP;not null" json:"createdAt"`
+
+	// 租期从创建或重新启动时开始计算，续期不能超过开始时间加实验的最长租期
+	LeaseStartedAt *time.Time `gorm:"type:timestamp NULL" json:"leaseStartedAt"`
+	LeaseExpiresAt *time.Time `gorm:"type:timestamp NULL;index" json:"leaseExpiresAt"`
+	LeaseWarnedAt  *time.Time `gorm:"type:timestamp NULL" json:"leaseWarnedAt"` // 已发送到期提醒的时间，续期后清空
+
+	// 工作节点加密后的访问凭据，仅所有者通过凭据接口解密查看
+	Credentials string `gorm:"type:TEXT" json:"-"`
+	// 进度代理令牌的 SHA-256，令牌本身只注入虚拟机
+	AgentTokenHash string `gorm:"size:64;index" json:"-"`
 
 	Experiment Experiment `gorm:"foreignKey:ExperimentID;constraint:OnDelete:CASCADE;-:migration" json:"experiment"`
 }
 
+// 虚拟机指令发件箱，与业务数据在同一事务中写入，由后台协程投递到消息队列
+type OutboxMessage struct {
+	ID         int        `gorm:"primaryKey;autoIncrement" json:"id"`
+	MessageKey string     `gorm:"not null;size:100" json:"messageKey"`
+	Payload    string     `gorm:"type:MEDIUMTEXT;not null" json:"payload"`
+	Status     string     `gorm:"type:ENUM('pending', 'sent', 'failed');default:'pending';index:idx_outbox_status" json:"status"` // 多次推送失败后为 failed，不再投递
+	Attempts   int        `gorm:"default:0" json:"attempts"`
+	LastError  string     `gorm:"size:255" json:"lastError"`
+	CreatedAt  time.Time  `gorm:"type:timestamp;default:CURRENT_TIMESTAMP;not null" json:"createdAt"`
+	SentAt     *time.Time `json:"sentAt,omitempty"`
+	RetryAt    *time.Time `json:"retryAt,omitempty"` // 推送失败后下次重试的时间
+}
+
 type StudentVirtualMachine struct {
 	StudentID       int       `gorm:"primaryKey" json:"studentId"`
 	VMID            int       `gorm:"primaryKey" json:"vmId"`
@@ -173,17 +333,40 @@ type StudentVirtualMachine struct {
 type Question struct {
 	QuestionID   int       `gorm:"primaryKey;autoIncrement" json:"questionId"`
 	CourseID     int       `json:"courseId"` // 所属课程
-	QuestionType string    `gorm:"type:ENUM('single','multiple');not null" json:"questionType"`
+	QuestionType string    `gorm:"type:ENUM('single','multiple','true_false','fill_blank','numeric','short_answer');not null" json:"questionType"`
 	Content      string    `gorm:"type:TEXT;not null" json:"content"`      // 题目内容
 	Explanation  string    `gorm:"type:TEXT" json:"explanation,omitempty"` // 解析
 	CreatedAt    time.Time `gorm:"type:timestamp;default:CURRENT_TIMESTAMP;not null" json:"createdAt"`
-	AssessmentID int       `json:"assessmentId"` // 新增字段，关联评分项
+	AssessmentID int       `json:"assessmentId"` // 新增字段，关联评分项，题库中的题目为 0
+
+	// 填空题每个空的评分规则；数值题的参考答案及允许的绝对误差。判断题使用两个选项，简答题由教师评分
+	Blanks        []BlankRule `gorm:"serializer:json;type:TEXT" json:"blanks,omitempty"`
+	NumericAnswer *float64    `json:"numericAnswer,omitempty"`
+	Tolerance     float64     `gorm:"not null;default:0" json:"tolerance,omitempty"`
+
+	// 题目分值，评分项得分按各题得分之和占总分值的比例折算；多选题的部分得分规则：全对才得分、按选对比例得分（错选不得分）或错选倒扣
+	Points        float64 `gorm:"type:decimal(5,2);not null;default:1" json:"points"`
+	PartialCredit string  `gorm:"type:ENUM('all_or_nothing', 'proportional', 'penalty');default:'all_or_nothing';not null" json:"partialCredit"`
 
 	// 关联关系
 	Course    Course           `gorm:"foreignKey:CourseID;-:migration" json:"course,omitempty"`
 	ChapterID *int             `gorm:"column:chapter_id;default:null" json:"chapterId,omitempty"`
 	Chapter   CourseChapter    `gorm:"foreignKey:ChapterID;references:ChapterID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;-:migration" json:"chapter,omitempty"`
 	Options   []QuestionOption `gorm:"foreignKey:QuestionID" json:"options,omitempty"` // 题目选项
+	Tags      []QuestionTag    `gorm:"foreignKey:QuestionID" json:"tags,omitempty"`    // 题库标签
+}
+
+// 题库题目的标签，抽题规则按标签抽题
+type QuestionTag struct {
+	QuestionID int    `gorm:"primaryKey" json:"-"`
+	Tag        string `gorm:"primaryKey;size:50;index" json:"tag"`
+}
+
+// 填空题一个空的评分规则
+type BlankRule struct {
+	Accepted      []string `json:"accepted,omitempty"` // 可接受的答案，以 re: 开头的按正则表达式匹配整个答案
+	CaseSensitive bool     `json:"caseSensitive,omitempty"`
+	Whitespace    string   `json:"whitespace,omitempty"` // trim（默认）去除首尾空白，collapse 另将连续空白合并为一个空格，ignore 忽略全部空白
 }
 
 type QuestionOption struct {
@@ -201,6 +384,19 @@ type StudentAnswer struct {
 	StudentID  int       `json:"studentId"`  // 答题学生
 	QuestionID int       `json:"questionId"` // 对应题目
 	AnswerTime time.Time `gorm:"type:timestamp;default:CURRENT_TIMESTAMP;not null" json:"answerTime"`
+	AttemptID  *int      `gorm:"index" json:"attemptId"` // 所属作答，引入作答前的记录为空
+
+	// 非选择题的答案：填空题按空的顺序保存，数值题保存数值，简答题保存文本
+	BlankAnswers  []string `gorm:"serializer:json;type:TEXT" json:"blankAnswers,omitempty"`
+	NumericAnswer *float64 `json:"numericAnswer,omitempty"`
+	TextAnswer    string   `gorm:"type:TEXT" json:"textAnswer,omitempty"`
+	IsCorrect     *bool    `json:"isCorrect"` // 提交时自动评分的结果，简答题等待教师评分时为空
+
+	// 教师评分：设置后覆盖自动评分结果
+	Score    *float64   `gorm:"type:decimal(5,2)" json:"score,omitempty"`
+	Comment  string     `gorm:"type:TEXT" json:"comment,omitempty"`
+	GradedBy *int       `json:"gradedBy,omitempty"`
+	GradedAt *time.Time `gorm:"type:timestamp NULL" json:"gradedAt,omitempty"`
 
 	// 关联关系
 	Student    User                  `gorm:"foreignKey:StudentID" json:"student"`
@@ -208,6 +404,32 @@ type StudentAnswer struct {
 	Selections []StudentAnswerOption `gorm:"foreignKey:AnswerID" json:"selections,omitempty"` // 选中选项
 }
 
+// 学生的一次作答：开始时按评分项时限确定截止时间，提交后只按本次作答的答案评分
+type AssessmentAttempt struct {
+	AttemptID     int        `gorm:"primaryKey;autoIncrement" json:"attemptId"`
+	AssessmentID  int        `gorm:"not null;uniqueIndex:idx_attempt_no" json:"assessmentId"`
+	StudentID     int        `gorm:"not null;uniqueIndex:idx_attempt_no;index" json:"studentId"`
+	AttemptNo     int        `gorm:"not null;uniqueIndex:idx_attempt_no" json:"attemptNo"` // 第几次作答，从 1 开始
+	Status        string     `gorm:"type:ENUM('in_progress', 'submitted');default:'in_progress';not null;index" json:"status"`
+	StartedAt     time.Time  `gorm:"type:timestamp;default:CURRENT_TIMESTAMP;not null" json:"startedAt"`
+	Deadline      *time.Time `gorm:"type:timestamp NULL;index" json:"deadline"` // 不限时的评分项为空
+	SubmittedAt   *time.Time `gorm:"type:timestamp NULL" json:"submittedAt"`
+	AutoSubmitted bool       `gorm:"not null" json:"autoSubmitted"` // 到达截止时间后由系统提交
+	Score         *float64   `gorm:"type:decimal(5,2)" json:"score"`
+
+	// 开始作答时确定的题目及顺序，评分和回看都以此为准；引入抽题前的作答为空，使用评分项的全部题目
+	DrawnQuestions []DrawnQuestion `gorm:"serializer:json;type:MEDIUMTEXT" json:"-"`
+
+	Assessment CourseAssessment `gorm:"foreignKey:AssessmentID;-:migration" json:"-"`
+	Answers    []StudentAnswer  `gorm:"foreignKey:AttemptID;-:migration" json:"answers,omitempty"`
+}
+
+// 作答中的一道题及其选项的展示顺序
+type DrawnQuestion struct {
+	QuestionID int   `json:"questionId"`
+	OptionIDs  []int `json:"optionIds,omitempty"`
+}
+
 type StudentAnswerOption struct {
 	AnswerOptionID int `gorm:"primaryKey;autoIncrement" json:"answerOptionId"`
 	AnswerID       int `json:"answerId"` // 所属答题记录
@@ -0,0 +1,151 @@
+package outbox
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/models"
+	"github.com/MeteorsLiu/virtuallabs/backend/queue"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	pollInterval = 2 * time.Second
+	batchSize    = 100
+	// 已投递消息的保留时间，便于排查问题
+	retention = 7 * 24 * time.Hour
+	// 推送失败的重试间隔从 pollInterval 起逐次翻倍，最长 maxRetryDelay，
+	// 失败 maxAttempts 次后标记为 failed，同一虚拟机后续的指令继续投递
+	maxRetryDelay = 5 * time.Minute
+	maxAttempts   = 20
+)
+
+var wakeup = make(chan struct{}, 1)
+
+// Enqueue 在调用方的事务中写入待投递消息，事务提交后消息才对投递协程可见
+func Enqueue(tx *gorm.DB, msg queue.Message) error {
+	return tx.Create(&models.OutboxMessage{
+		MessageKey: msg.Key,
+		Payload:    msg.Value,
+		Status:     "pending",
+	}).Error
+}
+
+// Notify 在事务提交后唤醒投递协程，避免等待下一个轮询周期
+func Notify() {
+	select {
+	case wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Run 循环投递发件箱中的消息，直到 ctx 结束
+//
+// 投递语义为至少一次：消息推送成功但标记失败时会被重复投递，消费端需保证幂等。
+// 每个虚拟机每次只投递最早一条未投递的消息，保证同一虚拟机的指令不会乱序。
+func Run(ctx context.Context, db *gorm.DB) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	lastCleanup := time.Now()
+	for {
+		for {
+			n, err := relayBatch(ctx, db)
+			if err != nil {
+				log.Println("outbox:", err)
+				break
+			}
+			// 同一虚拟机的后续消息要等前一条投递后才能选中
+			if n == 0 {
+				break
+			}
+		}
+
+		if time.Since(lastCleanup) > time.Hour {
+			db.Where("status = ? AND sent_at < ?", "sent", time.Now().Add(-retention)).
+				Delete(&models.OutboxMessage{})
+			lastCleanup = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wakeup:
+		}
+	}
+}
+
+// relayBatch 锁定每个虚拟机最早一条待投递的消息并逐条推送。
+// 多实例部署时通过 SKIP LOCKED 避免重复投递：其他实例正在投递的消息仍是该虚拟机最早的待投递消息，
+// 被跳过后不会选中同一虚拟机的后续消息
+func relayBatch(ctx context.Context, db *gorm.DB) (int, error) {
+	sent := 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		oldest := tx.Model(&models.OutboxMessage{}).
+			Select("MIN(id)").
+			Where("status = ?", "pending").
+			Group("message_key")
+		var msgs []models.OutboxMessage
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND id IN (?)", "pending", oldest).
+			Where("retry_at IS NULL OR retry_at <= ?", time.Now()).
+			Order("id ASC").
+			Limit(batchSize).
+			Find(&msgs).Error; err != nil {
+			return err
+		}
+
+		for _, m := range msgs {
+			if err := queue.Push(ctx, queue.Message{Key: m.MessageKey, Value: m.Payload}); err != nil {
+				if err := markFailed(tx, &m, err); err != nil {
+					return err
+				}
+				continue
+			}
+
+			now := time.Now()
+			if err := tx.Model(&models.OutboxMessage{}).Where("id = ?", m.ID).Updates(map[string]interface{}{
+				"status":   "sent",
+				"attempts": gorm.Expr("attempts + 1"),
+				"sent_at":  &now,
+			}).Error; err != nil {
+				return err
+			}
+			sent++
+		}
+		return nil
+	})
+	return sent, err
+}
+
+// markFailed 记录推送失败并推迟下次重试，达到 maxAttempts 后不再投递
+func markFailed(tx *gorm.DB, m *models.OutboxMessage, pushErr error) error {
+	errMsg := pushErr.Error()
+	if len(errMsg) > 255 {
+		errMsg = errMsg[:255]
+	}
+	attempts := m.Attempts + 1
+	updates := map[string]interface{}{
+		"attempts":   attempts,
+		"last_error": errMsg,
+	}
+	if attempts >= maxAttempts {
+		log.Printf("outbox: message %d (key %s) failed %d times, giving up: %v", m.ID, m.MessageKey, attempts, pushErr)
+		updates["status"] = "failed"
+	} else {
+		updates["retry_at"] = time.Now().Add(retryDelay(attempts))
+	}
+	return tx.Model(&models.OutboxMessage{}).Where("id = ?", m.ID).Updates(updates).Error
+}
+
+// retryDelay 返回第 attempts 次失败后的重试间隔
+func retryDelay(attempts int) time.Duration {
+	delay := pollInterval
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
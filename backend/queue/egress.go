@@ -0,0 +1,64 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// 出站策略模式
+const (
+	EgressOpen      = "open"      // 不限制，与未设置相同
+	EgressBlocked   = "blocked"   // 禁止所有出站访问
+	EgressAllowlist = "allowlist" // 只允许访问 CIDRs 和 Hosts
+)
+
+// 允许列表的最大条目数，避免生成过大的 NetworkPolicy
+const maxEgressEntries = 50
+
+// Egress 为虚拟机的出站网络策略，由工作节点创建 NetworkPolicy 执行。
+// 进度代理访问后端的地址始终放行；Hosts 在创建虚拟机时解析为 IP，之后的 DNS 变化不会生效
+type Egress struct {
+	Mode  string   `json:"mode"`
+	CIDRs []string `json:"cidrs,omitempty"`
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+// Restricted 判断是否需要限制出站
+func (e *Egress) Restricted() bool {
+	return e != nil && e.Mode != "" && e.Mode != EgressOpen
+}
+
+func (e *Egress) Validate() error {
+	if e == nil {
+		return nil
+	}
+	switch e.Mode {
+	case "", EgressOpen, EgressBlocked:
+		if len(e.CIDRs) > 0 || len(e.Hosts) > 0 {
+			return fmt.Errorf("出站策略 %s 不能设置允许列表", e.Mode)
+		}
+		return nil
+	case EgressAllowlist:
+	default:
+		return fmt.Errorf("无效的出站策略: %s", e.Mode)
+	}
+
+	if len(e.CIDRs)+len(e.Hosts) == 0 {
+		return errors.New("允许列表不能为空")
+	}
+	if len(e.CIDRs)+len(e.Hosts) > maxEgressEntries {
+		return fmt.Errorf("允许列表最多 %d 项", maxEgressEntries)
+	}
+	for _, cidr := range e.CIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("无效的 CIDR: %s", cidr)
+		}
+	}
+	for _, host := range e.Hosts {
+		if !dnsNamePattern.MatchString(host) || net.ParseIP(host) != nil {
+			return fmt.Errorf("无效的主机名: %s", host)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package queue
+
+import "testing"
+
+func TestEgressValidate(t *testing.T) {
+	for _, e := range []*Egress{
+		nil,
+		{Mode: EgressOpen},
+		{Mode: EgressBlocked},
+		{Mode: EgressAllowlist, CIDRs: []string{"10.0.0.0/8", "2001:db8::/32"}, Hosts: []string{"mirrors.example.com"}},
+	} {
+		if err := e.Validate(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", e, err)
+		}
+	}
+
+	for name, e := range map[string]*Egress{
+		"unknown mode":     {Mode: "offline"},
+		"blocked with ips": {Mode: EgressBlocked, CIDRs: []string{"10.0.0.0/8"}},
+		"empty allowlist":  {Mode: EgressAllowlist},
+		"bare ip":          {Mode: EgressAllowlist, CIDRs: []string{"10.0.0.1"}},
+		"ip as host":       {Mode: EgressAllowlist, Hosts: []string{"10.0.0.1"}},
+		"wildcard host":    {Mode: EgressAllowlist, Hosts: []string{"*.example.com"}},
+	} {
+		if err := e.Validate(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	if (&Egress{Mode: EgressOpen}).Restricted() || (*Egress)(nil).Restricted() {
+		t.Error("open egress should not be restricted")
+	}
+	if !(&Egress{Mode: EgressBlocked}).Restricted() {
+		t.Error("blocked egress should be restricted")
+	}
+}
@@ -0,0 +1,207 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 后端与工作节点之间的消息协议
+//
+// 兼容规则：
+//   - 在载荷中新增可选字段不升级版本，解码时忽略未知字段，缺失字段取零值；
+//   - 删除、重命名字段或改变字段含义时 SchemaVersion 加一，
+//     工作节点需继续支持所有旧版本，因此升级时先升级工作节点、再升级后端；
+//   - 新增消息类型不升级版本，旧工作节点遇到未知类型返回 ErrUnknownType；
+//   - 版本高于工作节点支持的消息返回 ErrUnsupportedVersion；
+//   - 解码失败的消息不得丢弃，由工作节点转入死信队列，升级后可重新投递；
+//   - 不带 version 字段的消息视为版本 0，即旧版的 VMRequest 格式。
+const SchemaVersion = 1
+
+type MessageType string
+
+const (
+	TypeCreateVM MessageType = "vm.create"
+	TypeDeleteVM MessageType = "vm.delete"
+	// 租期到期停止虚拟机（缩容到 0）及续期时重新启动
+	TypeStopVM  MessageType = "vm.stop"
+	TypeStartVM MessageType = "vm.start"
+)
+
+// TraceIDKey 为上下文中链路 ID 的键，gin.Context 通过 Set 写入后可直接作为 context 使用
+const TraceIDKey = "traceId"
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported schema version")
+	ErrUnknownType        = errors.New("unknown message type")
+	ErrInvalidPayload     = errors.New("invalid payload")
+)
+
+// Envelope 为消息外层结构，Payload 的具体类型由 Type 决定
+type Envelope struct {
+	Version   int             `json:"version"`
+	Type      MessageType     `json:"type"`
+	ID        string          `json:"id"`
+	Timestamp time.Time       `json:"timestamp"`
+	TraceID   string          `json:"traceId,omitempty"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+type CreateVMPayload struct {
+	VMID      int        `json:"vmId"`
+	VMName    string     `json:"vmName"`
+	Provision *Provision `json:"provision,omitempty"`
+}
+
+type DeleteVMPayload struct {
+	VMID   int    `json:"vmId"`
+	VMName string `json:"vmName"`
+}
+
+type StopVMPayload struct {
+	VMID   int    `json:"vmId"`
+	VMName string `json:"vmName"`
+}
+
+type StartVMPayload struct {
+	VMID   int    `json:"vmId"`
+	VMName string `json:"vmName"`
+}
+
+// NewEnvelope 以当前版本封装载荷，链路 ID 取自 ctx
+func NewEnvelope(ctx context.Context, typ MessageType, payload any) (*Envelope, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{
+		Version:   SchemaVersion,
+		Type:      typ,
+		ID:        uuid.NewString(),
+		Timestamp: time.Now().UTC(),
+		TraceID:   TraceID(ctx),
+		Payload:   b,
+	}, nil
+}
+
+// TraceID 读取上下文中的链路 ID，不存在时返回空串
+func TraceID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(TraceIDKey).(string)
+	return id
+}
+
+// Decode 解析消息并检查版本和类型，返回的错误均表示该消息当前无法处理
+func Decode(value []byte) (*Envelope, error) {
+	var probe struct {
+		Version *int `json:"version"`
+	}
+	if err := json.Unmarshal(value, &probe); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	if probe.Version == nil {
+		return decodeLegacy(value)
+	}
+
+	var e Envelope
+	if err := json.Unmarshal(value, &e); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	if e.Version < 1 || e.Version > SchemaVersion {
+		return nil, fmt.Errorf("%w: %d (supported 1-%d)", ErrUnsupportedVersion, e.Version, SchemaVersion)
+	}
+	switch e.Type {
+	case TypeCreateVM, TypeDeleteVM, TypeStopVM, TypeStartVM:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownType, e.Type)
+	}
+	return &e, nil
+}
+
+// CreateVM 解析创建载荷
+func (e *Envelope) CreateVM() (*CreateVMPayload, error) {
+	var p CreateVMPayload
+	if err := e.decodePayload(TypeCreateVM, &p); err != nil {
+		return nil, err
+	}
+	if p.VMName == "" {
+		return nil, fmt.Errorf("%w: vmName is required", ErrInvalidPayload)
+	}
+	return &p, nil
+}
+
+// DeleteVM 解析删除载荷
+func (e *Envelope) DeleteVM() (*DeleteVMPayload, error) {
+	var p DeleteVMPayload
+	if err := e.decodePayload(TypeDeleteVM, &p); err != nil {
+		return nil, err
+	}
+	if p.VMName == "" {
+		return nil, fmt.Errorf("%w: vmName is required", ErrInvalidPayload)
+	}
+	return &p, nil
+}
+
+// StopVM 解析停止载荷
+func (e *Envelope) StopVM() (*StopVMPayload, error) {
+	var p StopVMPayload
+	if err := e.decodePayload(TypeStopVM, &p); err != nil {
+		return nil, err
+	}
+	if p.VMName == "" {
+		return nil, fmt.Errorf("%w: vmName is required", ErrInvalidPayload)
+	}
+	return &p, nil
+}
+
+// StartVM 解析启动载荷
+func (e *Envelope) StartVM() (*StartVMPayload, error) {
+	var p StartVMPayload
+	if err := e.decodePayload(TypeStartVM, &p); err != nil {
+		return nil, err
+	}
+	if p.VMName == "" {
+		return nil, fmt.Errorf("%w: vmName is required", ErrInvalidPayload)
+	}
+	return &p, nil
+}
+
+func (e *Envelope) decodePayload(typ MessageType, v any) error {
+	if e.Type != typ {
+		return fmt.Errorf("%w: payload is %q, not %q", ErrInvalidPayload, e.Type, typ)
+	}
+	if err := json.Unmarshal(e.Payload, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	return nil
+}
+
+// decodeLegacy 将版本 0 的 VMRequest 转换为信封，兼容升级前已入队的消息
+func decodeLegacy(value []byte) (*Envelope, error) {
+	var req VMRequest
+	if err := json.Unmarshal(value, &req); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+
+	var (
+		typ     MessageType
+		payload any
+	)
+	switch req.OpCode {
+	case OpCreateVM:
+		typ, payload = TypeCreateVM, CreateVMPayload{VMID: req.Vmid, VMName: req.Vmname, Provision: req.Provision}
+	case OpDeleteVM:
+		typ, payload = TypeDeleteVM, DeleteVMPayload{VMID: req.Vmid, VMName: req.Vmname}
+	default:
+		return nil, fmt.Errorf("%w: legacy opcode %d", ErrUnknownType, req.OpCode)
+	}
+
+	b, _ := json.Marshal(payload)
+	return &Envelope{Version: 0, Type: typ, Payload: b}, nil
+}
@@ -0,0 +1,114 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	ctx := context.WithValue(context.Background(), TraceIDKey, "trace-1")
+	provision := &Provision{ExperimentID: 3, InitScript: "echo hi"}
+	msg := CreateVMMessage(ctx, 7, "vm-a", provision)
+	if msg.Key != "vm-a" {
+		t.Fatalf("key = %q, want vm-a", msg.Key)
+	}
+
+	e, err := Decode([]byte(msg.Value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Version != SchemaVersion || e.Type != TypeCreateVM || e.ID == "" || e.TraceID != "trace-1" || e.Timestamp.IsZero() {
+		t.Fatalf("unexpected envelope %+v", e)
+	}
+	p, err := e.CreateVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.VMID != 7 || p.VMName != "vm-a" || p.Provision == nil || p.Provision.InitScript != "echo hi" {
+		t.Fatalf("unexpected payload %+v", p)
+	}
+	if _, err := e.DeleteVM(); !errors.Is(err, ErrInvalidPayload) {
+		t.Fatalf("DeleteVM on create envelope: %v", err)
+	}
+}
+
+func TestStopStartMessages(t *testing.T) {
+	for _, msg := range []Message{
+		StopVMMessage(context.Background(), 4, "vm-c"),
+		StartVMMessage(context.Background(), 4, "vm-c"),
+	} {
+		e, err := Decode([]byte(msg.Value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var name string
+		switch e.Type {
+		case TypeStopVM:
+			p, err := e.StopVM()
+			if err != nil {
+				t.Fatal(err)
+			}
+			name = p.VMName
+		case TypeStartVM:
+			p, err := e.StartVM()
+			if err != nil {
+				t.Fatal(err)
+			}
+			name = p.VMName
+		}
+		if name != "vm-c" || msg.Key != "vm-c" {
+			t.Fatalf("unexpected message %+v", msg)
+		}
+	}
+}
+
+func TestDecodeLegacy(t *testing.T) {
+	b, _ := json.Marshal(&VMRequest{OpCode: OpDeleteVM, Vmid: 2, Vmname: "vm-b"})
+	e, err := Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Version != 0 || e.Type != TypeDeleteVM {
+		t.Fatalf("unexpected envelope %+v", e)
+	}
+	p, err := e.DeleteVM()
+	if err != nil || p.VMID != 2 || p.VMName != "vm-b" {
+		t.Fatalf("payload %+v, err %v", p, err)
+	}
+
+	if _, err := Decode([]byte(`{"OpCode":9,"Vmname":"x"}`)); !errors.Is(err, ErrUnknownType) {
+		t.Fatalf("unknown legacy opcode: %v", err)
+	}
+}
+
+func TestDecodeCompatibility(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		err   error
+	}{
+		{"unknown fields ignored", `{"version":1,"type":"vm.delete","id":"1","payload":{"vmId":1,"vmName":"a","future":true},"extra":1}`, nil},
+		{"newer version", `{"version":2,"type":"vm.delete","payload":{"vmName":"a"}}`, ErrUnsupportedVersion},
+		{"zero version", `{"version":0,"type":"vm.delete","payload":{"vmName":"a"}}`, ErrUnsupportedVersion},
+		{"unknown type", `{"version":1,"type":"vm.snapshot","payload":{}}`, ErrUnknownType},
+		{"bad json", `{"version":1,`, ErrInvalidPayload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode([]byte(tt.value))
+			if tt.err == nil && err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	e, _ := Decode([]byte(`{"version":1,"type":"vm.create","payload":{"vmId":1}}`))
+	if _, err := e.CreateVM(); !errors.Is(err, ErrInvalidPayload) {
+		t.Fatalf("missing vmName: %v", err)
+	}
+}
@@ -3,10 +3,14 @@ package queue
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
 
 	"github.com/zeromicro/go-queue/kq"
 )
 
+// OpCode 为版本 0 消息的操作码
 type OpCode int
 
 const (
@@ -16,19 +20,112 @@ const (
 
 var kafkaQueue = kq.NewPusher([]string{"localhost:9092"}, "k8s", kq.WithSyncPush())
 
+// Init 按配置重新创建推送器，需在处理请求前调用
+func Init(brokers []string, topic string) {
+	kafkaQueue = kq.NewPusher(brokers, topic, kq.WithSyncPush())
+}
+
+// 实验环境初始化数据总大小上限，需低于 ConfigMap 的 1MiB 限制
+const MaxProvisionSize = 768 << 10
+
+// VMRequest 为版本 0 的消息格式，仅用于解码升级前入队的消息，新消息使用 Envelope
 type VMRequest struct {
 	OpCode
-	Vmid   int
-	Vmname string
+	Vmid      int
+	Vmname    string
+	Provision *Provision `json:",omitempty"`
+}
+
+// Provision 描述创建虚拟机时需要注入的实验文件、初始化脚本和学生变量
+type Provision struct {
+	ExperimentID  int
+	StudentID     int
+	StudentNumber string
+	InitScript    string
+	Files         []ProvisionFile
+	Image         *ImageSpec  `json:",omitempty"` // 为空时使用部署模板中的默认镜像
+	Scheduling    *Scheduling `json:",omitempty"` // 镜像与实验合并后的调度约束
+	Agent         *AgentSpec  `json:",omitempty"` // 虚拟机内进度代理的上报地址
+	Egress        *Egress     `json:",omitempty"` // 为空时不限制出站
+}
+
+// AgentSpec 进度代理使用令牌调用后端的 /agent 接口上报实验步骤完成情况，
+// 令牌由工作节点创建虚拟机时生成，只将哈希随凭据回调上报，不经过消息队列
+type AgentSpec struct {
+	URL string
+}
+
+// ImageSpec 为镜像目录中镜像的运行参数，资源数量格式同 Kubernetes
+type ImageSpec struct {
+	Image          string
+	CPURequest     string `json:",omitempty"`
+	CPULimit       string `json:",omitempty"`
+	MemoryRequest  string `json:",omitempty"`
+	MemoryLimit    string `json:",omitempty"`
+	Ports          []int  `json:",omitempty"` // 第一个为访问端口，为空时为 80
+	AccessProtocol string
+}
+
+// ProvisionFile 为实验附件，URL 为后端 /uploads 下的相对地址
+type ProvisionFile struct {
+	Name string
+	URL  string
+}
+
+// ValidFileName 判断附件名能否直接作为工作目录下的单级文件名
+func ValidFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && name == path.Base(name) && !strings.ContainsAny(name, "\\\x00")
+}
+
+// ValidateFiles 检查附件名有效且互不重复，重名的附件在 ConfigMap 中会相互覆盖
+func (p *Provision) ValidateFiles() error {
+	if p == nil {
+		return nil
+	}
+	seen := make(map[string]bool, len(p.Files))
+	for _, f := range p.Files {
+		if !ValidFileName(f.Name) {
+			return fmt.Errorf("无效的附件名: %q", f.Name)
+		}
+		if seen[f.Name] {
+			return fmt.Errorf("附件重名: %s", f.Name)
+		}
+		seen[f.Name] = true
+	}
+	return nil
+}
+
+// Message 为待推送的消息，由发件箱持久化后再投递
+//
+// Key 为虚拟机名：同一虚拟机的指令落在同一分区并按顺序消费，不同虚拟机可并行处理
+type Message struct {
+	Key   string
+	Value string
+}
+
+func CreateVMMessage(ctx context.Context, vmid int, vmname string, provision *Provision) Message {
+	return newMessage(ctx, vmname, TypeCreateVM, CreateVMPayload{VMID: vmid, VMName: vmname, Provision: provision})
+}
+
+func DeleteVMMessage(ctx context.Context, vmid int, vmname string) Message {
+	return newMessage(ctx, vmname, TypeDeleteVM, DeleteVMPayload{VMID: vmid, VMName: vmname})
 }
 
-func CreateVM(vmid int, vmname string) error {
-	b, _ := json.Marshal(&VMRequest{Vmid: vmid, Vmname: vmname, OpCode: OpCreateVM})
-	return kafkaQueue.KPush(context.TODO(), "k8s", string(b))
+func StopVMMessage(ctx context.Context, vmid int, vmname string) Message {
+	return newMessage(ctx, vmname, TypeStopVM, StopVMPayload{VMID: vmid, VMName: vmname})
 }
 
-func DeleteVM(vmid int, vmname string) error {
-	b, _ := json.Marshal(&VMRequest{Vmid: vmid, Vmname: vmname, OpCode: OpDeleteVM})
-	return kafkaQueue.KPush(context.TODO(), "k8s", string(b))
+func StartVMMessage(ctx context.Context, vmid int, vmname string) Message {
+	return newMessage(ctx, vmname, TypeStartVM, StartVMPayload{VMID: vmid, VMName: vmname})
+}
+
+func newMessage(ctx context.Context, key string, typ MessageType, payload any) Message {
+	e, _ := NewEnvelope(ctx, typ, payload)
+	b, _ := json.Marshal(e)
+	return Message{Key: key, Value: string(b)}
+}
 
+// Push 同步推送一条消息
+func Push(ctx context.Context, msg Message) error {
+	return kafkaQueue.KPush(ctx, msg.Key, msg.Value)
 }
@@ -2,6 +2,25 @@ package queue
 
 import "testing"
 
-func TestQueue(t *testing.T) {
-	t.Log(CreateVM(1, "aaaa"))
+func TestProvisionValidateFiles(t *testing.T) {
+	ok := &Provision{Files: []ProvisionFile{{Name: "main.c"}, {Name: ".bashrc"}}}
+	if err := ok.ValidateFiles(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := (*Provision)(nil).ValidateFiles(); err != nil {
+		t.Errorf("nil provision: unexpected error: %v", err)
+	}
+
+	for name, files := range map[string][]ProvisionFile{
+		"dot":       {{Name: "."}},
+		"dot dot":   {{Name: ".."}},
+		"empty":     {{Name: ""}},
+		"nested":    {{Name: "a/b"}},
+		"backslash": {{Name: `a\b`}},
+		"duplicate": {{Name: "main.c"}, {Name: "main.c"}},
+	} {
+		if err := (&Provision{Files: files}).ValidateFiles(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
 }
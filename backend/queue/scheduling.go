@@ -0,0 +1,147 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// Scheduling 为虚拟机 Pod 的调度约束，字段与 Kubernetes PodSpec 同名同格式，
+// Affinity 为 Kubernetes Affinity 对象的 JSON，保存时按 AffinitySpec 校验
+type Scheduling struct {
+	NodeSelector      map[string]string `json:"nodeSelector,omitempty"`
+	Affinity          json.RawMessage   `json:"affinity,omitempty"`
+	Tolerations       []Toleration      `json:"tolerations,omitempty"`
+	PriorityClassName string            `json:"priorityClassName,omitempty"`
+}
+
+type Toleration struct {
+	Key               string `json:"key,omitempty"`
+	Operator          string `json:"operator,omitempty"`
+	Value             string `json:"value,omitempty"`
+	Effect            string `json:"effect,omitempty"`
+	TolerationSeconds *int64 `json:"tolerationSeconds,omitempty"`
+}
+
+var (
+	// 标签键可带 DNS 子域名前缀，如 node.example.com/pool
+	labelKeyPattern   = regexp.MustCompile(`^([a-z0-9]([-a-z0-9.]*[a-z0-9])?/)?[A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?$`)
+	labelValuePattern = regexp.MustCompile(`^([A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?)?$`)
+	dnsNamePattern    = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]{0,251}[a-z0-9])?$`)
+)
+
+// IsZero 判断是否未设置任何约束
+func (s *Scheduling) IsZero() bool {
+	return s == nil || (len(s.NodeSelector) == 0 && len(s.Affinity) == 0 && len(s.Tolerations) == 0 && s.PriorityClassName == "")
+}
+
+// Validate 校验调度约束的格式，是否存在对应节点或 PriorityClass 由集群判断
+func (s *Scheduling) Validate() error {
+	if s == nil {
+		return nil
+	}
+	for k, v := range s.NodeSelector {
+		if !labelKeyPattern.MatchString(k) || len(k) > 253 {
+			return fmt.Errorf("无效的节点标签键: %s", k)
+		}
+		if !labelValuePattern.MatchString(v) {
+			return fmt.Errorf("无效的节点标签值: %s", v)
+		}
+	}
+
+	if _, err := s.AffinitySpec(); err != nil {
+		return err
+	}
+
+	if len(s.Tolerations) > 20 {
+		return errors.New("tolerations 最多 20 项")
+	}
+	for _, t := range s.Tolerations {
+		if t.Key != "" && !labelKeyPattern.MatchString(t.Key) {
+			return fmt.Errorf("无效的容忍键: %s", t.Key)
+		}
+		switch t.Operator {
+		case "", "Equal":
+			if t.Key == "" {
+				return errors.New("operator 为 Equal 时 key 不能为空")
+			}
+		case "Exists":
+			if t.Value != "" {
+				return errors.New("operator 为 Exists 时 value 必须为空")
+			}
+		default:
+			return fmt.Errorf("无效的 operator: %s", t.Operator)
+		}
+		switch t.Effect {
+		case "", "NoSchedule", "PreferNoSchedule", "NoExecute":
+		default:
+			return fmt.Errorf("无效的 effect: %s", t.Effect)
+		}
+		if t.TolerationSeconds != nil && t.Effect != "NoExecute" {
+			return errors.New("tolerationSeconds 仅适用于 NoExecute")
+		}
+	}
+
+	if name := s.PriorityClassName; name != "" {
+		if !dnsNamePattern.MatchString(name) {
+			return fmt.Errorf("无效的 priorityClassName: %s", name)
+		}
+		// 系统保留的优先级只用于集群组件
+		if strings.HasPrefix(name, "system-") {
+			return fmt.Errorf("不允许使用系统优先级: %s", name)
+		}
+	}
+	return nil
+}
+
+// AffinitySpec 按 Kubernetes Affinity 类型解析亲和性并拒绝未知字段，
+// 保存时与工作节点创建 Pod 时使用同一解析，拼错的约束在保存时即报错
+func (s *Scheduling) AffinitySpec() (*apiv1.Affinity, error) {
+	if s == nil || len(s.Affinity) == 0 {
+		return nil, nil
+	}
+	var affinity apiv1.Affinity
+	dec := json.NewDecoder(bytes.NewReader(s.Affinity))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&affinity); err != nil {
+		return nil, fmt.Errorf("无效的 affinity: %v", err)
+	}
+	if dec.More() {
+		return nil, errors.New("affinity 必须为单个 JSON 对象")
+	}
+	return &affinity, nil
+}
+
+// MergeScheduling 以镜像的约束为基础叠加实验的约束：节点标签按键覆盖，容忍合并，
+// 亲和性和优先级以实验的设置为准
+func MergeScheduling(base, override *Scheduling) *Scheduling {
+	if base.IsZero() && override.IsZero() {
+		return nil
+	}
+	out := &Scheduling{}
+	for _, s := range []*Scheduling{base, override} {
+		if s == nil {
+			continue
+		}
+		if len(s.NodeSelector) > 0 {
+			if out.NodeSelector == nil {
+				out.NodeSelector = map[string]string{}
+			}
+			maps.Copy(out.NodeSelector, s.NodeSelector)
+		}
+		if len(s.Affinity) > 0 {
+			out.Affinity = s.Affinity
+		}
+		out.Tolerations = append(out.Tolerations, s.Tolerations...)
+		if s.PriorityClassName != "" {
+			out.PriorityClassName = s.PriorityClassName
+		}
+	}
+	return out
+}
@@ -0,0 +1,65 @@
+package queue
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSchedulingValidate(t *testing.T) {
+	seconds := int64(60)
+	valid := &Scheduling{
+		NodeSelector: map[string]string{"node.example.com/pool": "exam"},
+		Affinity:     json.RawMessage(`{"nodeAffinity":{}}`),
+		Tolerations: []Toleration{
+			{Key: "dedicated", Operator: "Equal", Value: "exam", Effect: "NoSchedule"},
+			{Operator: "Exists", Effect: "NoExecute", TolerationSeconds: &seconds},
+		},
+		PriorityClassName: "lab-exam",
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for name, s := range map[string]*Scheduling{
+		"bad selector key":  {NodeSelector: map[string]string{"-bad": "x"}},
+		"affinity array":    {Affinity: json.RawMessage(`[]`)},
+		"affinity typo":     {Affinity: json.RawMessage(`{"nodeAfinity":{}}`)},
+		"affinity bad type": {Affinity: json.RawMessage(`{"nodeAffinity":{"requiredDuringSchedulingIgnoredDuringExecution":[]}}`)},
+		"equal without key": {Tolerations: []Toleration{{Operator: "Equal", Value: "x"}}},
+		"exists with value": {Tolerations: []Toleration{{Key: "k", Operator: "Exists", Value: "x"}}},
+		"bad effect":        {Tolerations: []Toleration{{Key: "k", Effect: "Never"}}},
+		"seconds no exec":   {Tolerations: []Toleration{{Key: "k", Effect: "NoSchedule", TolerationSeconds: &seconds}}},
+		"system priority":   {PriorityClassName: "system-node-critical"},
+	} {
+		if err := s.Validate(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestMergeScheduling(t *testing.T) {
+	if MergeScheduling(nil, &Scheduling{}) != nil {
+		t.Fatal("empty merge should be nil")
+	}
+
+	image := &Scheduling{
+		NodeSelector:      map[string]string{"size": "large", "zone": "a"},
+		Tolerations:       []Toleration{{Key: "gpu", Operator: "Exists"}},
+		PriorityClassName: "lab-practice",
+	}
+	experiment := &Scheduling{
+		NodeSelector:      map[string]string{"zone": "exam"},
+		Tolerations:       []Toleration{{Key: "dedicated", Value: "exam"}},
+		PriorityClassName: "lab-exam",
+	}
+	got := MergeScheduling(image, experiment)
+	if got.NodeSelector["size"] != "large" || got.NodeSelector["zone"] != "exam" {
+		t.Errorf("node selector = %v", got.NodeSelector)
+	}
+	if len(got.Tolerations) != 2 || got.PriorityClassName != "lab-exam" {
+		t.Errorf("merged = %+v", got)
+	}
+	if image.NodeSelector["zone"] != "a" {
+		t.Error("merge must not modify its inputs")
+	}
+}
@@ -0,0 +1,76 @@
+package sheet
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestColumnName(t *testing.T) {
+	for i, want := range map[int]string{0: "A", 25: "Z", 26: "AA", 51: "AZ", 52: "BA", 701: "ZZ", 702: "AAA"} {
+		if got := columnName(i); got != want {
+			t.Errorf("columnName(%d) = %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, [][]Cell{{"学号", "成绩"}, {"2023001", 92.5}, {"2023002", nil}}); err != nil {
+		t.Fatal(err)
+	}
+	want := "\ufeff学号,成绩\n2023001,92.5\n2023002,\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := WriteCSV(&buf, [][]Cell{{"=HYPERLINK(\"http://x\")", "+1", "-1", "@SUM(A1)", -3.5, "a=b"}}); err != nil {
+		t.Fatal(err)
+	}
+	want = "\ufeff\"'=HYPERLINK(\"\"http://x\"\")\",'+1,'-1,'@SUM(A1),-3.5,a=b\n"
+	if buf.String() != want {
+		t.Errorf("formula cells: got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestWriteXLSX(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteXLSX(&buf, "成绩/期末", [][]Cell{{"学号", "成绩"}, {"a<b", 88}}); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		files[f.Name] = string(b)
+	}
+	if !strings.Contains(files["xl/workbook.xml"], `name="成绩_期末"`) {
+		t.Errorf("sheet name not sanitized: %s", files["xl/workbook.xml"])
+	}
+	sheet := files["xl/worksheets/sheet1.xml"]
+	for _, want := range []string{`<c r="B2"><v>88</v></c>`, `<t xml:space="preserve">a&lt;b</t>`} {
+		if !strings.Contains(sheet, want) {
+			t.Errorf("worksheet missing %s: %s", want, sheet)
+		}
+	}
+}
+
+func TestReadCSV(t *testing.T) {
+	records, err := ReadCSV(strings.NewReader("\ufeff学号, 成绩\n2023001,92.5,缺交实验报告\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0][0] != "学号" || records[0][1] != "成绩" || len(records[1]) != 3 {
+		t.Errorf("unexpected records: %q", records)
+	}
+}
@@ -0,0 +1,110 @@
+package worker
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+)
+
+// 工作节点上报虚拟机访问凭据的后端接口
+const CredentialsCallbackPath = "/vm-credentials-callback"
+
+// Credentials 为工作节点为每台虚拟机生成的访问凭据，只在后端和工作节点之间以密文传输
+type Credentials struct {
+	VNCPassword   string `json:"vncPassword"`
+	SSHUser       string `json:"sshUser,omitempty"`
+	SSHPrivateKey string `json:"sshPrivateKey,omitempty"`
+	SSHPublicKey  string `json:"sshPublicKey,omitempty"`
+}
+
+type CredentialsCallback struct {
+	VMName string `json:"vmName" binding:"required"`
+	Sealed string `json:"sealed" binding:"required"`
+	// 工作节点生成的进度代理令牌的哈希，令牌本身只保存在集群内
+	AgentTokenHash string `json:"agentTokenHash,omitempty" binding:"omitempty,len=64,hexadecimal"`
+}
+
+var (
+	ErrInvalidCredentials = errors.New("invalid sealed credentials")
+	// 未配置共享密钥时加密密钥可由公开常量推出，拒绝加解密
+	ErrNoSecret = errors.New("worker secret is not configured")
+)
+
+// NewAgentToken 生成进度代理令牌，返回令牌及其哈希。令牌由工作节点生成并注入虚拟机，
+// 只有哈希上报给后端，消息队列和数据库中都不会出现令牌明文
+func NewAgentToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(b)
+	return token, HashAgentToken(token), nil
+}
+
+func HashAgentToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// credentialKey 由共享密钥派生加密密钥，与请求认证使用的密钥区分用途
+func credentialKey(secret string) []byte {
+	sum := sha256.Sum256([]byte("virtuallabs-credentials\x00" + secret))
+	return sum[:]
+}
+
+// SealCredentials 使用 AES-GCM 加密凭据，虚拟机名作为附加数据，密文不能挪用到其他虚拟机
+func SealCredentials(secret, vmName string, c *Credentials) (string, error) {
+	plain, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(secret)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, []byte(vmName))), nil
+}
+
+// OpenCredentials 解密 SealCredentials 生成的密文
+func OpenCredentials(secret, vmName, sealed string) (*Credentials, error) {
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	aead, err := newAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < aead.NonceSize() {
+		return nil, ErrInvalidCredentials
+	}
+	plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(vmName))
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	var c Credentials
+	if err := json.Unmarshal(plain, &c); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return &c, nil
+}
+
+func newAEAD(secret string) (cipher.AEAD, error) {
+	if secret == "" {
+		return nil, ErrNoSecret
+	}
+	block, err := aes.NewCipher(credentialKey(secret))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
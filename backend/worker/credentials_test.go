@@ -0,0 +1,39 @@
+package worker
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSealCredentials(t *testing.T) {
+	creds := &Credentials{VNCPassword: "pa55word", SSHUser: "root", SSHPublicKey: "ssh-ed25519 AAAA"}
+	sealed, err := SealCredentials("secret", "vm-a", creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := OpenCredentials("secret", "vm-a", sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *creds {
+		t.Fatalf("got %+v, want %+v", got, creds)
+	}
+
+	if _, err := OpenCredentials("other", "vm-a", sealed); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong secret: %v", err)
+	}
+	if _, err := OpenCredentials("secret", "vm-b", sealed); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("sealed for another vm: %v", err)
+	}
+	if _, err := OpenCredentials("secret", "vm-a", "not base64!"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("garbage: %v", err)
+	}
+
+	if _, err := SealCredentials("", "vm-a", creds); !errors.Is(err, ErrNoSecret) {
+		t.Errorf("seal without secret: %v", err)
+	}
+	if _, err := OpenCredentials("", "vm-a", sealed); !errors.Is(err, ErrNoSecret) {
+		t.Errorf("open without secret: %v", err)
+	}
+}
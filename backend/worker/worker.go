@@ -0,0 +1,224 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/queue"
+)
+
+var (
+	// k8s 工作节点对外提供的管理接口地址
+	Addr = "http://127.0.0.1:8889"
+	// 后端与工作节点互相调用时携带的共享密钥，为空时不校验
+	Secret string
+)
+
+// 携带共享密钥的请求头
+const SecretHeader = "X-Worker-Secret"
+
+// 文件传输限制，后端与工作节点共用
+const (
+	WorkspaceDir    = "/root/workspace"
+	MaxUploadSize   = 100 << 20
+	MaxDownloadSize = 200 << 20
+)
+
+// 日志查询参数，后端与工作节点共用
+type LogOptions struct {
+	TailLines int64 `form:"tailLines" binding:"omitempty,min=1,max=10000"`
+	Follow    bool  `form:"follow"`
+	Previous  bool  `form:"previous"`
+}
+
+// Values 将参数编码为查询字符串
+func (o LogOptions) Values() url.Values {
+	v := url.Values{}
+	if o.TailLines > 0 {
+		v.Set("tailLines", strconv.FormatInt(o.TailLines, 10))
+	}
+	if o.Follow {
+		v.Set("follow", "true")
+	}
+	if o.Previous {
+		v.Set("previous", "true")
+	}
+	return v
+}
+
+// ParseLogOptions 从查询字符串解析日志参数
+func ParseLogOptions(v url.Values) (LogOptions, error) {
+	var o LogOptions
+	var err error
+	if s := v.Get("tailLines"); s != "" {
+		if o.TailLines, err = strconv.ParseInt(s, 10, 64); err != nil || o.TailLines <= 0 {
+			return o, fmt.Errorf("无效的 tailLines: %s", s)
+		}
+	}
+	if s := v.Get("follow"); s != "" {
+		if o.Follow, err = strconv.ParseBool(s); err != nil {
+			return o, fmt.Errorf("无效的 follow: %s", s)
+		}
+	}
+	if s := v.Get("previous"); s != "" {
+		if o.Previous, err = strconv.ParseBool(s); err != nil {
+			return o, fmt.Errorf("无效的 previous: %s", s)
+		}
+	}
+	return o, nil
+}
+
+// PodLogs 向工作节点请求虚拟机容器日志，调用方负责关闭响应体
+func PodLogs(ctx context.Context, vmName string, opts LogOptions) (*http.Response, error) {
+	u := fmt.Sprintf("%s/vms/%s/logs?%s", Addr, url.PathEscape(vmName), opts.Values().Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return do(req)
+}
+
+// 文件传输参数，Path 为相对工作目录的路径
+type FileOptions struct {
+	Path    string `form:"path"`
+	Name    string `form:"-"`
+	Archive bool   `form:"archive"`
+}
+
+// Values 将参数编码为查询字符串
+func (o FileOptions) Values() url.Values {
+	v := url.Values{}
+	v.Set("path", o.Path)
+	if o.Name != "" {
+		v.Set("name", o.Name)
+	}
+	if o.Archive {
+		v.Set("archive", "true")
+	}
+	return v
+}
+
+// ParseFileOptions 从查询字符串解析文件传输参数
+func ParseFileOptions(v url.Values) (FileOptions, error) {
+	o := FileOptions{Path: v.Get("path"), Name: v.Get("name")}
+	if s := v.Get("archive"); s != "" {
+		var err error
+		if o.Archive, err = strconv.ParseBool(s); err != nil {
+			return o, fmt.Errorf("无效的 archive: %s", s)
+		}
+	}
+	return o, nil
+}
+
+// WorkspacePath 将相对路径解析为工作目录内的绝对路径，".." 无法越出工作目录
+func WorkspacePath(p string) string {
+	return path.Join(WorkspaceDir, path.Clean("/"+p))
+}
+
+// DownloadFile 从虚拟机下载文件，Archive 为 true 时返回 tar 归档
+func DownloadFile(ctx context.Context, vmName string, opts FileOptions) (*http.Response, error) {
+	u := fmt.Sprintf("%s/vms/%s/files?%s", Addr, url.PathEscape(vmName), opts.Values().Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return do(req)
+}
+
+// UploadFile 向虚拟机上传单个文件或 tar 归档（Archive 为 true 时解包到 Path）
+func UploadFile(ctx context.Context, vmName string, opts FileOptions, body io.Reader, size int64) (*http.Response, error) {
+	u := fmt.Sprintf("%s/vms/%s/files?%s", Addr, url.PathEscape(vmName), opts.Values().Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return do(req)
+}
+
+// 工作节点拉取预热池配置的后端接口
+const WarmPoolsPath = "/worker/warm-pools"
+
+// 工作节点核对已领取的预热虚拟机是否有对应虚拟机记录的后端接口
+const ClaimedVMsPath = "/worker/claimed-vms"
+
+// ClaimedVM 为已领取的预热虚拟机及领取时携带的虚拟机记录 ID
+type ClaimedVM struct {
+	VMID   int    `json:"vmId"`
+	VMName string `json:"vmName"`
+}
+
+// ErrNoWarmVM 表示预热池中没有就绪的空闲虚拟机
+var ErrNoWarmVM = errors.New("no warm vm available")
+
+// WarmPool 为单个实验的预热池配置，Provision 只包含实验级别的附件和初始化脚本
+type WarmPool struct {
+	ExperimentID int              `json:"experimentId"`
+	Size         int              `json:"size"`
+	Provision    *queue.Provision `json:"provision"`
+}
+
+// ClaimRequest 领取预热虚拟机，VMID 用于分配访问端口
+type ClaimRequest struct {
+	ExperimentID  int    `json:"experimentId"`
+	VMID          int    `json:"vmId"`
+	StudentID     int    `json:"studentId"`
+	StudentNumber string `json:"studentNumber"`
+
+	Agent *queue.AgentSpec `json:"agent,omitempty"` // 领取后写入虚拟机的进度代理地址，令牌由工作节点生成
+}
+
+// ClaimResponse 中的 Credentials 为 SealCredentials 加密后的访问凭据
+type ClaimResponse struct {
+	VMName      string `json:"vmName"`
+	Credentials string `json:"credentials,omitempty"`
+	// 领取时观察到的虚拟机状态，取值同状态回调
+	Status string `json:"status"`
+	// 领取时生成的进度代理令牌的哈希
+	AgentTokenHash string `json:"agentTokenHash,omitempty"`
+}
+
+// ClaimWarmVM 从预热池领取一台就绪的虚拟机，池为空时返回 ErrNoWarmVM
+func ClaimWarmVM(ctx context.Context, claim ClaimRequest) (*ClaimResponse, error) {
+	b, _ := json.Marshal(&claim)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, Addr+"/pool/claim", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrNoWarmVM
+	default:
+		return nil, fmt.Errorf("claim warm vm: unexpected status %s", resp.Status)
+	}
+
+	var out ClaimResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func do(req *http.Request) (*http.Response, error) {
+	if Secret != "" {
+		req.Header.Set(SecretHeader, Secret)
+	}
+	return http.DefaultClient.Do(req)
+}
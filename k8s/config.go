@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zeromicro/go-queue/kq"
+	"github.com/zeromicro/go-zero/core/conf"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Config 工作节点配置，优先级：命令行参数 > 环境变量 > 配置文件 > 默认值
+type Config struct {
+	// 只使用其中的连接和消费者组设置，消息由单协程拉取后分发，并发由 Concurrency 控制
+	kq.KqConf
+
+	// 为空时在集群内使用 ServiceAccount，集群外使用 KUBECONFIG 或 ~/.kube/config
+	Kubeconfig string `json:",optional,env=WORKER_KUBECONFIG"`
+	Namespace  string `json:",default=default,env=WORKER_NAMESPACE"`
+	Template   string `json:",default=k8sdeploy.yml.tmpl,env=WORKER_TEMPLATE"`
+	BackendURL string `json:",default=http://127.0.0.1:8888,env=WORKER_BACKEND_URL"`
+	ListenAddr string `json:",default=127.0.0.1:8889,env=WORKER_LISTEN_ADDR"`
+	// 与后端互相调用时校验的共享密钥，需与后端 Worker.Secret 一致，同时用于加密访问凭据，必填
+	Secret string `json:",optional,env=WORKER_SECRET"`
+
+	// 无法解析或版本不受支持的消息转入该主题，不会被静默丢弃
+	DeadLetterTopic string `json:",default=k8s-dead,env=WORKER_DEAD_LETTER_TOPIC"`
+
+	// 同时处理的虚拟机指令数上限，避免整班同时开机时压垮 API Server
+	Concurrency int `json:",default=8,env=WORKER_CONCURRENCY"`
+	// 每个工作协程排队的指令数，排满后暂停拉取消息
+	Backlog int `json:",default=64,env=WORKER_BACKLOG"`
+
+	// 从后端拉取预热池配置并补齐的周期
+	WarmPoolInterval time.Duration `json:",default=30s,env=WORKER_WARM_POOL_INTERVAL"`
+}
+
+func loadConfig() Config {
+	configFile := flag.String("f", envOr("WORKER_CONFIG", "kq.yml"), "the config file")
+	kubeconfig := flag.String("kubeconfig", "", "kubeconfig path, empty for in-cluster or default loading rules")
+	namespace := flag.String("namespace", "", "namespace for lab deployments")
+	tmpl := flag.String("template", "", "deployment template path")
+	backendURL := flag.String("backend", "", "backend base url for callbacks and lab files")
+	listenAddr := flag.String("listen", "", "listen address of the worker api")
+	flag.Parse()
+
+	var c Config
+	conf.MustLoad(*configFile, &c)
+
+	// 只覆盖显式传入的参数
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "kubeconfig":
+			c.Kubeconfig = *kubeconfig
+		case "namespace":
+			c.Namespace = *namespace
+		case "template":
+			c.Template = *tmpl
+		case "backend":
+			c.BackendURL = *backendURL
+		case "listen":
+			c.ListenAddr = *listenAddr
+		}
+	})
+
+	if err := c.Validate(); err != nil {
+		log.Fatalf("invalid config %s: %v", *configFile, err)
+	}
+	return c
+}
+
+// Validate 在启动时检查配置，尽早给出明确的错误
+func (c *Config) Validate() error {
+	if len(c.Brokers) == 0 {
+		return errors.New("Brokers is empty")
+	}
+	if c.Topic == "" || c.Group == "" {
+		return errors.New("Topic and Group are required")
+	}
+	if c.Secret == "" {
+		return errors.New("Secret is required to seal VM access credentials")
+	}
+	if c.DeadLetterTopic == "" || c.DeadLetterTopic == c.Topic {
+		return errors.New("DeadLetterTopic is required and must differ from Topic")
+	}
+
+	if c.Concurrency < 1 || c.Backlog < 1 {
+		return errors.New("Concurrency and Backlog must be positive")
+	}
+	if c.WarmPoolInterval <= 0 {
+		return errors.New("WarmPoolInterval must be positive")
+	}
+
+	if errs := validation.IsDNS1123Label(c.Namespace); len(errs) > 0 {
+		return fmt.Errorf("Namespace %q: %s", c.Namespace, strings.Join(errs, "; "))
+	}
+
+	if _, err := os.Stat(c.Template); err != nil {
+		return fmt.Errorf("Template: %w", err)
+	}
+
+	u, err := url.Parse(c.BackendURL)
+	if err != nil {
+		return fmt.Errorf("BackendURL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("BackendURL %q must be an absolute http(s) url", c.BackendURL)
+	}
+	c.BackendURL = strings.TrimRight(c.BackendURL, "/")
+
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		return fmt.Errorf("ListenAddr: %w", err)
+	}
+
+	if c.Kubeconfig != "" {
+		if _, err := os.Stat(c.Kubeconfig); err != nil {
+			return fmt.Errorf("Kubeconfig: %w", err)
+		}
+	}
+	return nil
+}
+
+// restConfigFor 按配置选择集群认证方式
+func restConfigFor(c Config) (*rest.Config, error) {
+	if c.Kubeconfig != "" {
+		return clientcmd.BuildConfigFromFlags("", c.Kubeconfig)
+	}
+
+	// 以 Pod 形式运行时使用挂载的 ServiceAccount
+	cfg, err := rest.InClusterConfig()
+	if err == nil {
+		return cfg, nil
+	}
+	if !errors.Is(err, rest.ErrNotInCluster) {
+		return nil, fmt.Errorf("in-cluster config: %w", err)
+	}
+
+	cfg, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{},
+	).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("not running in cluster and no usable kubeconfig: %w", err)
+	}
+	return cfg, nil
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/queue"
+	"github.com/MeteorsLiu/virtuallabs/backend/worker"
+	"golang.org/x/crypto/ssh"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	credentialsVolume = "credentials"
+	credentialsMount  = "/run/lab-credentials"
+
+	vncPasswordKey       = "vnc-password"
+	sshPrivateKeyKey     = "ssh-private-key"
+	sshAuthorizedKeysKey = "ssh-authorized-keys"
+	agentTokenKey        = "agent-token"
+
+	sshPort = 22
+	sshUser = "root"
+
+	// VNC 认证只使用密码的前 8 个字符，更长的密码没有意义
+	vncPasswordLength = 8
+	passwordAlphabet  = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+func credentialsSecretName(vmName string) string {
+	return vmName + "-credentials"
+}
+
+// wantsSSH 镜像开放 22 端口时才生成 SSH 密钥
+func wantsSSH(p *queue.Provision) bool {
+	if p == nil || p.Image == nil {
+		return false
+	}
+	for _, port := range p.Image.Ports {
+		if port == sshPort {
+			return true
+		}
+	}
+	return false
+}
+
+func randomPassword(n int) (string, error) {
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(passwordAlphabet)))
+	for i := range b {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = passwordAlphabet[idx.Int64()]
+	}
+	return string(b), nil
+}
+
+// generateCredentials 生成随机 VNC 密码，按需生成 ed25519 SSH 密钥对
+func generateCredentials(withSSH bool) (*worker.Credentials, error) {
+	password, err := randomPassword(vncPasswordLength)
+	if err != nil {
+		return nil, err
+	}
+	creds := &worker.Credentials{VNCPassword: password}
+	if !withSSH {
+		return creds, nil
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		return nil, err
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	creds.SSHUser = sshUser
+	creds.SSHPrivateKey = string(pem.EncodeToMemory(block))
+	creds.SSHPublicKey = string(ssh.MarshalAuthorizedKey(sshPub))
+	return creds, nil
+}
+
+// applyCredentials 通过 Secret 注入 VNC 密码和进度代理令牌，并只读挂载 authorized_keys，私钥不进入容器
+func applyCredentials(deployment *appsv1.Deployment, withSSH, withAgent bool) {
+	spec := &deployment.Spec.Template.Spec
+	main := &spec.Containers[0]
+	name := credentialsSecretName(deployment.Name)
+
+	secretEnv := func(env, key string) apiv1.EnvVar {
+		return apiv1.EnvVar{
+			Name: env,
+			ValueFrom: &apiv1.EnvVarSource{SecretKeyRef: &apiv1.SecretKeySelector{
+				LocalObjectReference: apiv1.LocalObjectReference{Name: name},
+				Key:                  key,
+			}},
+		}
+	}
+	main.Env = append(main.Env, secretEnv("VNC_PASSWORD", vncPasswordKey))
+	if withAgent {
+		main.Env = append(main.Env, secretEnv("LAB_AGENT_TOKEN", agentTokenKey))
+	}
+	if !withSSH {
+		return
+	}
+
+	mode := int32(0o400)
+	spec.Volumes = append(spec.Volumes, apiv1.Volume{
+		Name: credentialsVolume,
+		VolumeSource: apiv1.VolumeSource{Secret: &apiv1.SecretVolumeSource{
+			SecretName:  name,
+			Items:       []apiv1.KeyToPath{{Key: sshAuthorizedKeysKey, Path: "authorized_keys"}},
+			DefaultMode: &mode,
+		}},
+	})
+	main.VolumeMounts = append(main.VolumeMounts, apiv1.VolumeMount{Name: credentialsVolume, MountPath: credentialsMount, ReadOnly: true})
+	main.Env = append(main.Env, apiv1.EnvVar{Name: "LAB_SSH_AUTHORIZED_KEYS", Value: credentialsMount + "/authorized_keys"})
+}
+
+// createCredentialsSecret 保存凭据，属主为 Deployment 以便随之回收
+func createCredentialsSecret(ctx context.Context, deployment *appsv1.Deployment, creds *worker.Credentials, agentToken string) error {
+	data := map[string][]byte{vncPasswordKey: []byte(creds.VNCPassword)}
+	if agentToken != "" {
+		data[agentTokenKey] = []byte(agentToken)
+	}
+	if creds.SSHPrivateKey != "" {
+		data[sshPrivateKeyKey] = []byte(creds.SSHPrivateKey)
+		data[sshAuthorizedKeysKey] = []byte(creds.SSHPublicKey)
+	}
+
+	_, err := secretClient.Create(ctx, &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   credentialsSecretName(deployment.Name),
+			Labels: map[string]string{"app": deployment.Name},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       deployment.Name,
+				UID:        deployment.UID,
+			}},
+		},
+		Type: apiv1.SecretTypeOpaque,
+		Data: data,
+	}, metav1.CreateOptions{})
+	return err
+}
+
+// ensureCredentialsSecret 保存凭据，Secret 已存在时改为返回其中保存的凭据和进度代理令牌，
+// 保证重复的创建指令上报的凭据与虚拟机实际使用的一致
+func ensureCredentialsSecret(ctx context.Context, deployment *appsv1.Deployment, creds *worker.Credentials, agentToken string) (*worker.Credentials, string, error) {
+	err := createCredentialsSecret(ctx, deployment, creds, agentToken)
+	if apierrors.IsAlreadyExists(err) {
+		return loadCredentials(ctx, deployment.Name)
+	}
+	return creds, agentToken, err
+}
+
+// loadCredentials 从 Secret 读取虚拟机的凭据和进度代理令牌
+func loadCredentials(ctx context.Context, vmName string) (*worker.Credentials, string, error) {
+	s, err := secretClient.Get(ctx, credentialsSecretName(vmName), metav1.GetOptions{})
+	if err != nil {
+		return nil, "", err
+	}
+	creds := &worker.Credentials{VNCPassword: string(s.Data[vncPasswordKey])}
+	if key, ok := s.Data[sshPrivateKeyKey]; ok {
+		creds.SSHUser = sshUser
+		creds.SSHPrivateKey = string(key)
+		creds.SSHPublicKey = string(s.Data[sshAuthorizedKeysKey])
+	}
+	return creds, string(s.Data[agentTokenKey]), nil
+}
+
+// reportCredentials 将加密后的凭据和进度代理令牌的哈希上报给后端
+func reportCredentials(ctx context.Context, vmName string, creds *worker.Credentials, agentToken string) error {
+	sealed, err := worker.SealCredentials(secret, vmName, creds)
+	if err != nil {
+		return err
+	}
+	callback := worker.CredentialsCallback{VMName: vmName, Sealed: sealed}
+	if agentToken != "" {
+		callback.AgentTokenHash = worker.HashAgentToken(agentToken)
+	}
+	b, _ := json.Marshal(callback)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, backendAddr+worker.CredentialsCallbackPath, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		req.Header.Set(worker.SecretHeader, secret)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("report credentials: unexpected status %s: %s", resp.Status, msg)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// 指令执行失败后的重试间隔，重试用尽后转入死信队列
+var retryDelays = []time.Duration{time.Second, 5 * time.Second, 15 * time.Second}
+
+// job 一条虚拟机指令及其来源消息，执行结束（成功或转入死信队列）后才提交该消息的位移
+type job struct {
+	msg  kafka.Message
+	name string
+	run  func() error
+}
+
+// dispatcher 按虚拟机名把指令分配到固定的工作协程：
+// 同一虚拟机的指令按到达顺序串行执行，不同虚拟机之间并行处理，
+// 工作协程数即同时访问 API Server 的指令数上限
+type dispatcher struct {
+	shards []chan job
+	wg     sync.WaitGroup
+}
+
+func newDispatcher(concurrency, backlog int) *dispatcher {
+	d := &dispatcher{shards: make([]chan job, concurrency)}
+	for i := range d.shards {
+		ch := make(chan job, backlog)
+		d.shards[i] = ch
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for j := range ch {
+				d.execute(j)
+			}
+		}()
+	}
+	return d
+}
+
+// Dispatch 将任务放入 key 对应的队列，队列已满时阻塞，从而减缓消息拉取
+func (d *dispatcher) Dispatch(key string, j job) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	d.shards[h.Sum32()%uint32(len(d.shards))] <- j
+}
+
+// execute 执行指令并按 retryDelays 重试，仍然失败时转入死信队列，最后标记消息已处理
+func (d *dispatcher) execute(j job) {
+	log.Print(j.name)
+	err := j.run()
+	for _, delay := range retryDelays {
+		if err == nil {
+			break
+		}
+		log.Printf("%s failed, retry in %s: %v", j.name, delay, err)
+		time.Sleep(delay)
+		err = j.run()
+	}
+	if err != nil {
+		log.Printf("%s failed after %d retries: %v", j.name, len(retryDelays), err)
+		deadLetter(string(j.msg.Key), string(j.msg.Value))
+	}
+	offsets.Done(j.msg)
+}
+
+// Close 等待已分配的任务全部执行完毕
+func (d *dispatcher) Close() {
+	for _, ch := range d.shards {
+		close(ch)
+	}
+	d.wg.Wait()
+}
+
+// offsetTracker 按分区记录已拉取但未处理完的消息，只提交连续处理完的最大位移，
+// 避免排在后面的指令先完成时把前面尚未执行的指令一并提交
+type offsetTracker struct {
+	reader  *kafka.Reader
+	mu      sync.Mutex
+	pending map[int][]*trackedMessage
+}
+
+type trackedMessage struct {
+	msg  kafka.Message
+	done bool
+}
+
+func newOffsetTracker(reader *kafka.Reader) *offsetTracker {
+	return &offsetTracker{reader: reader, pending: make(map[int][]*trackedMessage)}
+}
+
+// Track 在分发前登记消息，同一分区的消息按拉取顺序登记
+func (t *offsetTracker) Track(msg kafka.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[msg.Partition] = append(t.pending[msg.Partition], &trackedMessage{msg: msg})
+}
+
+// Done 标记消息已处理，并提交该分区开头连续处理完的消息
+func (t *offsetTracker) Done(msg kafka.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	queue := t.pending[msg.Partition]
+	for _, m := range queue {
+		if m.msg.Offset == msg.Offset {
+			m.done = true
+			break
+		}
+	}
+
+	var last *kafka.Message
+	for len(queue) > 0 && queue[0].done {
+		last = &queue[0].msg
+		queue = queue[1:]
+	}
+	t.pending[msg.Partition] = queue
+	if last == nil {
+		return
+	}
+	// 持锁同步提交，保证同一分区的位移只会前进
+	if err := t.reader.CommitMessages(context.Background(), *last); err != nil {
+		log.Printf("commit partition %d offset %d: %v", last.Partition, last.Offset, err)
+	}
+}
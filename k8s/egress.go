@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/queue"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func networkPolicyName(vmName string) string {
+	return vmName + "-egress"
+}
+
+// createNetworkPolicy 在创建 Deployment 之前创建出站策略，Pod 启动时限制即已生效。
+// 策略此时还没有属主，Deployment 创建后由 adoptNetworkPolicy 补上
+func createNetworkPolicy(ctx context.Context, vmName string, p *queue.Provision) error {
+	if p == nil || !p.Egress.Restricted() {
+		return nil
+	}
+	var agentURL string
+	if p.Agent != nil {
+		agentURL = p.Agent.URL
+	}
+	rules, err := egressRules(ctx, p.Egress, agentURL)
+	if err != nil {
+		return err
+	}
+
+	_, err = networkPolicyClient.Create(ctx, &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   networkPolicyName(vmName),
+			Labels: map[string]string{"app": vmName},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": vmName}},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+			Egress:      rules,
+		},
+	}, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+// adoptNetworkPolicy 将出站策略的属主设为 Deployment，删除虚拟机时随之回收
+func adoptNetworkPolicy(ctx context.Context, deployment *appsv1.Deployment) error {
+	np, err := networkPolicyClient.Get(ctx, networkPolicyName(deployment.Name), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	np.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: "apps/v1",
+		Kind:       "Deployment",
+		Name:       deployment.Name,
+		UID:        deployment.UID,
+	}}
+	_, err = networkPolicyClient.Update(ctx, np, metav1.UpdateOptions{})
+	return err
+}
+
+// deleteNetworkPolicy 删除出站策略，用于 Deployment 未能创建或属主未设置成功的情况
+func deleteNetworkPolicy(ctx context.Context, vmName string) error {
+	err := networkPolicyClient.Delete(ctx, networkPolicyName(vmName), metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// egressRules 生成出站规则：blocked 只放行进度代理的后端地址，
+// allowlist 另外放行列出的 CIDR、解析后的主机 IP，以及解析主机名所需的集群 DNS
+func egressRules(ctx context.Context, e *queue.Egress, agentURL string) ([]networkingv1.NetworkPolicyEgressRule, error) {
+	var rules []networkingv1.NetworkPolicyEgressRule
+
+	if agentURL != "" {
+		rule, err := agentRule(ctx, agentURL)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	if e.Mode != queue.EgressAllowlist {
+		return rules, nil
+	}
+
+	var peers []networkingv1.NetworkPolicyPeer
+	for _, cidr := range e.CIDRs {
+		peers = append(peers, networkingv1.NetworkPolicyPeer{IPBlock: &networkingv1.IPBlock{CIDR: cidr}})
+	}
+	for _, host := range e.Hosts {
+		ips, err := resolveHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, ips...)
+	}
+	rules = append(rules, networkingv1.NetworkPolicyEgressRule{To: peers})
+
+	if len(e.Hosts) > 0 {
+		rules = append(rules, dnsRule())
+	}
+	return rules, nil
+}
+
+// agentRule 只放行后端地址上进度代理使用的端口
+func agentRule(ctx context.Context, agentURL string) (networkingv1.NetworkPolicyEgressRule, error) {
+	u, err := url.Parse(agentURL)
+	if err != nil || u.Hostname() == "" {
+		return networkingv1.NetworkPolicyEgressRule{}, fmt.Errorf("invalid agent url %q", agentURL)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return networkingv1.NetworkPolicyEgressRule{}, fmt.Errorf("invalid agent url %q", agentURL)
+	}
+
+	peers, err := resolveHost(ctx, u.Hostname())
+	if err != nil {
+		return networkingv1.NetworkPolicyEgressRule{}, err
+	}
+	tcp := apiv1.ProtocolTCP
+	p := intstr.FromInt32(int32(n))
+	return networkingv1.NetworkPolicyEgressRule{
+		To:    peers,
+		Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &p}},
+	}, nil
+}
+
+// resolveHost 将主机名解析为单个地址的 IPBlock，IP 地址原样使用
+func resolveHost(ctx context.Context, host string) ([]networkingv1.NetworkPolicyPeer, error) {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s: %w", host, err)
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	peers := make([]networkingv1.NetworkPolicyPeer, 0, len(ips))
+	for _, ip := range ips {
+		cidr := ip.String() + "/32"
+		if ip.To4() == nil {
+			cidr = ip.String() + "/128"
+		}
+		peers = append(peers, networkingv1.NetworkPolicyPeer{IPBlock: &networkingv1.IPBlock{CIDR: cidr}})
+	}
+	return peers, nil
+}
+
+// dnsRule 放行集群 DNS
+func dnsRule() networkingv1.NetworkPolicyEgressRule {
+	udp, tcp := apiv1.ProtocolUDP, apiv1.ProtocolTCP
+	port := intstr.FromInt32(53)
+	return networkingv1.NetworkPolicyEgressRule{
+		To: []networkingv1.NetworkPolicyPeer{{
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"kubernetes.io/metadata.name": "kube-system"}},
+			PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"k8s-app": "kube-dns"}},
+		}},
+		Ports: []networkingv1.NetworkPolicyPort{
+			{Protocol: &udp, Port: &port},
+			{Protocol: &tcp, Port: &port},
+		},
+	}
+}
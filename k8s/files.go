@@ -0,0 +1,297 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/worker"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+var (
+	errInvalidArchive = errors.New("invalid tar archive")
+	errTooLarge       = errors.New("file too large")
+)
+
+// execInPod 在虚拟机主容器内执行命令，标准输入输出通过 exec 子资源流式传输
+func execInPod(ctx context.Context, pod *apiv1.Pod, cmd []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	req := clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.Namespace).
+		Name(pod.Name).
+		SubResource("exec").
+		VersionedParams(&apiv1.PodExecOptions{
+			Container: pod.Spec.Containers[0].Name,
+			Command:   cmd,
+			Stdin:     stdin != nil,
+			Stdout:    stdout != nil,
+			Stderr:    stderr != nil,
+		}, scheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(restConfig, http.MethodPost, req.URL())
+	if err != nil {
+		return err
+	}
+	return executor.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+}
+
+// runningVMPod 查找虚拟机的运行中 Pod，失败时已写入响应
+func runningVMPod(w http.ResponseWriter, r *http.Request, vmName string) (*apiv1.Pod, bool) {
+	pod, err := findVMPod(r.Context(), vmName)
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusNotFound, "虚拟机容器不存在")
+		return nil, false
+	}
+	if pod.Status.Phase != apiv1.PodRunning {
+		writeError(w, http.StatusConflict, "虚拟机未运行")
+		return nil, false
+	}
+	return pod, true
+}
+
+// downloadWriter 在第一次写入时才发送响应头，以便出错时仍能返回 JSON 错误
+type downloadWriter struct {
+	w           http.ResponseWriter
+	contentType string
+	filename    string
+	written     int64
+	started     bool
+	exceeded    bool
+}
+
+func (d *downloadWriter) start() {
+	d.started = true
+	d.w.Header().Set("Content-Type", d.contentType)
+	d.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", d.filename))
+	d.w.WriteHeader(http.StatusOK)
+}
+
+func (d *downloadWriter) Write(p []byte) (int, error) {
+	if d.written+int64(len(p)) > worker.MaxDownloadSize {
+		d.exceeded = true
+		return 0, errTooLarge
+	}
+	if !d.started {
+		d.start()
+	}
+	n, err := d.w.Write(p)
+	d.written += int64(n)
+	return n, err
+}
+
+// limitedBuffer 只保留前若干字节的标准错误输出，用于记录日志
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := 4096 - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// downloadFileHandler 下载工作目录内的文件，archive=true 时以 tar 打包文件或目录
+func downloadFileHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmNameFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	opts, err := worker.ParseFileOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	target := worker.WorkspacePath(opts.Path)
+
+	pod, ok := runningVMPod(w, r, name)
+	if !ok {
+		return
+	}
+
+	out := &downloadWriter{w: w}
+	var cmd []string
+	if opts.Archive {
+		// 不加 -h，归档内的符号链接保持为链接而不会被跟随
+		cmd = []string{"tar", "cf", "-", "-C", path.Dir(target), path.Base(target)}
+		out.contentType = "application/x-tar"
+		out.filename = path.Base(target) + ".tar"
+	} else {
+		cmd = []string{"sh", "-c", `test -f "$0" && exec cat -- "$0"`, target}
+		out.contentType = "application/octet-stream"
+		out.filename = path.Base(target)
+	}
+
+	var stderr limitedBuffer
+	err = execInPod(r.Context(), pod, cmd, nil, out, &stderr)
+	switch {
+	case err == nil:
+		if !out.started {
+			out.start()
+		}
+	case out.started:
+		// 响应头已发送，只能中断连接让客户端感知传输失败
+		log.Println(err, stderr.String())
+		panic(http.ErrAbortHandler)
+	case out.exceeded:
+		writeError(w, http.StatusRequestEntityTooLarge, "文件过大")
+	default:
+		log.Println(err, stderr.String())
+		var exitErr utilexec.ExitError
+		if errors.As(err, &exitErr) {
+			writeError(w, http.StatusNotFound, "文件不存在")
+			return
+		}
+		writeError(w, http.StatusBadGateway, "文件下载失败")
+	}
+}
+
+// uploadFileHandler 向工作目录写入单个文件，archive=true 时将请求体作为 tar 归档解包
+func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmNameFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	opts, err := worker.ParseFileOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !opts.Archive && (opts.Name == "" || opts.Name != path.Base(opts.Name) || opts.Name == "..") {
+		writeError(w, http.StatusBadRequest, "无效的文件名")
+		return
+	}
+	if r.ContentLength < 0 {
+		writeError(w, http.StatusLengthRequired, "缺少文件长度")
+		return
+	}
+	if r.ContentLength > worker.MaxUploadSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "文件过大")
+		return
+	}
+	dir := worker.WorkspacePath(opts.Path)
+
+	pod, ok := runningVMPod(w, r, name)
+	if !ok {
+		return
+	}
+
+	// 无论上传的是单文件还是归档，都重新生成一份只含普通文件和目录的 tar 流交给容器解包
+	body := http.MaxBytesReader(w, r.Body, worker.MaxUploadSize)
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		var err error
+		if opts.Archive {
+			err = sanitizeTar(pw, body)
+		} else {
+			err = singleFileTar(pw, opts.Name, r.ContentLength, body)
+		}
+		pw.CloseWithError(err)
+		errc <- err
+	}()
+
+	cmd := []string{"sh", "-c", `mkdir -p "$0" && exec tar xf - --no-same-owner --no-same-permissions -C "$0"`, dir}
+	var stderr limitedBuffer
+	err = execInPod(r.Context(), pod, cmd, pr, nil, &stderr)
+	pr.Close()
+	if werr := <-errc; errors.Is(werr, errInvalidArchive) {
+		writeError(w, http.StatusBadRequest, "无效的 tar 归档")
+		return
+	}
+	if err != nil {
+		log.Println(err, stderr.String())
+		writeError(w, http.StatusBadGateway, "文件上传失败")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, `{"message":"上传成功","path":%q}`+"\n", dir)
+}
+
+// singleFileTar 将单个文件包装为 tar 流
+func singleFileTar(dst io.Writer, name string, size int64, src io.Reader) error {
+	tw := tar.NewWriter(dst)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o644,
+		Size:     size,
+		ModTime:  time.Now(),
+	}); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, src); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// sanitizeTar 逐项复制用户上传的归档，拒绝绝对路径和 ".." 并丢弃链接、设备等特殊文件
+func sanitizeTar(dst io.Writer, src io.Reader) error {
+	tr := tar.NewReader(src)
+	tw := tar.NewWriter(dst)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidArchive, err)
+		}
+
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("%w: unsafe path %s", errInvalidArchive, hdr.Name)
+		}
+		if name == "." {
+			continue
+		}
+
+		out := &tar.Header{
+			Typeflag: hdr.Typeflag,
+			Name:     name,
+			Mode:     hdr.Mode & 0o777,
+			ModTime:  hdr.ModTime,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			out.Size = hdr.Size
+		case tar.TypeDir:
+			out.Name += "/"
+		default:
+			continue
+		}
+
+		if err := tw.WriteHeader(out); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/queue"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// 访问端口记录在 Deployment 注解上，端口转发时读取
+	accessPortAnnotation     = "lab/access-port"
+	accessProtocolAnnotation = "lab/access-protocol"
+
+	defaultAccessPort = 80
+)
+
+// applyImage 用镜像目录中的镜像替换模板默认镜像，初始化容器使用同一镜像
+func applyImage(deployment *appsv1.Deployment, spec *queue.ImageSpec) error {
+	if spec == nil {
+		return nil
+	}
+	main := &deployment.Spec.Template.Spec.Containers[0]
+	main.Image = spec.Image
+
+	resources := apiv1.ResourceRequirements{}
+	for _, q := range []struct {
+		list  *apiv1.ResourceList
+		name  apiv1.ResourceName
+		value string
+	}{
+		{&resources.Requests, apiv1.ResourceCPU, spec.CPURequest},
+		{&resources.Limits, apiv1.ResourceCPU, spec.CPULimit},
+		{&resources.Requests, apiv1.ResourceMemory, spec.MemoryRequest},
+		{&resources.Limits, apiv1.ResourceMemory, spec.MemoryLimit},
+	} {
+		if q.value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(q.value)
+		if err != nil {
+			return fmt.Errorf("%s %q: %w", q.name, q.value, err)
+		}
+		if *q.list == nil {
+			*q.list = apiv1.ResourceList{}
+		}
+		(*q.list)[q.name] = quantity
+	}
+	main.Resources = resources
+
+	if len(spec.Ports) > 0 {
+		main.Ports = main.Ports[:0]
+		for _, p := range spec.Ports {
+			main.Ports = append(main.Ports, apiv1.ContainerPort{
+				Name:          "port-" + strconv.Itoa(p),
+				ContainerPort: int32(p),
+			})
+		}
+	}
+
+	if deployment.Annotations == nil {
+		deployment.Annotations = map[string]string{}
+	}
+	deployment.Annotations[accessPortAnnotation] = strconv.Itoa(accessPort(spec))
+	deployment.Annotations[accessProtocolAnnotation] = spec.AccessProtocol
+	return nil
+}
+
+func accessPort(spec *queue.ImageSpec) int {
+	if spec == nil || len(spec.Ports) == 0 {
+		return defaultAccessPort
+	}
+	return spec.Ports[0]
+}
+
+// deploymentAccessPort 读取 Deployment 记录的访问端口，旧的 Deployment 默认为 80
+func deploymentAccessPort(d *appsv1.Deployment) int {
+	if p, err := strconv.Atoi(d.Annotations[accessPortAnnotation]); err == nil && p > 0 {
+		return p
+	}
+	return defaultAccessPort
+}
@@ -15,36 +15,71 @@ import (
 	"time"
 
 	"github.com/MeteorsLiu/virtuallabs/backend/api/vm"
+	"github.com/MeteorsLiu/virtuallabs/backend/queue"
+	"github.com/MeteorsLiu/virtuallabs/backend/worker"
 	appsv1 "k8s.io/api/apps/v1"
 	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/kubernetes"
 	v1 "k8s.io/client-go/kubernetes/typed/apps/v1"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
-
-	"k8s.io/client-go/tools/clientcmd"
+	networkingv1 "k8s.io/client-go/kubernetes/typed/networking/v1"
+	"k8s.io/client-go/rest"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 var (
+	restConfig        *rest.Config
+	clientset         *kubernetes.Clientset
 	deploymentsClient v1.DeploymentInterface
 	podClient         corev1.PodInterface
+	configMapClient   corev1.ConfigMapInterface
+	secretClient      corev1.SecretInterface
+	deployTemplate    *template.Template
+
+	networkPolicyClient networkingv1.NetworkPolicyInterface
+
+	// 后端服务地址，用于状态回调和拉取实验附件
+	backendAddr string
+	namespace   string
+	kubeconfig  string
+	secret      string
 )
 
-func init() {
-	config, err := clientcmd.BuildConfigFromFlags("", "k8sconfig.yml")
+// setup 根据配置初始化 k8s 客户端和 Deployment 模板
+func setup(c Config) error {
+	var err error
+	restConfig, err = restConfigFor(c)
+	if err != nil {
+		return err
+	}
+	clientset, err = kubernetes.NewForConfig(restConfig)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	clientset, err := kubernetes.NewForConfig(config)
+
+	deployTemplate, err = template.ParseFiles(c.Template)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("parse template: %w", err)
 	}
 
-	deploymentsClient = clientset.AppsV1().Deployments(apiv1.NamespaceDefault)
+	backendAddr = c.BackendURL
+	namespace = c.Namespace
+	kubeconfig = c.Kubeconfig
+	secret = c.Secret
+
+	deploymentsClient = clientset.AppsV1().Deployments(namespace)
+
+	podClient = clientset.CoreV1().Pods(namespace)
+
+	configMapClient = clientset.CoreV1().ConfigMaps(namespace)
+
+	secretClient = clientset.CoreV1().Secrets(namespace)
 
-	podClient = clientset.CoreV1().Pods(apiv1.NamespaceDefault)
+	networkPolicyClient = clientset.NetworkingV1().NetworkPolicies(namespace)
+	return nil
 }
 
 func phaseToString(phase apiv1.PodPhase) string {
@@ -65,7 +100,12 @@ func callAPI(name, message string, phase apiv1.PodPhase) {
 	}
 	b, _ := json.Marshal(req)
 
-	resp, err := http.Post("http://127.0.0.1:8888/vm-status-callback", "application/json", bytes.NewBuffer(b))
+	httpReq, _ := http.NewRequest(http.MethodPost, backendAddr+"/vm-status-callback", bytes.NewBuffer(b))
+	httpReq.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		httpReq.Header.Set(worker.SecretHeader, secret)
+	}
+	resp, err := http.DefaultClient.Do(httpReq)
 
 	if err != nil {
 		log.Println(err)
@@ -91,53 +131,143 @@ func callbackStatus(pod *appsv1.Deployment, port int) {
 		if !ok {
 			return
 		}
+		if msg, failed := initContainerFailure(p); failed {
+			callAPI(pod.Name, msg, apiv1.PodFailed)
+			return
+		}
 		if p.Status.Phase != apiv1.PodPending {
 			callAPI(pod.Name, p.Status.Message, p.Status.Phase)
 
-			go func() {
-				log.Println("kubectl", "port-forward", "deployments/"+pod.Name, strconv.Itoa(port+6000)+":80")
-
-				ret, err := exec.Command("kubectl", "port-forward", "deployments/"+pod.Name, strconv.Itoa(port+6000)+":80").CombinedOutput()
-				if err != nil {
-					log.Println(string(ret))
-				}
-			}()
+			go portForward(pod.Name, port, deploymentAccessPort(pod))
 			return
 		}
 	}
 }
 
-func createVm(Vmname string, port int) error {
-	tmp, err := template.ParseFiles("k8sdeploy.yml.tmpl")
+// portForward 将虚拟机的访问端口转发到本机，进程退出前阻塞
+func portForward(name string, port, targetPort int) {
+	args := []string{"port-forward", "-n", namespace, "deployments/" + name, strconv.Itoa(port+6000) + ":" + strconv.Itoa(targetPort)}
+	if kubeconfig != "" {
+		args = append(args, "--kubeconfig", kubeconfig)
+	}
+	log.Println("kubectl", args)
+
+	ret, err := exec.Command("kubectl", args...).CombinedOutput()
 	if err != nil {
-		log.Println(err)
-		return err
+		log.Println(string(ret))
 	}
+}
 
+// initContainerFailure 检查初始化容器是否以非零状态退出
+func initContainerFailure(p *apiv1.Pod) (string, bool) {
+	for _, st := range p.Status.InitContainerStatuses {
+		if t := st.State.Terminated; t != nil && t.ExitCode != 0 {
+			return fmt.Sprintf("初始化容器 %s 执行失败（退出码 %d）", st.Name, t.ExitCode), true
+		}
+		if t := st.LastTerminationState.Terminated; t != nil && t.ExitCode != 0 {
+			return fmt.Sprintf("初始化容器 %s 执行失败（退出码 %d）", st.Name, t.ExitCode), true
+		}
+	}
+	return "", false
+}
+
+// newDeployment 按模板生成虚拟机的 Deployment
+func newDeployment(Vmname string) (*appsv1.Deployment, error) {
 	var buf bytes.Buffer
 
-	if err := tmp.Execute(&buf, map[string]any{
-		"Vmname": Vmname,
+	if err := deployTemplate.Execute(&buf, map[string]any{
+		"Vmname":    Vmname,
+		"Namespace": namespace,
 	}); err != nil {
+		return nil, err
+	}
+	var deployment appsv1.Deployment
+
+	if err := yaml.Unmarshal(buf.Bytes(), &deployment); err != nil {
+		return nil, err
+	}
+	deployment.Namespace = namespace
+	return &deployment, nil
+}
+
+func createVm(Vmname string, port int, provision *queue.Provision) error {
+	deployment, err := newDeployment(Vmname)
+	if err != nil {
 		log.Println(err)
 		return err
 	}
-	var deployment appsv1.Deployment
 
-	err = yaml.Unmarshal(buf.Bytes(), &deployment)
+	if err := applySpec(deployment, provision); err != nil {
+		log.Println(err)
+		callAPI(Vmname, "实验镜像、调度或附件配置无效", apiv1.PodFailed)
+		return err
+	}
+	applyProvision(deployment, provision)
+
+	creds, err := generateCredentials(wantsSSH(provision))
 	if err != nil {
 		log.Println(err)
 		return err
 	}
+	// 进度代理令牌在此生成并只保存在集群的 Secret 中，后端只收到其哈希
+	var agentToken string
+	if provision != nil && provision.Agent != nil {
+		if agentToken, _, err = worker.NewAgentToken(); err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+	applyCredentials(deployment, creds.SSHPrivateKey != "", agentToken != "")
+
+	if err := createNetworkPolicy(context.TODO(), Vmname, provision); err != nil {
+		log.Println(err)
+		callAPI(Vmname, "出站网络策略创建失败", apiv1.PodFailed)
+		return err
+	}
 
 	// Create Deployment
 	fmt.Println("Creating deployment...")
-	machine, err := deploymentsClient.Create(context.TODO(), &deployment, metav1.CreateOptions{})
+	machine, err := deploymentsClient.Create(context.TODO(), deployment, metav1.CreateOptions{})
+	existed := apierrors.IsAlreadyExists(err)
+	if existed {
+		// 发件箱按至少一次投递，上次投递可能在创建 Deployment 之后的某一步失败，
+		// 取回已有的 Deployment 重新执行后续各步，每一步已完成时直接跳过
+		log.Println("deployment already exists:", Vmname)
+		machine, err = deploymentsClient.Get(context.TODO(), Vmname, metav1.GetOptions{})
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	} else if err != nil {
+		log.Println(err)
+		deleteNetworkPolicy(context.TODO(), Vmname)
+		return err
+	}
+	if err := adoptNetworkPolicy(context.TODO(), machine); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	if err := createProvisionConfigMap(context.TODO(), machine, provision); err != nil {
+		log.Println(err)
+		callAPI(machine.Name, "实验环境初始化失败", apiv1.PodFailed)
+		return err
+	}
+
+	creds, agentToken, err = ensureCredentialsSecret(context.TODO(), machine, creds, agentToken)
 	if err != nil {
 		log.Println(err)
+		callAPI(machine.Name, "访问凭据生成失败", apiv1.PodFailed)
 		return err
 	}
+	if err := reportCredentials(context.TODO(), machine.Name, creds, agentToken); err != nil {
+		log.Println(err)
+	}
 
+	// 已缩容的虚拟机没有 Pod，状态在重新启动时上报
+	if existed && machine.Spec.Replicas != nil && *machine.Spec.Replicas == 0 {
+		return nil
+	}
 	go callbackStatus(machine, port)
 
 	return nil
@@ -147,10 +277,57 @@ func deleteVm(Vmname string) error {
 	deletePolicy := metav1.DeletePropagationForeground
 	if err := deploymentsClient.Delete(context.TODO(), Vmname, metav1.DeleteOptions{
 		PropagationPolicy: &deletePolicy,
-	}); err != nil {
+	}); err != nil && !apierrors.IsNotFound(err) {
+		log.Println(err, Vmname)
+
+		return err
+	}
+	// 出站策略通常随 Deployment 回收，属主未设置成功时在此删除
+	if err := deleteNetworkPolicy(context.TODO(), Vmname); err != nil {
+		log.Println(err, Vmname)
+		return err
+	}
+	return nil
+}
+
+// scaleVm 调整虚拟机副本数，租期到期时缩容到 0，续期重新启动时恢复为 1
+func scaleVm(Vmname string, replicas int32) error {
+	scale, err := deploymentsClient.GetScale(context.TODO(), Vmname, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if scale.Spec.Replicas == replicas {
+		return nil
+	}
+	scale.Spec.Replicas = replicas
+	_, err = deploymentsClient.UpdateScale(context.TODO(), Vmname, scale, metav1.UpdateOptions{})
+	return err
+}
+
+func stopVm(Vmname string) error {
+	if err := scaleVm(Vmname, 0); err != nil && !apierrors.IsNotFound(err) {
+		log.Println(err, Vmname)
+		return err
+	}
+	return nil
+}
+
+func startVm(Vmname string, port int) error {
+	if err := scaleVm(Vmname, 1); err != nil {
 		log.Println(err, Vmname)
+		if apierrors.IsNotFound(err) {
+			// 重试不会成功，上报失败后确认该指令
+			callAPI(Vmname, "虚拟机已被回收，请删除后重新创建", apiv1.PodFailed)
+			return nil
+		}
+		return err
+	}
 
+	machine, err := deploymentsClient.Get(context.TODO(), Vmname, metav1.GetOptions{})
+	if err != nil {
+		log.Println(err, Vmname)
 		return err
 	}
+	go callbackStatus(machine, port)
 	return nil
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/worker"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// podLogsHandler 以流的形式返回虚拟机容器日志
+func podLogsHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := vmNameFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	opts, err := worker.ParseLogOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	pod, err := findVMPod(r.Context(), name)
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusNotFound, "虚拟机容器不存在")
+		return
+	}
+
+	logOpts := &apiv1.PodLogOptions{
+		Container: pod.Spec.Containers[0].Name,
+		Follow:    opts.Follow,
+		Previous:  opts.Previous,
+	}
+	if opts.TailLines > 0 {
+		logOpts.TailLines = &opts.TailLines
+	}
+
+	stream, err := podClient.GetLogs(pod.Name, logOpts).Stream(r.Context())
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusBadGateway, "获取日志失败")
+		return
+	}
+	defer stream.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := stream.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Println(err)
+			}
+			return
+		}
+	}
+}
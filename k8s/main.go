@@ -2,42 +2,191 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/MeteorsLiu/virtuallabs/backend/queue"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
 	"github.com/zeromicro/go-queue/kq"
-	"github.com/zeromicro/go-zero/core/conf"
 )
 
-func consumer(ctx context.Context, key, value string) error {
-	if key != "k8s" {
-		return nil
+var (
+	jobs    *dispatcher
+	offsets *offsetTracker
+	// 无法解析或重试后仍执行失败的消息转入死信队列，排查或升级工作节点后可重新投递
+	deadLetters *kq.Pusher
+)
+
+// consumer 只负责解析和分发，按虚拟机名保证同一虚拟机的指令顺序执行，
+// 消息的位移在指令执行完毕或转入死信队列后才提交
+func consumer(msg kafka.Message) {
+	e, err := queue.Decode(msg.Value)
+	if err != nil {
+		log.Printf("undecodable message (key %s): %v", msg.Key, err)
+		reject(msg)
+		return
+	}
+
+	var (
+		vmName string
+		run    func() error
+	)
+	switch e.Type {
+	case queue.TypeCreateVM:
+		p, err := e.CreateVM()
+		if err != nil {
+			log.Printf("message %s (trace %s): %v", e.ID, e.TraceID, err)
+			reject(msg)
+			return
+		}
+		vmName, run = p.VMName, func() error { return createVm(p.VMName, p.VMID+80, p.Provision) }
+	case queue.TypeDeleteVM:
+		p, err := e.DeleteVM()
+		if err != nil {
+			log.Printf("message %s (trace %s): %v", e.ID, e.TraceID, err)
+			reject(msg)
+			return
+		}
+		vmName, run = p.VMName, func() error { return deleteVm(p.VMName) }
+	case queue.TypeStopVM:
+		p, err := e.StopVM()
+		if err != nil {
+			log.Printf("message %s (trace %s): %v", e.ID, e.TraceID, err)
+			reject(msg)
+			return
+		}
+		vmName, run = p.VMName, func() error { return stopVm(p.VMName) }
+	case queue.TypeStartVM:
+		p, err := e.StartVM()
+		if err != nil {
+			log.Printf("message %s (trace %s): %v", e.ID, e.TraceID, err)
+			reject(msg)
+			return
+		}
+		vmName, run = p.VMName, func() error { return startVm(p.VMName, p.VMID+80) }
+	}
+
+	jobs.Dispatch(vmName, job{
+		msg:  msg,
+		name: fmt.Sprintf("%s %s (message %s, trace %s)", e.Type, vmName, e.ID, e.TraceID),
+		run:  run,
+	})
+}
+
+// reject 将无法处理的消息转入死信队列并提交位移
+func reject(msg kafka.Message) {
+	deadLetter(string(msg.Key), string(msg.Value))
+	offsets.Done(msg)
+}
+
+// deadLetter 按 retryDelays 重试推送到死信队列，仍然失败时把消息完整写入日志。
+// 调用方随后照常提交位移，否则该分区之后的位移都无法提交
+func deadLetter(key, value string) {
+	err := deadLetters.KPush(context.Background(), key, value)
+	for _, delay := range retryDelays {
+		if err == nil {
+			return
+		}
+		log.Printf("push to dead letter topic failed (key %s), retry in %s: %v", key, delay, err)
+		time.Sleep(delay)
+		err = deadLetters.KPush(context.Background(), key, value)
 	}
+	if err != nil {
+		log.Printf("push to dead letter topic failed (key %s): %v, dropping message: %s", key, err, value)
+	}
+}
 
-	var message queue.VMRequest
-	json.Unmarshal([]byte(value), &message)
+// consume 逐条拉取消息并分发，直到 ctx 取消
+func consume(ctx context.Context, reader *kafka.Reader) {
+	for {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("fetch message: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		offsets.Track(msg)
+		consumer(msg)
+	}
+}
 
-	switch message.OpCode {
-	case queue.OpCreateVM:
-		return createVm(message.Vmname, message.Vmid+80)
-	case queue.OpDeleteVM:
-		return deleteVm(message.Vmname)
+// newReader 按 kq 配置创建消费者组读取器，位移由 offsetTracker 手动提交
+func newReader(c kq.KqConf) (*kafka.Reader, error) {
+	offset := kafka.LastOffset
+	if c.Offset == "first" {
+		offset = kafka.FirstOffset
 	}
 
-	return nil
+	var dialer *kafka.Dialer
+	if c.Username != "" && c.Password != "" {
+		dialer = &kafka.Dialer{
+			Timeout:       10 * time.Second,
+			DualStack:     true,
+			SASLMechanism: plain.Mechanism{Username: c.Username, Password: c.Password},
+		}
+	}
+	if c.CaFile != "" {
+		caCert, err := os.ReadFile(c.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates in %s", c.CaFile)
+		}
+		if dialer == nil {
+			dialer = &kafka.Dialer{Timeout: 10 * time.Second, DualStack: true}
+		}
+		dialer.TLS = &tls.Config{RootCAs: pool}
+	}
+
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     c.Brokers,
+		GroupID:     c.Group,
+		Topic:       c.Topic,
+		StartOffset: offset,
+		MinBytes:    c.MinBytes,
+		MaxBytes:    c.MaxBytes,
+		MaxWait:     time.Second,
+		Dialer:      dialer,
+	}), nil
 }
 
 func main() {
-	var c kq.KqConf
+	c := loadConfig()
 
-	conf.MustLoad("kq.yml", &c)
+	if err := setup(c); err != nil {
+		log.Fatalf("setup kubernetes client: %v", err)
+	}
 
-	q, err := kq.NewQueue(c, kq.WithHandle(consumer))
+	reader, err := newReader(c.KqConf)
 	if err != nil {
-		panic(err)
+		log.Fatalf("setup kafka reader: %v", err)
 	}
+	offsets = newOffsetTracker(reader)
+	jobs = newDispatcher(c.Concurrency, c.Backlog)
+	deadLetters = kq.NewPusher(c.Brokers, c.DeadLetterTopic, kq.WithSyncPush())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go serveAPI(c.ListenAddr)
+	go runWarmPool(ctx, c.WarmPoolInterval)
 
-	defer q.Stop()
-	q.Start()
+	consume(ctx, reader)
 
+	// 停止拉取后等待已分发的指令执行完毕再关闭连接，未提交的消息重启后重新投递
+	jobs.Close()
+	deadLetters.Close()
+	reader.Close()
 }
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/queue"
+	"github.com/MeteorsLiu/virtuallabs/backend/worker"
+	"github.com/google/uuid"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// 预热池通过 Deployment 的标签区分状态，Pod 模板不变，领取时无需重启容器
+const (
+	poolLabel          = "lab/pool"
+	poolExperiment     = "lab/experiment"
+	poolRevision       = "lab/pool-revision"
+	poolVMIDAnnotation = "lab/vm-id"
+	poolClaimedAt      = "lab/claimed-at"
+
+	poolWarm    = "warm"
+	poolClaimed = "claimed"
+
+	// 单轮补齐最多创建的 Deployment 数，避免与学生的创建请求争抢 API Server
+	maxWarmCreates = 5
+
+	// 领取超过该时间仍没有对应虚拟机记录的预热虚拟机视为遗留，
+	// 需远大于后端的领取超时，避免删除后端正在保存记录的虚拟机
+	claimGracePeriod = 10 * time.Minute
+)
+
+var refillNow = make(chan struct{}, 1)
+
+// triggerRefill 领取后尽快补齐预热池
+func triggerRefill() {
+	select {
+	case refillNow <- struct{}{}:
+	default:
+	}
+}
+
+// runWarmPool 定期从后端拉取预热配置并补齐各实验的预热池
+func runWarmPool(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := refillWarmPools(ctx); err != nil {
+			log.Println("warm pool:", err)
+		}
+		if err := reapOrphanedClaims(ctx); err != nil {
+			log.Println("warm pool:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-refillNow:
+		}
+	}
+}
+
+func fetchWarmPools(ctx context.Context) ([]worker.WarmPool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, backendAddr+worker.WarmPoolsPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if secret != "" {
+		req.Header.Set(worker.SecretHeader, secret)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch warm pools: unexpected status %s", resp.Status)
+	}
+	var pools []worker.WarmPool
+	if err := json.NewDecoder(resp.Body).Decode(&pools); err != nil {
+		return nil, err
+	}
+	return pools, nil
+}
+
+// provisionRevision 标识预热时使用的实验附件和初始化脚本，实验修改后旧的预热虚拟机会被替换
+func provisionRevision(p *queue.Provision) string {
+	b, _ := json.Marshal(p)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+// refillWarmPools 删除多余或过期的预热虚拟机，并为不足的实验补齐
+func refillWarmPools(ctx context.Context) error {
+	pools, err := fetchWarmPools(ctx)
+	if err != nil {
+		return err
+	}
+	desired := make(map[string]worker.WarmPool, len(pools))
+	revisions := make(map[string]string, len(pools))
+	for _, p := range pools {
+		id := strconv.Itoa(p.ExperimentID)
+		desired[id] = p
+		revisions[id] = provisionRevision(p.Provision)
+	}
+
+	list, err := deploymentsClient.List(ctx, metav1.ListOptions{LabelSelector: poolLabel + "=" + poolWarm})
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]int)
+	for i := range list.Items {
+		d := &list.Items[i]
+		id := d.Labels[poolExperiment]
+		p, ok := desired[id]
+		if ok && d.Labels[poolRevision] == revisions[id] && current[id] < p.Size {
+			current[id]++
+			continue
+		}
+
+		// 以资源版本为前提删除，避免误删刚被领取的虚拟机
+		if err := deploymentsClient.Delete(ctx, d.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{ResourceVersion: &d.ResourceVersion},
+		}); err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+			log.Printf("warm pool: delete %s: %v", d.Name, err)
+		}
+	}
+
+	created := 0
+	for _, p := range pools {
+		id := strconv.Itoa(p.ExperimentID)
+		for n := current[id]; n < p.Size && created < maxWarmCreates; n++ {
+			if err := createWarmVm(ctx, p, revisions[id]); err != nil {
+				return err
+			}
+			created++
+		}
+	}
+	return nil
+}
+
+// reapOrphanedClaims 删除已领取但后端没有对应记录的预热虚拟机。
+// 后端领取超时或未能保存记录时会按常规流程另行创建，领取到的虚拟机不会再被使用
+func reapOrphanedClaims(ctx context.Context) error {
+	list, err := deploymentsClient.List(ctx, metav1.ListOptions{LabelSelector: poolLabel + "=" + poolClaimed})
+	if err != nil {
+		return err
+	}
+
+	var claimed []worker.ClaimedVM
+	for i := range list.Items {
+		d := &list.Items[i]
+		// 缺少领取时间的虚拟机领取于记录该注解之前，同样需要核对
+		if at, err := time.Parse(time.RFC3339, d.Annotations[poolClaimedAt]); err == nil && time.Since(at) < claimGracePeriod {
+			continue
+		}
+		vmid, err := strconv.Atoi(d.Annotations[poolVMIDAnnotation])
+		if err != nil {
+			continue
+		}
+		claimed = append(claimed, worker.ClaimedVM{VMID: vmid, VMName: d.Name})
+	}
+
+	// 后端每次最多核对 1000 台
+	for len(claimed) > 0 {
+		n := min(len(claimed), 500)
+		orphans, err := fetchOrphanedClaims(ctx, claimed[:n])
+		if err != nil {
+			return err
+		}
+		for _, vm := range orphans {
+			log.Printf("warm pool: deleting %s claimed for vm %d without a record", vm.VMName, vm.VMID)
+			deleteVm(vm.VMName)
+		}
+		claimed = claimed[n:]
+	}
+	return nil
+}
+
+func fetchOrphanedClaims(ctx context.Context, claimed []worker.ClaimedVM) ([]worker.ClaimedVM, error) {
+	b, _ := json.Marshal(claimed)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, backendAddr+worker.ClaimedVMsPath, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		req.Header.Set(worker.SecretHeader, secret)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("check claimed vms: unexpected status %s", resp.Status)
+	}
+	var orphans []worker.ClaimedVM
+	if err := json.NewDecoder(resp.Body).Decode(&orphans); err != nil {
+		return nil, err
+	}
+	return orphans, nil
+}
+
+// createWarmVm 创建一台未分配的预热虚拟机，只注入实验级别的附件和初始化脚本
+func createWarmVm(ctx context.Context, p worker.WarmPool, revision string) error {
+	deployment, err := newDeployment(uuid.NewString())
+	if err != nil {
+		return err
+	}
+	if deployment.Labels == nil {
+		deployment.Labels = map[string]string{}
+	}
+	deployment.Labels[poolLabel] = poolWarm
+	deployment.Labels[poolExperiment] = strconv.Itoa(p.ExperimentID)
+	deployment.Labels[poolRevision] = revision
+
+	if err := applySpec(deployment, p.Provision); err != nil {
+		return err
+	}
+	applyProvision(deployment, p.Provision)
+
+	creds, err := generateCredentials(wantsSSH(p.Provision))
+	if err != nil {
+		return err
+	}
+	applyCredentials(deployment, creds.SSHPrivateKey != "", false)
+
+	if err := createNetworkPolicy(ctx, deployment.Name, p.Provision); err != nil {
+		return err
+	}
+	machine, err := deploymentsClient.Create(ctx, deployment, metav1.CreateOptions{})
+	if err != nil {
+		deleteNetworkPolicy(ctx, deployment.Name)
+		return err
+	}
+	if err := adoptNetworkPolicy(ctx, machine); err != nil {
+		deleteVm(machine.Name)
+		return err
+	}
+	if err := createProvisionConfigMap(ctx, machine, p.Provision); err != nil {
+		deleteVm(machine.Name)
+		return err
+	}
+	if err := createCredentialsSecret(ctx, machine, creds, ""); err != nil {
+		deleteVm(machine.Name)
+		return err
+	}
+	log.Printf("warm pool: created %s for experiment %d", machine.Name, p.ExperimentID)
+	return nil
+}
+
+// claimHandler 领取实验最早创建且已就绪的预热虚拟机
+func claimHandler(w http.ResponseWriter, r *http.Request) {
+	var req worker.ClaimRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil || req.ExperimentID <= 0 {
+		writeError(w, http.StatusBadRequest, "无效的领取请求")
+		return
+	}
+
+	list, err := deploymentsClient.List(r.Context(), metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s,%s=%d", poolLabel, poolWarm, poolExperiment, req.ExperimentID),
+	})
+	if err != nil {
+		log.Println(err)
+		writeError(w, http.StatusInternalServerError, "查询预热虚拟机失败")
+		return
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		return list.Items[i].CreationTimestamp.Before(&list.Items[j].CreationTimestamp)
+	})
+
+	for i := range list.Items {
+		d := &list.Items[i]
+		if d.Status.ReadyReplicas < 1 {
+			continue
+		}
+
+		claimed, err := claimDeployment(r.Context(), d, req.VMID)
+		if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+			// 已被其他请求领取或已被回收
+			continue
+		}
+		if err != nil {
+			log.Println(err)
+			writeError(w, http.StatusInternalServerError, "领取预热虚拟机失败")
+			return
+		}
+
+		// 进度代理令牌在此生成并写入虚拟机，只将哈希返回给后端；写入失败时不返回哈希，代理无法上报
+		resp := worker.ClaimResponse{VMName: claimed.Name, Status: "pending"}
+		var agentToken string
+		if req.Agent != nil {
+			token, hash, err := worker.NewAgentToken()
+			if err != nil {
+				log.Printf("warm pool: agent token for %s: %v", claimed.Name, err)
+			} else {
+				agentToken, resp.AgentTokenHash = token, hash
+			}
+		}
+		if err := writeStudentEnv(r.Context(), claimed.Name, req, agentToken); err != nil {
+			log.Printf("warm pool: write student env to %s: %v", claimed.Name, err)
+			resp.AgentTokenHash = ""
+		}
+		// 凭据随领取结果加密返回，读取失败时学生仍可使用虚拟机，只是无法查看凭据
+		if creds, _, err := loadCredentials(r.Context(), claimed.Name); err != nil {
+			log.Printf("warm pool: load credentials of %s: %v", claimed.Name, err)
+		} else if resp.Credentials, err = worker.SealCredentials(secret, claimed.Name, creds); err != nil {
+			log.Printf("warm pool: seal credentials of %s: %v", claimed.Name, err)
+		}
+
+		// 状态随领取结果返回；Pod 未在运行时（例如刚被重建）由状态回调在就绪后上报
+		if pod, err := findVMPod(r.Context(), claimed.Name); err == nil && pod.Status.Phase == apiv1.PodRunning {
+			resp.Status = "running"
+			go portForward(claimed.Name, req.VMID+80, deploymentAccessPort(claimed))
+		} else {
+			go callbackStatus(claimed, req.VMID+80)
+		}
+		triggerRefill()
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	writeError(w, http.StatusNotFound, "没有就绪的预热虚拟机")
+}
+
+// claimDeployment 修改预热标签完成领取，Update 携带资源版本，并发领取时只有一个成功
+func claimDeployment(ctx context.Context, d *appsv1.Deployment, vmid int) (*appsv1.Deployment, error) {
+	d = d.DeepCopy()
+	d.Labels[poolLabel] = poolClaimed
+	if d.Annotations == nil {
+		d.Annotations = map[string]string{}
+	}
+	d.Annotations[poolVMIDAnnotation] = strconv.Itoa(vmid)
+	d.Annotations[poolClaimedAt] = time.Now().UTC().Format(time.RFC3339)
+	return deploymentsClient.Update(ctx, d, metav1.UpdateOptions{})
+}
+
+// writeStudentEnv 预热时还不知道学生信息，领取后写入工作目录下的 .lab/env 供实验环境读取
+func writeStudentEnv(ctx context.Context, vmName string, req worker.ClaimRequest, agentToken string) error {
+	pod, err := findVMPod(ctx, vmName)
+	if err != nil {
+		return err
+	}
+
+	vars := [][2]string{
+		{"LAB_VM_NAME", vmName},
+		{"LAB_WORKSPACE", worker.WorkspaceDir},
+		{"LAB_EXPERIMENT_ID", strconv.Itoa(req.ExperimentID)},
+		{"LAB_STUDENT_ID", strconv.Itoa(req.StudentID)},
+		{"LAB_STUDENT_NUMBER", req.StudentNumber},
+	}
+	if req.Agent != nil {
+		vars = append(vars, [2]string{"LAB_AGENT_URL", req.Agent.URL}, [2]string{"LAB_AGENT_TOKEN", agentToken})
+	}
+
+	var env strings.Builder
+	for _, kv := range vars {
+		fmt.Fprintf(&env, "export %s='%s'\n", kv[0], strings.ReplaceAll(kv[1], "'", `'\''`))
+	}
+
+	var stderr limitedBuffer
+	cmd := []string{"sh", "-c", `mkdir -p "$0/.lab" && cat > "$0/.lab/env"`, worker.WorkspaceDir}
+	if err := execInPod(ctx, pod, cmd, strings.NewReader(env.String()), nil, &stderr); err != nil {
+		return fmt.Errorf("%w: %s", err, stderr.String())
+	}
+	return nil
+}
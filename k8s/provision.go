@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/queue"
+	"github.com/MeteorsLiu/virtuallabs/backend/worker"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	workspaceVolume = "workspace"
+	provisionVolume = "provision"
+	provisionMount  = "/provision"
+)
+
+// 初始化容器先把附件拷入工作目录，再在工作目录下执行实验初始化脚本
+const provisionCommand = `if [ -d /provision/files ]; then cp -rL /provision/files/. "$LAB_WORKSPACE"/; fi
+if [ -f /provision/init.sh ]; then cd "$LAB_WORKSPACE" && exec sh /provision/init.sh; fi`
+
+func provisionConfigMapName(vmName string) string {
+	return vmName + "-provision"
+}
+
+// labEnv 返回注入容器的学生变量，供初始化脚本和实验环境个性化使用
+func labEnv(vmName string, p *queue.Provision) []apiv1.EnvVar {
+	env := []apiv1.EnvVar{
+		{Name: "LAB_VM_NAME", Value: vmName},
+		{Name: "LAB_WORKSPACE", Value: worker.WorkspaceDir},
+	}
+	if p != nil {
+		env = append(env, apiv1.EnvVar{Name: "LAB_EXPERIMENT_ID", Value: strconv.Itoa(p.ExperimentID)})
+	}
+	// 令牌通过凭据 Secret 注入，见 applyCredentials
+	if p != nil && p.Agent != nil {
+		env = append(env, apiv1.EnvVar{Name: "LAB_AGENT_URL", Value: p.Agent.URL})
+	}
+	// 预热虚拟机创建时没有学生信息，领取后写入 $LAB_WORKSPACE/.lab/env
+	if p != nil && p.StudentID != 0 {
+		env = append(env,
+			apiv1.EnvVar{Name: "LAB_STUDENT_ID", Value: strconv.Itoa(p.StudentID)},
+			apiv1.EnvVar{Name: "LAB_STUDENT_NUMBER", Value: p.StudentNumber},
+		)
+	}
+	return env
+}
+
+// applyProvision 为 Deployment 挂载工作目录，并在需要时加入初始化容器
+func applyProvision(deployment *appsv1.Deployment, p *queue.Provision) {
+	spec := &deployment.Spec.Template.Spec
+	main := &spec.Containers[0]
+
+	spec.Volumes = append(spec.Volumes, apiv1.Volume{
+		Name:         workspaceVolume,
+		VolumeSource: apiv1.VolumeSource{EmptyDir: &apiv1.EmptyDirVolumeSource{}},
+	})
+	main.VolumeMounts = append(main.VolumeMounts, apiv1.VolumeMount{Name: workspaceVolume, MountPath: worker.WorkspaceDir})
+	main.Env = append(main.Env, labEnv(deployment.Name, p)...)
+
+	if p == nil || (p.InitScript == "" && len(p.Files) == 0) {
+		return
+	}
+
+	var items []apiv1.KeyToPath
+	if p.InitScript != "" {
+		items = append(items, apiv1.KeyToPath{Key: "init.sh", Path: "init.sh"})
+	}
+	for i, f := range p.Files {
+		items = append(items, apiv1.KeyToPath{Key: fileKey(i), Path: "files/" + f.Name})
+	}
+
+	spec.Volumes = append(spec.Volumes, apiv1.Volume{
+		Name: provisionVolume,
+		VolumeSource: apiv1.VolumeSource{ConfigMap: &apiv1.ConfigMapVolumeSource{
+			LocalObjectReference: apiv1.LocalObjectReference{Name: provisionConfigMapName(deployment.Name)},
+			Items:                items,
+		}},
+	})
+	spec.InitContainers = append(spec.InitContainers, apiv1.Container{
+		Name:            "provision",
+		Image:           main.Image,
+		ImagePullPolicy: main.ImagePullPolicy,
+		Command:         []string{"sh", "-c", provisionCommand},
+		Env:             labEnv(deployment.Name, p),
+		VolumeMounts: []apiv1.VolumeMount{
+			{Name: provisionVolume, MountPath: provisionMount, ReadOnly: true},
+			{Name: workspaceVolume, MountPath: worker.WorkspaceDir},
+		},
+	})
+}
+
+func fileKey(i int) string {
+	return "file-" + strconv.Itoa(i)
+}
+
+// createProvisionConfigMap 拉取实验附件并写入 ConfigMap，属主为 Deployment 以便随之回收，
+// ConfigMap 已存在时直接返回
+func createProvisionConfigMap(ctx context.Context, deployment *appsv1.Deployment, p *queue.Provision) error {
+	if p == nil || (p.InitScript == "" && len(p.Files) == 0) {
+		return nil
+	}
+	_, err := configMapClient.Get(ctx, provisionConfigMapName(deployment.Name), metav1.GetOptions{})
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	cm := &apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   provisionConfigMapName(deployment.Name),
+			Labels: map[string]string{"app": deployment.Name},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       deployment.Name,
+				UID:        deployment.UID,
+			}},
+		},
+		Data:       map[string]string{},
+		BinaryData: map[string][]byte{},
+	}
+
+	total := int64(len(p.InitScript))
+	if p.InitScript != "" {
+		cm.Data["init.sh"] = p.InitScript
+	}
+	for i, f := range p.Files {
+		b, err := fetchProvisionFile(ctx, f.URL)
+		if err != nil {
+			return fmt.Errorf("fetch %s: %w", f.Name, err)
+		}
+		total += int64(len(b))
+		if total > queue.MaxProvisionSize {
+			return fmt.Errorf("provision data exceeds %d bytes", queue.MaxProvisionSize)
+		}
+		cm.BinaryData[fileKey(i)] = b
+	}
+
+	_, err = configMapClient.Create(ctx, cm, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+// fetchProvisionFile 从后端 /uploads 下载实验附件
+func fetchProvisionFile(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, backendAddr+url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, queue.MaxProvisionSize+1))
+}
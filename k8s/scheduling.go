@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/MeteorsLiu/virtuallabs/backend/queue"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// applySpec 校验附件名并应用镜像和调度约束，需在 applyProvision 之前调用
+func applySpec(deployment *appsv1.Deployment, p *queue.Provision) error {
+	if p == nil {
+		return nil
+	}
+	if err := p.ValidateFiles(); err != nil {
+		return err
+	}
+	if err := applyImage(deployment, p.Image); err != nil {
+		return err
+	}
+	return applyScheduling(deployment, p.Scheduling)
+}
+
+// applyScheduling 将节点选择、亲和性、容忍和优先级写入 Pod 模板，节点标签与模板中的合并
+func applyScheduling(deployment *appsv1.Deployment, s *queue.Scheduling) error {
+	if s.IsZero() {
+		return nil
+	}
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	spec := &deployment.Spec.Template.Spec
+
+	if len(s.NodeSelector) > 0 {
+		if spec.NodeSelector == nil {
+			spec.NodeSelector = map[string]string{}
+		}
+		for k, v := range s.NodeSelector {
+			spec.NodeSelector[k] = v
+		}
+	}
+
+	affinity, err := s.AffinitySpec()
+	if err != nil {
+		return err
+	}
+	if affinity != nil {
+		spec.Affinity = affinity
+	}
+
+	for _, t := range s.Tolerations {
+		spec.Tolerations = append(spec.Tolerations, apiv1.Toleration{
+			Key:               t.Key,
+			Operator:          apiv1.TolerationOperator(t.Operator),
+			Value:             t.Value,
+			Effect:            apiv1.TaintEffect(t.Effect),
+			TolerationSeconds: t.TolerationSeconds,
+		})
+	}
+
+	if s.PriorityClassName != "" {
+		spec.PriorityClassName = s.PriorityClassName
+	}
+	return nil
+}
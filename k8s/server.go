@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/MeteorsLiu/virtuallabs/backend/worker"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// serveAPI 启动仅供后端调用的管理接口
+func serveAPI(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /vms/{name}/logs", podLogsHandler)
+	mux.HandleFunc("GET /vms/{name}/files", downloadFileHandler)
+	mux.HandleFunc("PUT /vms/{name}/files", uploadFileHandler)
+	mux.HandleFunc("POST /pool/claim", claimHandler)
+
+	log.Println("worker api listening on", addr)
+	if err := http.ListenAndServe(addr, requireSecret(mux)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// requireSecret 校验后端请求携带的共享密钥，未配置密钥时放行
+func requireSecret(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if secret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(worker.SecretHeader)), []byte(secret)) != 1 {
+			writeError(w, http.StatusUnauthorized, "invalid worker secret")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// vmNameFromPath 取出并校验路径中的虚拟机名，避免拼接出非法的标签选择器
+func vmNameFromPath(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := r.PathValue("name")
+	if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "无效的虚拟机名")
+		return "", false
+	}
+	return name, true
+}
+
+// findVMPod 返回 Deployment 下最新创建的 Pod
+func findVMPod(ctx context.Context, vmName string) (*apiv1.Pod, error) {
+	pods, err := podClient.List(ctx, metav1.ListOptions{LabelSelector: "app=" + vmName})
+	if err != nil {
+		return nil, err
+	}
+	if len(pods.Items) == 0 {
+		return nil, fmt.Errorf("vm %s has no pod", vmName)
+	}
+	sort.Slice(pods.Items, func(i, j int) bool {
+		return pods.Items[j].CreationTimestamp.Before(&pods.Items[i].CreationTimestamp)
+	})
+	return &pods.Items[0], nil
+}
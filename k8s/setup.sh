@@ -4,4 +4,11 @@ kubectl create token k8stoken --duration 99999999s
 kubectl apply -f  t2.yml
 kubectl apply -f  t.yml
 kubectl apply -f  t3.yml
+kubectl apply -f  t4.yml
 
+kubectl apply -f  t5.yml
+kubectl apply -f  t6.yml
+kubectl apply -f  t7.yml
+kubectl apply -f  t8.yml
+kubectl apply -f  t9.yml
+kubectl apply -f  priorityclasses.yml